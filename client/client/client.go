@@ -0,0 +1,370 @@
+// Package client is a Go client of the Nabia HTTP API, on which the
+// nabia-client command is built. Programs can use it to read and write the
+// keys of a Nabia server without going through the command line.
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client sends requests to a Nabia server. Its fields must be set before the
+// first request, after which it is safe for concurrent use.
+type Client struct {
+	Host  string
+	Port  uint16
+	HTTPS bool
+	// HTTPClient sends the requests, http.DefaultClient when nil. Its
+	// transport holds the TLS settings, such as the CA to trust.
+	HTTPClient *http.Client
+	// Token is sent as a bearer token, for servers requiring API keys. No
+	// Authorization header is sent while it is empty.
+	Token string
+	// Retries is how many times a request is retried after a connection
+	// error, other than an untrusted certificate, or a 5xx response. POST
+	// requests aren't idempotent, so they are only retried with RetryPOST.
+	Retries   int
+	RetryPOST bool
+	// Verify makes Get and Stream check the value received against the
+	// checksum sent by the server, failing with ErrChecksumMismatch.
+	Verify bool
+	// Logf reports retries and verified checksums, nothing is reported when
+	// it is nil.
+	Logf func(format string, v ...any)
+}
+
+// New returns a client of the server listening on host and port, over HTTP,
+// without retries.
+func New(host string, port uint16) *Client {
+	return &Client{Host: host, Port: port}
+}
+
+// Errors returned for the statuses callers react to, wrapped along with the
+// status.
+var (
+	ErrBadRequest = errors.New("bad request")
+	ErrNotFound   = errors.New("key not found")
+	ErrConflict   = errors.New("key already exists")
+	ErrServer     = errors.New("server error")
+)
+
+// ErrChecksumMismatch is returned with Verify when the data received doesn't
+// match the checksum sent by the server, as after a truncated download.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrListingUnsupported is returned by List when the server predates /_keys.
+var ErrListingUnsupported = errors.New("listing keys is not supported by this server")
+
+// checksumHeader carries the CRC-32 of the values served by the server.
+const checksumHeader = "X-Nabia-CRC32"
+
+// userAgent identifies the client to the server.
+const userAgent = "nabia-client/0.1"
+
+// retryBackoff is the delay before the first retry, doubled on every retry.
+var retryBackoff = 200 * time.Millisecond
+
+// maxRetryDelay bounds the delay between two attempts, including the one a
+// server asks for with Retry-After.
+const maxRetryDelay = 30 * time.Second
+
+// retryDelay returns how long to wait before retrying after the given number
+// of failed attempts: the Retry-After of the response if there is one, and
+// otherwise an exponential backoff with jitter, so that clients failing at the
+// same time don't retry in lockstep.
+func retryDelay(attempts int, response *http.Response) time.Duration {
+	if response != nil {
+		if header := response.Header.Get("Retry-After"); header != "" {
+			if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+				return min(time.Duration(seconds)*time.Second, maxRetryDelay)
+			}
+			if date, err := http.ParseTime(header); err == nil {
+				return min(max(time.Until(date), 0), maxRetryDelay)
+			}
+		}
+	}
+	backoff := maxRetryDelay
+	if attempts <= 16 { // past that the shift could overflow
+		backoff = min(retryBackoff<<(attempts-1), maxRetryDelay)
+	}
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+func (c *Client) logf(format string, v ...any) {
+	if c.Logf != nil {
+		c.Logf(format, v...)
+	}
+}
+
+// do sends a request, with value as its body of type ctype unless value is
+// nil, and retries it as allowed by Retries and RetryPOST.
+func (c *Client) do(method string, key string, query url.Values, value []byte, ctype string) (*http.Response, error) {
+	u := &url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort(c.Host, strconv.Itoa(int(c.Port))),
+		Path:     key,
+		RawQuery: query.Encode(),
+	}
+	if c.HTTPS {
+		u.Scheme = "https"
+	}
+
+	retries := c.Retries
+	if method == "POST" && !c.RetryPOST {
+		retries = 0
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	for attempts := 1; ; attempts++ {
+		var body io.Reader
+		if value != nil {
+			body = bytes.NewReader(value)
+		}
+		req, err := http.NewRequest(method, u.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		if value != nil {
+			if ctype == "" {
+				ctype = "application/octet-stream" // https://www.iana.org/assignments/media-types/application/octet-stream
+			}
+			req.Header.Set("Content-Type", ctype)
+		}
+		req.Header.Set("User-Agent", userAgent)
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+
+		response, err := client.Do(req)
+		var certificateError *tls.CertificateVerificationError
+		if attempts > retries || (err == nil && response.StatusCode/100 != 5) || errors.As(err, &certificateError) {
+			return response, err // a certificate won't be trusted on the next attempt either
+		}
+		delay := retryDelay(attempts, response)
+		if err != nil {
+			c.logf("Request failed, retrying in %s: %s", delay, err)
+		} else {
+			c.logf("Server answered %s, retrying in %s", response.Status, delay)
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+		time.Sleep(delay)
+	}
+}
+
+// checkStatus returns nil for 2xx responses, and otherwise an error wrapping
+// the one matching the status, if any.
+func checkStatus(response *http.Response) error {
+	if response.StatusCode/100 == 2 {
+		return nil
+	}
+	err := fmt.Errorf("expected 2xx response code, got %s", response.Status)
+	switch {
+	case response.StatusCode == http.StatusBadRequest:
+		return fmt.Errorf("%w: %w", ErrBadRequest, err)
+	case response.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case response.StatusCode == http.StatusConflict:
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	case response.StatusCode/100 == 5:
+		return fmt.Errorf("%w: %w", ErrServer, err)
+	default:
+		return err
+	}
+}
+
+// verifyChecksum compares sum, the CRC-32 of the data received, to the one
+// sent by the server in header, and reports it once verified.
+func (c *Client) verifyChecksum(header http.Header, sum uint32) error {
+	expected := header.Get(checksumHeader)
+	if expected == "" {
+		return fmt.Errorf("cannot verify the data: the server sent no %s header", checksumHeader)
+	}
+	received := fmt.Sprintf("%08x", sum)
+	if !strings.EqualFold(expected, received) {
+		return fmt.Errorf("%w: received data has CRC-32 %s, expected %s", ErrChecksumMismatch, received, expected)
+	}
+	c.logf("Verified CRC-32 %s", received)
+	return nil
+}
+
+// Get returns the value of key along with its Content-Type.
+func (c *Client) Get(key string) ([]byte, string, error) {
+	response, err := c.do("GET", key, nil, nil, "")
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkStatus(response); err != nil {
+		return nil, "", err
+	}
+	if c.Verify {
+		if err := c.verifyChecksum(response.Header, crc32.ChecksumIEEE(body)); err != nil {
+			return nil, "", err
+		}
+	}
+	return body, response.Header.Get("Content-Type"), nil
+}
+
+// Stream copies the value of key to dst as it is received, without holding it
+// in memory, and returns its Content-Type and size. This keeps memory usage
+// flat no matter how large the value is. The bytes are copied as they are,
+// whatever their Content-Type.
+func (c *Client) Stream(key string, dst io.Writer) (string, int64, error) {
+	response, err := c.do("GET", key, nil, nil, "")
+	if err != nil {
+		return "", 0, err
+	}
+	defer response.Body.Close()
+
+	if err := checkStatus(response); err != nil {
+		return "", 0, err
+	}
+	checksum := crc32.NewIEEE()
+	written, err := io.Copy(io.MultiWriter(dst, checksum), response.Body)
+	if err != nil {
+		return "", written, err
+	}
+	if c.Verify {
+		if err := c.verifyChecksum(response.Header, checksum.Sum32()); err != nil {
+			return "", written, err
+		}
+	}
+	return response.Header.Get("Content-Type"), written, nil
+}
+
+// Head tells whether key exists.
+func (c *Client) Head(key string) (bool, error) {
+	response, err := c.do("HEAD", key, nil, nil, "")
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := checkStatus(response); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Options returns the methods allowed on key, as listed by the Allow header.
+func (c *Client) Options(key string) (string, error) {
+	response, err := c.do("OPTIONS", key, nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if err := checkStatus(response); err != nil {
+		return "", err
+	}
+
+	allow := response.Header.Get("Allow")
+	if allow == "" {
+		return "", fmt.Errorf("the server answered %s without an Allow header", response.Status)
+	}
+	return allow, nil
+}
+
+// Post creates key with value, of type ctype, and fails with ErrConflict if
+// it already exists.
+func (c *Client) Post(key string, value []byte, ctype string) error {
+	return c.write("POST", key, value, ctype)
+}
+
+// Put creates or replaces key with value, of type ctype.
+func (c *Client) Put(key string, value []byte, ctype string) error {
+	return c.write("PUT", key, value, ctype)
+}
+
+func (c *Client) write(method string, key string, value []byte, ctype string) error {
+	if value == nil {
+		value = []byte{}
+	}
+	response, err := c.do(method, key, nil, value, ctype)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return checkStatus(response)
+}
+
+// Delete deletes key.
+func (c *Client) Delete(key string) error {
+	response, err := c.do("DELETE", key, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return checkStatus(response)
+}
+
+// KeyListing is a key listed by List, along with its value and Content-Type
+// when they were asked for.
+type KeyListing struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type,omitempty"`
+	Value       []byte `json:"value,omitempty"`
+}
+
+// List lists, in lexicographic order, the keys starting with prefix, at most
+// limit of them unless limit is 0, and with their values if values is set.
+func (c *Client) List(prefix string, limit int, values bool) ([]KeyListing, error) {
+	query := url.Values{"prefix": {prefix}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if values {
+		query.Set("values", "true")
+	}
+	response, err := c.do("GET", "/_keys", query, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, ErrListingUnsupported // older servers take /_keys for a key
+	}
+	if err := checkStatus(response); err != nil {
+		return nil, err
+	}
+
+	var listing []KeyListing
+	if values {
+		err = json.NewDecoder(response.Body).Decode(&listing)
+	} else {
+		var keys []string
+		err = json.NewDecoder(response.Body).Decode(&keys)
+		for _, key := range keys {
+			listing = append(listing, KeyListing{Key: key})
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed listing: %s", err)
+	}
+	return listing, nil
+}
@@ -0,0 +1,320 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client of a server running handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	p, _ := strconv.Atoi(port)
+	return New(host, uint16(p))
+}
+
+// storeHandler serves keys held in memory, as the server does.
+func storeHandler() http.HandlerFunc {
+	var mu sync.Mutex
+	type value struct {
+		data  []byte
+		ctype string
+	}
+	values := map[string]value{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		v, exists := values[r.URL.Path]
+		switch r.Method {
+		case "GET", "HEAD":
+			if !exists {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", v.ctype)
+			w.Header().Set(checksumHeader, fmt.Sprintf("%08x", crc32.ChecksumIEEE(v.data)))
+			w.Write(v.data)
+		case "POST", "PUT":
+			if r.Method == "POST" && exists {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			data, _ := io.ReadAll(r.Body)
+			values[r.URL.Path] = value{data, r.Header.Get("Content-Type")}
+			w.WriteHeader(http.StatusCreated)
+		case "DELETE":
+			if !exists {
+				http.NotFound(w, r)
+				return
+			}
+			delete(values, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		case "OPTIONS":
+			w.Header().Set("Allow", "GET, HEAD, POST, PUT, DELETE, OPTIONS")
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	c := newTestClient(t, storeHandler())
+	c.Verify = true
+
+	if exists, err := c.Head("/key"); err != nil || exists {
+		t.Errorf("Unexpected HEAD of a missing key: %t (%v)", exists, err)
+	}
+	if _, _, err := c.Get("/key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := c.Post("/key", []byte("value"), "text/plain"); err != nil {
+		t.Fatalf("Failed to POST: %s", err)
+	}
+	if err := c.Post("/key", []byte("value"), "text/plain"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	if exists, err := c.Head("/key"); err != nil || !exists {
+		t.Errorf("Unexpected HEAD of an existing key: %t (%v)", exists, err)
+	}
+	if err := c.Put("/key", []byte("new value"), ""); err != nil {
+		t.Fatalf("Failed to PUT: %s", err)
+	}
+	data, ctype, err := c.Get("/key")
+	if err != nil || string(data) != "new value" || ctype != "application/octet-stream" {
+		t.Errorf("Unexpected GET: %q of %q (%v)", data, ctype, err)
+	}
+	var buffer bytes.Buffer
+	if ctype, written, err := c.Stream("/key", &buffer); err != nil || buffer.String() != "new value" || written != 9 || ctype != "application/octet-stream" {
+		t.Errorf("Unexpected stream: %q, %d bytes of %q (%v)", buffer.String(), written, ctype, err)
+	}
+	if allow, err := c.Options("/key"); err != nil || !strings.Contains(allow, "DELETE") {
+		t.Errorf("Unexpected OPTIONS: %q (%v)", allow, err)
+	}
+	if err := c.Delete("/key"); err != nil {
+		t.Fatalf("Failed to DELETE: %s", err)
+	}
+	if err := c.Delete("/key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// An empty value is sent as such
+	if err := c.Put("/empty", nil, "text/plain"); err != nil {
+		t.Fatalf("Failed to PUT an empty value: %s", err)
+	}
+	if data, _, err := c.Get("/empty"); err != nil || len(data) != 0 {
+		t.Errorf("Unexpected empty value: %q (%v)", data, err)
+	}
+}
+
+func TestToken(t *testing.T) {
+	var authorization []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+	})
+	c.Get("/key")
+	c.Token = "secret"
+	c.Get("/key")
+	if strings.Join(authorization, ",") != ",Bearer secret" {
+		t.Errorf("Unexpected Authorization headers: %q", authorization)
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	table := []struct {
+		status   int
+		expected error // nil for success
+	}{
+		{http.StatusOK, nil},
+		{http.StatusNoContent, nil},
+		{http.StatusBadRequest, ErrBadRequest},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusConflict, ErrConflict},
+		{http.StatusInternalServerError, ErrServer},
+		{http.StatusForbidden, nil}, // an error, but none of the typed ones
+	}
+	typed := []error{ErrBadRequest, ErrNotFound, ErrConflict, ErrServer}
+	for _, row := range table {
+		err := checkStatus(&http.Response{StatusCode: row.status, Status: http.StatusText(row.status)})
+		if (err == nil) != (row.status/100 == 2) {
+			t.Errorf("Unexpected error for %d: %v", row.status, err)
+		}
+		for _, e := range typed {
+			if errors.Is(err, e) != (e == row.expected) {
+				t.Errorf("Unexpected error for %d: %v", row.status, err)
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	value := []byte("verified value")
+	var checksum string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if checksum != "" {
+			w.Header().Set(checksumHeader, checksum)
+		}
+		w.Write(value)
+	})
+	var logs []string
+	c.Logf = func(format string, v ...any) { logs = append(logs, fmt.Sprintf(format, v...)) }
+
+	correct := fmt.Sprintf("%08x", crc32.ChecksumIEEE(value))
+	table := []struct {
+		verify   bool
+		checksum string
+		ok       bool
+	}{
+		{true, correct, true},
+		{true, strings.ToUpper(correct), true},
+		{true, "00000000", false},
+		{true, "", false},
+		{false, "00000000", true}, // only checked with Verify
+	}
+	for _, row := range table {
+		c.Verify = row.verify
+		checksum = row.checksum
+		logs = nil
+		data, _, err := c.Get("/key")
+		_, _, streamErr := c.Stream("/key", io.Discard)
+		for _, err := range []error{err, streamErr} {
+			if (err == nil) != row.ok {
+				t.Errorf("Unexpected error with Verify %t and checksum %q: %v", row.verify, row.checksum, err)
+			}
+		}
+		if row.checksum == "00000000" && row.verify && !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("A wrong checksum wasn't reported as a mismatch: %v", err)
+		}
+		if row.ok && !bytes.Equal(data, value) {
+			t.Errorf("Unexpected data: got %q, expected %q", data, value)
+		}
+		if row.verify && row.ok && len(logs) != 2 {
+			t.Errorf("The verified checksum wasn't reported by both downloads: %q", logs)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	var query url.Values
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		if query.Get("values") == "true" {
+			io.WriteString(w, `[{"key":"/a/1","content_type":"text/plain","value":"dmFsdWU="}]`)
+		} else {
+			io.WriteString(w, `["/a/1","/a/2"]`)
+		}
+	})
+	listing, err := c.List("/a/", 0, false)
+	if err != nil || len(listing) != 2 || listing[1].Key != "/a/2" || query.Get("prefix") != "/a/" || query.Has("limit") {
+		t.Errorf("Unexpected listing: %+v (%v), queried with %v", listing, err, query)
+	}
+	listing, err = c.List("/a/", 1, true)
+	if err != nil || len(listing) != 1 || string(listing[0].Value) != "value" || listing[0].ContentType != "text/plain" || query.Get("limit") != "1" {
+		t.Errorf("Unexpected listing with values: %+v (%v), queried with %v", listing, err, query)
+	}
+
+	c = newTestClient(t, http.NotFound)
+	if _, err := c.List("", 0, false); !errors.Is(err, ErrListingUnsupported) {
+		t.Errorf("Expected ErrListingUnsupported, got %v", err)
+	}
+}
+
+// flakyServer fails the first failures requests with status, then answers 200.
+func flakyServer(t *testing.T, failures int, status int, retryAfter string) (*Client, *int32) {
+	t.Helper()
+	var count int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if int(atomic.AddInt32(&count, 1)) <= failures {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	return c, &count
+}
+
+func TestRetries(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = backoff })
+
+	table := []struct {
+		name       string
+		method     string
+		failures   int
+		status     int
+		retryPost  bool
+		succeeds   bool
+		attempts   int32
+		retryAfter string
+	}{
+		{"recovers within the budget", "PUT", 3, http.StatusServiceUnavailable, false, true, 4, ""},
+		{"gives up past the budget", "PUT", 4, http.StatusInternalServerError, false, false, 4, ""},
+		{"never retries 4xx", "DELETE", 1, http.StatusNotFound, false, false, 1, ""},
+		{"never retries POST by default", "POST", 1, http.StatusBadGateway, false, false, 1, ""},
+		{"retries POST when allowed", "POST", 1, http.StatusBadGateway, true, true, 2, ""},
+		{"honors Retry-After", "PUT", 1, http.StatusServiceUnavailable, false, true, 2, "1"},
+	}
+	for _, row := range table {
+		c, count := flakyServer(t, row.failures, row.status, row.retryAfter)
+		c.Retries, c.RetryPOST = 3, row.retryPost
+		start := time.Now()
+		response, err := c.do(row.method, "/key", nil, []byte("value"), "")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", row.name, err)
+		}
+		response.Body.Close()
+		if succeeded := response.StatusCode == http.StatusOK; succeeded != row.succeeds {
+			t.Errorf("%s: unexpected final status %d", row.name, response.StatusCode)
+		}
+		if attempts := atomic.LoadInt32(count); attempts != row.attempts {
+			t.Errorf("%s: got %d attempts, expected %d", row.name, attempts, row.attempts)
+		}
+		if row.retryAfter != "" && time.Since(start) < time.Second {
+			t.Errorf("%s: retried after %s", row.name, time.Since(start))
+		}
+	}
+
+	// Connection errors are retried too, and the last one is returned
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %s", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	c := New("127.0.0.1", uint16(port))
+	c.Retries = 2
+	var retries int
+	c.Logf = func(string, ...any) { retries++ }
+	if _, _, err := c.Get("/key"); err == nil || retries != 2 {
+		t.Errorf("Expected a connection error after 2 retries, got %v after %d", err, retries)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts := 1; attempts < 40; attempts++ {
+		if delay := retryDelay(attempts, nil); delay <= 0 || delay > maxRetryDelay {
+			t.Errorf("Unbounded delay after %d attempts: %s", attempts, delay)
+		}
+	}
+	response := &http.Response{Header: http.Header{"Retry-After": []string{"3600"}}}
+	if delay := retryDelay(1, response); delay != maxRetryDelay {
+		t.Errorf("Retry-After wasn't bounded: got %s", delay)
+	}
+}
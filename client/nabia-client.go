@@ -1,17 +1,21 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net"
+	"mime"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"unicode/utf8"
 
+	"github.com/Nabia-DB/nabia/client/client"
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -31,158 +35,331 @@ func detectBytesliceMimetype(byteSlice []byte) string {
 	return mtype.String()
 }
 
-func makeRequest(method string, key string, host string, port uint16, value []byte, ctype ...string) (*http.Response, error) {
-	u := &url.URL{
-		Scheme: "http",
-		Host:   net.JoinHostPort(host, strconv.Itoa(int(port))),
-		Path:   key,
+// printable tells whether data of type ctype is text, which GET prints: any
+// text/* type, JSON and XML, as long as data is valid UTF-8.
+func printable(ctype string, data []byte) bool {
+	mediatype, _, err := mime.ParseMediaType(ctype)
+	if err != nil || !utf8.Valid(data) {
+		return false
 	}
-
-	var req *http.Request
-	var err error
-
-	if value != nil {
-		req, err = http.NewRequest(method, u.String(), bytes.NewReader(value))
-	} else {
-		req, err = http.NewRequest(method, u.String(), nil)
+	switch {
+	case strings.HasPrefix(mediatype, "text/"):
+		return true
+	case mediatype == "application/json", mediatype == "application/xml":
+		return true
+	default:
+		return strings.HasSuffix(mediatype, "+json") || strings.HasSuffix(mediatype, "+xml")
 	}
+}
 
-	if err != nil {
-		return nil, err
+// contentType returns the Content-Type to send content with: the one given
+// with --content-type, or otherwise the one detected from content.
+func contentType(content []byte) (string, error) {
+	ctype := viper.GetString("content-type")
+	if ctype == "" {
+		return detectBytesliceMimetype(content), nil
+	}
+	if _, _, err := mime.ParseMediaType(ctype); err != nil {
+		return "", fmt.Errorf("invalid content type %q: %s", ctype, err)
 	}
+	return ctype, nil
+}
 
-	if len(ctype) == 0 { // unknown Content-Type, let's set a default
-		req.Header.Set("Content-Type", "application/octet-stream") // https://www.iana.org/assignments/media-types/application/octet-stream
-	} else { // Content-Type was set
-		req.Header.Set("Content-Type", ctype[0]) // https://www.iana.org/assignments/media-types/application/octet-stream
+// newHTTPClient returns the client to send requests with. With --ca-cert the
+// server certificate is verified against that CA instead of the system ones,
+// and with --insecure it isn't verified at all, for self-signed certificates.
+func newHTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: viper.GetBool("insecure")}
+	if caCert := viper.GetString("ca-cert"); caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
 	}
-	req.Header.Set("User-Agent", "nabia-client/0.1")
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
 
-	client := &http.Client{}
-	response, err := client.Do(req)
+// newClient returns a client of the server set with --host and --port, sending
+// requests as set by the other flags.
+func newClient() (*client.Client, error) {
+	httpClient, err := newHTTPClient()
 	if err != nil {
 		return nil, err
 	}
-
-	return response, nil
+	c := client.New(viper.GetString("host"), uint16(viper.GetInt("port")))
+	c.HTTPS = viper.GetBool("https")
+	c.HTTPClient = httpClient
+	c.Token = viper.GetString("token")
+	c.Retries = viper.GetInt("retries")
+	c.RetryPOST = viper.GetBool("retry-post")
+	c.Verify = viper.GetBool("verify")
+	c.Logf = log.Printf
+	return c, nil
 }
 
-func optionsData(key string, host string, port uint16) (string, error) {
-	response, err := makeRequest("OPTIONS", key, host, port, nil)
-	if err != nil {
-		return "", err
+// exitCode returns the exit status of the client after err: 2 for a bad
+// request, 3 for a missing key, 4 for a conflict, 5 for a server error, and 1
+// otherwise.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, client.ErrBadRequest):
+		return 2
+	case errors.Is(err, client.ErrNotFound):
+		return 3
+	case errors.Is(err, client.ErrConflict):
+		return 4
+	case errors.Is(err, client.ErrServer):
+		return 5
+	default:
+		return 1
 	}
-	defer response.Body.Close()
+}
 
-	optionsString := response.Header.Get("Allow")
-	if len(optionsString) == 0 {
-		log.Fatalf("Unknown error while trying to \"OPTIONS\" %s at %s:%d: Empty Allow header", key, host, port)
-	}
-	return optionsString, nil
+// fail reports err and exits with the matching code.
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(exitCode(err))
 }
 
-func headData(key string, host string, port uint16) (bool, error) {
-	response, err := makeRequest("HEAD", key, host, port, nil)
-	if err != nil {
-		return false, err
+// dryRun reports, without sending anything, the request that a mutating
+// command would make when --dry-run is set. It returns true if the request
+// must not be sent.
+func dryRun(cmd *cobra.Command, method string, key string, host string, port uint16, value []byte, ctype string) bool {
+	if !viper.GetBool("dry-run") {
+		return false
 	}
-	defer response.Body.Close()
-
-	if response.StatusCode/100 != 2 {
-		return false, nil
+	if value != nil {
+		fmt.Fprintf(cmd.OutOrStdout(), "Dry run: would %s %d bytes of %q to key %s at %s:%d\n", method, len(value), ctype, key, host, port)
+	} else {
+		fmt.Fprintf(cmd.OutOrStdout(), "Dry run: would %s key %s at %s:%d\n", method, key, host, port)
 	}
-
-	return true, nil
+	return true
 }
 
-func getData(key string, host string, port uint16) ([]byte, string, error) {
-	response, err := makeRequest("GET", key, host, port, nil)
+// streamToFile downloads key into the file at path. The value is streamed into
+// a temporary file next to it, renamed over path only once complete, so a
+// failed download leaves an existing file untouched, permissions included.
+func streamToFile(c *client.Client, key string, path string) (string, int64, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
 	if err != nil {
-		return nil, "", err
+		return "", 0, fmt.Errorf("error creating output file: %s", err)
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	ctype, written, err := c.Stream(key, file)
+	if err == nil {
+		err = file.Chmod(mode)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
 	}
-	defer response.Body.Close()
-
-	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return nil, "", err
+		os.Remove(file.Name())
+		return "", 0, err
 	}
+	return ctype, written, nil
+}
 
-	if response.StatusCode/100 != 2 {
-		return nil, "", fmt.Errorf("expected 2xx response code, got %s", response.Status)
+// runBatchLine executes one command of a batch, such as "PUT /key value", and
+// returns its result. The value is the rest of the line, spaces included.
+func runBatchLine(cmd *cobra.Command, c *client.Client, line string) (string, error) {
+	method, rest, _ := strings.Cut(line, " ")
+	key, value, hasValue := strings.Cut(strings.TrimLeft(rest, " "), " ")
+	if key == "" {
+		return "", fmt.Errorf("a key is required")
 	}
-
-	ctype := response.Header.Get("Content-Type")
-
-	return body, ctype, nil
+	switch method {
+	case "GET":
+		data, ctype, err := c.Get(key)
+		if err != nil {
+			return "", err
+		}
+		if printable(ctype, data) {
+			return fmt.Sprintf("%q", string(data)), nil
+		}
+		return fmt.Sprintf("%d bytes of %q", len(data), ctype), nil
+	case "HEAD":
+		exists, err := c.Head(key)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return "", fmt.Errorf("key %q does not exist", key)
+		}
+		return "exists", nil
+	case "POST", "PUT":
+		if !hasValue || value == "" {
+			return "", fmt.Errorf("a value is required")
+		}
+		ctype, err := contentType([]byte(value))
+		if err != nil {
+			return "", err
+		}
+		if dryRun(cmd, method, key, c.Host, c.Port, []byte(value), ctype) {
+			return "dry run", nil
+		}
+		if method == "POST" {
+			err = c.Post(key, []byte(value), ctype)
+		} else {
+			err = c.Put(key, []byte(value), ctype)
+		}
+		if err != nil {
+			return "", err
+		}
+		return "done", nil
+	case "DELETE":
+		if dryRun(cmd, method, key, c.Host, c.Port, nil, "") {
+			return "dry run", nil
+		}
+		if err := c.Delete(key); err != nil {
+			return "", err
+		}
+		return "done", nil
+	}
+	return "", fmt.Errorf("unknown command %q", method)
 }
 
-func postData(key string, host string, port uint16, value []byte, ctype string) error {
-	response, err := makeRequest("POST", key, host, port, value, ctype)
+// deletePrefix deletes every key starting with prefix, once confirmed with
+// --yes or interactively, and reports the outcome for each of them.
+func deletePrefix(cmd *cobra.Command, c *client.Client, prefix string) error {
+	listing, err := c.List(prefix, 0, false)
 	if err != nil {
 		return err
 	}
-	defer response.Body.Close()
-
-	if response.StatusCode/100 != 2 {
-		return fmt.Errorf("expected 2xx response code, got %s", response.Status)
+	out := cmd.OutOrStdout()
+	if len(listing) == 0 {
+		fmt.Fprintf(out, "No key starts with %s at %s:%d\n", prefix, c.Host, c.Port)
+		return nil
+	}
+	if viper.GetBool("dry-run") {
+		for _, l := range listing {
+			dryRun(cmd, "DELETE", l.Key, c.Host, c.Port, nil, "")
+		}
+		return nil
+	}
+	if !viper.GetBool("yes") {
+		fmt.Fprintf(out, "Delete %d keys starting with %s at %s:%d? [y/N] ", len(listing), prefix, c.Host, c.Port)
+		answer, _ := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			return fmt.Errorf("deletion not confirmed, nothing was deleted")
+		}
+	}
+	deleted := 0
+	for _, l := range listing {
+		if err := c.Delete(l.Key); err != nil {
+			fmt.Fprintf(out, "Failed to delete key %s: %s\n", l.Key, err)
+			continue
+		}
+		deleted++
+		fmt.Fprintf(out, "Deleted key %s\n", l.Key)
+	}
+	fmt.Fprintf(out, "Deleted %d of %d keys\n", deleted, len(listing))
+	if deleted < len(listing) {
+		return fmt.Errorf("%d keys couldn't be deleted", len(listing)-deleted)
 	}
-
 	return nil
 }
 
-func putData(key string, host string, port uint16, value []byte, ctype string) error {
-	response, err := makeRequest("PUT", key, host, port, value, ctype)
-	if err != nil {
-		return err
+// loadConfig reads the configuration file at path or, without one, the
+// optional nabia-client file of the user's configuration directory, such as
+// ~/.config/nabia/nabia-client.yaml, then applies the selected profile.
+func loadConfig(path string) error {
+	if path != "" {
+		viper.SetConfigFile(path)
+	} else {
+		viper.SetConfigName("nabia-client")
+		if dir, err := os.UserConfigDir(); err == nil {
+			viper.AddConfigPath(filepath.Join(dir, "nabia"))
+		}
 	}
-	defer response.Body.Close()
-
-	if response.StatusCode/100 != 2 {
-		return fmt.Errorf("expected 2xx response code, got %s", response.Status)
+	if err := viper.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if path != "" || !errors.As(err, &notFound) {
+			return fmt.Errorf("reading the configuration: %w", err)
+		}
 	}
-
-	return nil
+	return applyProfile()
 }
 
-func deleteData(key string, host string, port uint16) error {
-	response, err := makeRequest("DELETE", key, host, port, nil)
-	if err != nil {
-		return err
+// applyProfile merges the settings of the profile selected with --profile or
+// NABIA_PROFILE, such as its host and port, over the top-level settings of the
+// configuration file. Flags and environment variables still take precedence.
+// Without a selected profile the top-level settings are used as they are.
+func applyProfile() error {
+	name := viper.GetString("profile")
+	if name == "" {
+		return nil
 	}
-	defer response.Body.Close()
-
-	if response.StatusCode/100 != 2 {
-		return fmt.Errorf("expected 2xx response code, got %s", response.Status)
+	profile := viper.Sub("profiles." + name)
+	if profile == nil {
+		return fmt.Errorf("profile %q isn't defined in the configuration", name)
 	}
-
-	return nil
+	return viper.MergeConfigMap(profile.AllSettings())
 }
 
-func main() {
+// newRootCmd builds the command line interface of the client.
+func newRootCmd() *cobra.Command {
 	var rootCmd = &cobra.Command{
 		Use:   "nabia-client",
 		Short: "Nabia client application",
+		// Errors are reported by main, with an exit code telling them apart
+		SilenceErrors: true,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			// The arguments are valid by now, so errors don't call for the usage
+			cmd.SilenceUsage = true
+		},
 	}
 
 	var getCmd = &cobra.Command{
 		Use:   "GET [key]",
 		Short: "GET a key",
 		Args:  cobra.ExactArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			key := args[0]
-			host := viper.GetString("host")
-			port := viper.GetInt("port")
-			fmt.Printf("Getting key %s from %s:%d\n", key, host, port)
-			data, ctype, err := getData(key, host, uint16(port))
+			c, err := newClient()
 			if err != nil {
-				log.Fatalf(err.Error())
-			} else {
-				if ctype == "text/plain; charset=utf-8" && utf8.Valid(data) {
-					fmt.Printf("%q\n", string(data))
+				return err
+			}
+			if output := viper.GetString("output"); output != "" {
+				// Progress goes to stderr, so stdout only carries the value
+				fmt.Fprintf(cmd.ErrOrStderr(), "Getting key %s from %s:%d\n", key, c.Host, c.Port)
+				var ctype string
+				var written int64
+				if output == "-" {
+					ctype, written, err = c.Stream(key, cmd.OutOrStdout())
 				} else {
-					fmt.Printf("Data is %q, not plain text, refusing to print to stdout.\n", ctype)
+					ctype, written, err = streamToFile(c, key, output)
 				}
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.ErrOrStderr(), "Saved %d bytes of %q\n", written, ctype)
+				return nil
+			}
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Getting key %s from %s:%d\n", key, c.Host, c.Port)
+			data, ctype, err := c.Get(key)
+			if err != nil {
+				return err
 			}
+			if printable(ctype, data) || viper.GetBool("force") {
+				fmt.Fprintf(out, "%q\n", string(data))
+			} else {
+				fmt.Fprintf(out, "Data is %q, not text, refusing to print to stdout. Use --force to print it anyway.\n", ctype)
+			}
+			return nil
 		},
 	}
 
@@ -190,43 +367,44 @@ func main() {
 		Use:   "POST [key] [value]",
 		Short: "POST value to a key",
 		Args:  cobra.MinimumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			key := args[0]
-			host := viper.GetString("host")
-			port := viper.GetInt("port")
-			filePath, _ := cmd.Flags().GetString("file")
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			filePath := viper.GetString("file")
 
 			var content []byte
-			var err error
-
-			ctype := "application/octet-stream"
 
 			if filePath != "" {
 				// filePath is provided, read the file and post its content
 				content, err = os.ReadFile(filePath)
 				if err != nil {
-					fmt.Fprintln(os.Stderr, "Error reading file:", err)
-					return
+					return fmt.Errorf("error reading file: %s", err)
 				}
-				ctype = detectBytesliceMimetype(content)
-				fmt.Printf("Posting content of file %s to key %s at %s:%d\n", filePath, key, host, port)
 			} else if len(args) > 1 {
 				// value is provided as a second argument, post it as is
 				content = []byte(args[1])
-				if utf8.Valid(content) {
-					ctype = "text/plain; charset=utf-8"
-					fmt.Printf("Posting value %q to key %s at %s:%d\n", string(content), key, host, port)
-				} else {
+				if !utf8.Valid(content) {
 					fmt.Println("Non-Unicode value provided as argument. To POST arbitrary bytes, please see the --file flag")
 				}
 			} else {
-				log.Fatal("Either a value or --file must be provided")
+				return fmt.Errorf("either a value or --file must be provided")
 			}
-			ctype = detectBytesliceMimetype(content)
-			err = postData(key, host, uint16(port), content, ctype)
+			ctype, err := contentType(content)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+				return err
+			}
+			if dryRun(cmd, "POST", key, c.Host, c.Port, content, ctype) {
+				return nil
 			}
+			if filePath != "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "Posting content of file %s to key %s at %s:%d\n", filePath, key, c.Host, c.Port)
+			} else if utf8.Valid(content) {
+				fmt.Fprintf(cmd.OutOrStdout(), "Posting value %q to key %s at %s:%d\n", string(content), key, c.Host, c.Port)
+			}
+			return c.Post(key, content, ctype)
 		},
 	}
 
@@ -234,59 +412,71 @@ func main() {
 		Use:   "PUT [key] [value]",
 		Short: "PUT value to a key",
 		Args:  cobra.MinimumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			key := args[0]
-			host := viper.GetString("host")
-			port := viper.GetInt("port")
-			filePath, _ := cmd.Flags().GetString("file")
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			filePath := viper.GetString("file")
 
 			var content []byte
-			var err error
-
-			ctype := "application/octet-stream"
 
 			if filePath != "" {
 				// filePath is provided, read the file and put its content
 				content, err = os.ReadFile(filePath)
 				if err != nil {
-					fmt.Fprintln(os.Stderr, "Error reading file:", err)
-					return
+					return fmt.Errorf("error reading file: %s", err)
 				}
-				fmt.Printf("Putting content of file %s to key %s at %s:%d\n", filePath, key, host, port)
 			} else if len(args) > 1 {
 				// value is provided as a second argument, put it as is
 				content = []byte(args[1])
-				if utf8.Valid(content) {
-					ctype = "text/plain; charset=utf-8"
-					fmt.Printf("Putting value %q to key %s at %s:%d\n", string(content), key, host, port)
-				} else {
+				if !utf8.Valid(content) {
 					fmt.Println("Non-Unicode value provided as argument. To POST arbitrary bytes, please see the --file flag")
 				}
 			} else {
-				log.Fatal("Either a value or --file must be provided")
+				return fmt.Errorf("either a value or --file must be provided")
 			}
-			ctype = detectBytesliceMimetype(content)
-			err = putData(key, host, uint16(port), content, ctype)
+			ctype, err := contentType(content)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+				return err
 			}
+			if dryRun(cmd, "PUT", key, c.Host, c.Port, content, ctype) {
+				return nil
+			}
+			if filePath != "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "Putting content of file %s to key %s at %s:%d\n", filePath, key, c.Host, c.Port)
+			} else if utf8.Valid(content) {
+				fmt.Fprintf(cmd.OutOrStdout(), "Putting value %q to key %s at %s:%d\n", string(content), key, c.Host, c.Port)
+			}
+			return c.Put(key, content, ctype)
 		},
 	}
 
 	var deleteCmd = &cobra.Command{
 		Use:   "DELETE [key]",
-		Short: "DELETE a key",
-		Args:  cobra.ExactArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		Short: "DELETE a key, or with --prefix every key starting with it",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if viper.GetString("prefix") != "" {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			if prefix := viper.GetString("prefix"); prefix != "" {
+				return deletePrefix(cmd, c, prefix)
+			}
 			key := args[0]
-			host := viper.GetString("host")
-			port := viper.GetInt("port")
 
-			fmt.Printf("Deleting key %s from %s:%d\n", key, host, port)
-			err := deleteData(key, host, uint16(port))
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+			if dryRun(cmd, "DELETE", key, c.Host, c.Port, nil, "") {
+				return nil
 			}
+			fmt.Printf("Deleting key %s from %s:%d\n", key, c.Host, c.Port)
+			return c.Delete(key)
 		},
 	}
 
@@ -294,20 +484,23 @@ func main() {
 		Use:   "HEAD [key]",
 		Short: "HEAD (check if exists) key",
 		Args:  cobra.ExactArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			key := args[0]
-			host := viper.GetString("host")
-			port := viper.GetInt("port")
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
 
-			fmt.Printf("Checking if key %s exists at %s:%d\n", key, host, port)
-			exists, err := headData(key, host, uint16(port))
+			fmt.Printf("Checking if key %s exists at %s:%d\n", key, c.Host, c.Port)
+			exists, err := c.Head(key)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
+				return err
 			} else if exists {
 				fmt.Printf("Key %q exists\n", key)
 			} else {
 				fmt.Printf("Key %q does not exist\n", key)
 			}
+			return nil
 		},
 	}
 
@@ -315,18 +508,116 @@ func main() {
 		Use:   "OPTIONS [key]",
 		Short: "OPTIONS (check available methods) key",
 		Args:  cobra.ExactArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			key := args[0]
-			host := viper.GetString("host")
-			port := viper.GetInt("port")
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
 
-			fmt.Printf("Checking available methods for key %s at %s:%d\n", key, host, port)
-			optionsString, err := optionsData(key, host, uint16(port))
+			fmt.Printf("Checking available methods for key %s at %s:%d\n", key, c.Host, c.Port)
+			optionsString, err := c.Options(key)
 			if err != nil {
-				log.Fatalf("Error: %s", err)
-			} else {
-				fmt.Printf("%s\n", optionsString)
+				return err
+			}
+			fmt.Printf("%s\n", optionsString)
+			return nil
+		},
+	}
+
+	var listCmd = &cobra.Command{
+		Use:   "list [prefix]",
+		Short: "List the keys starting with prefix, or every key",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			prefix := ""
+			if len(args) == 1 {
+				prefix = args[0]
+			}
+
+			values := viper.GetBool("values")
+			listing, err := c.List(prefix, viper.GetInt("limit"), values)
+			if err != nil {
+				return err
 			}
+			out := cmd.OutOrStdout()
+			if viper.GetBool("json") {
+				encoder := json.NewEncoder(out)
+				if values {
+					err = encoder.Encode(listing)
+				} else {
+					keys := make([]string, 0, len(listing))
+					for _, l := range listing {
+						keys = append(keys, l.Key)
+					}
+					err = encoder.Encode(keys)
+				}
+				return err
+			}
+			for _, l := range listing {
+				switch {
+				case !values:
+					fmt.Fprintln(out, l.Key)
+				case printable(l.ContentType, l.Value):
+					fmt.Fprintf(out, "%s\t%q\n", l.Key, string(l.Value))
+				default:
+					fmt.Fprintf(out, "%s\t%d bytes of %q\n", l.Key, len(l.Value), l.ContentType)
+				}
+			}
+			return nil
+		},
+	}
+
+	var batchCmd = &cobra.Command{
+		Use:   "batch [file]",
+		Short: "Run the commands of a file, or of stdin, one per line",
+		Long: "Run the commands of a file, or of stdin without a file or with -, one per line, such as\n" +
+			"\"PUT /key value\" or \"DELETE /key\". GET, HEAD, POST, PUT and DELETE are supported.\n" +
+			"Blank lines and lines starting with # are skipped. A failed command doesn't stop the batch.",
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+
+			input := cmd.InOrStdin()
+			if len(args) == 1 && args[0] != "-" {
+				file, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				input = file
+			}
+			succeeded, failed := 0, 0
+			scanner := bufio.NewScanner(input)
+			for line := 1; scanner.Scan(); line++ {
+				command := strings.TrimSpace(scanner.Text())
+				if command == "" || strings.HasPrefix(command, "#") {
+					continue
+				}
+				result, err := runBatchLine(cmd, c, command)
+				if err != nil {
+					failed++
+					fmt.Fprintf(cmd.OutOrStdout(), "%d: %s: error: %s\n", line, command, err)
+				} else {
+					succeeded++
+					fmt.Fprintf(cmd.OutOrStdout(), "%d: %s: %s\n", line, command, result)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%d succeeded, %d failed\n", succeeded, failed)
+			if failed > 0 {
+				return fmt.Errorf("%d commands failed", failed)
+			}
+			return nil
 		},
 	}
 
@@ -336,10 +627,36 @@ func main() {
 	rootCmd.AddCommand(putCmd)
 	rootCmd.AddCommand(headCmd)
 	rootCmd.AddCommand(optionsCmd)
+	rootCmd.AddCommand(batchCmd)
+	rootCmd.AddCommand(listCmd)
+
+	return rootCmd
+}
 
+func main() {
+	rootCmd := newRootCmd()
+
+	pflag.String("config", "", "Configuration file, instead of nabia-client.yaml in the nabia directory of the user's configuration directory")
+	pflag.String("profile", "", "Server profile of the configuration file to connect to")
 	pflag.String("host", "localhost", "Nabia server host")
 	pflag.Uint16("port", 5380, "Nabia server port")
 	pflag.String("file", "", "Path to a file, uploaded with POST or PUT, and downloaded with GET")
+	pflag.String("content-type", "", "Content-Type to POST or PUT the value with, instead of the detected one")
+	pflag.String("output", "", "Write the value fetched with GET to this file, or to stdout with -")
+	pflag.Bool("force", false, "Print the value fetched with GET even if it isn't text")
+	pflag.Bool("verify", false, "Verify the value fetched with GET against the checksum sent by the server")
+	pflag.Bool("https", false, "Connect to the server over HTTPS")
+	pflag.String("ca-cert", "", "PEM file of the CA to verify the server certificate with, instead of the system ones")
+	pflag.String("token", "", "Bearer token to authenticate with, for servers requiring API keys")
+	pflag.Bool("insecure", false, "Don't verify the server certificate, for self-signed ones")
+	pflag.Int("retries", 2, "Times a request is retried after a connection error or a 5xx response")
+	pflag.Bool("retry-post", false, "Retry POST requests as well, although they may have been applied")
+	pflag.Bool("values", false, "List the values of the keys as well")
+	pflag.Int("limit", 0, "List at most this many keys, 0 for no limit")
+	pflag.Bool("json", false, "Print the list as JSON")
+	pflag.String("prefix", "", "DELETE every key starting with this prefix instead of a single key")
+	pflag.Bool("yes", false, "Delete keys by prefix without asking for confirmation")
+	pflag.Bool("dry-run", false, "Print the request POST, PUT or DELETE would make, without sending it")
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
 
@@ -347,10 +664,13 @@ func main() {
 
 	viper.SetEnvPrefix("nabia")
 	viper.AutomaticEnv()
-
-	if err := rootCmd.Execute(); err != nil {
+	if err := loadConfig(viper.GetString("config")); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
+	if err := rootCmd.Execute(); err != nil {
+		fail(err)
+	}
+
 }
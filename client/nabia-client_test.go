@@ -0,0 +1,747 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Nabia-DB/nabia/client/client"
+	"github.com/spf13/viper"
+)
+
+// mockServer records the requests it receives and answers with status.
+type mockServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newMockServer(t *testing.T, status int) *mockServer {
+	t.Helper()
+	ms := &mockServer{}
+	ms.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms.mu.Lock()
+		ms.requests = append(ms.requests, r)
+		ms.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ms.Close)
+	useServer(t, ms.Server)
+	return ms
+}
+
+// methods returns the methods of the requests received so far.
+func (ms *mockServer) methods() []string {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var methods []string
+	for _, r := range ms.requests {
+		methods = append(methods, r.Method)
+	}
+	return methods
+}
+
+// useServer points the client at server for the duration of a test.
+func useServer(t *testing.T, server *httptest.Server) {
+	t.Helper()
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	setConfig(t, "host", host)
+	p, _ := strconv.Atoi(port)
+	setConfig(t, "port", p)
+}
+
+// setConfig overrides a configuration key for the duration of a test.
+func setConfig(t *testing.T, key string, value interface{}) {
+	t.Helper()
+	viper.Set(key, value)
+	t.Cleanup(func() { viper.Set(key, nil) })
+}
+
+// execute runs the client with the given arguments and returns its output.
+func execute(t *testing.T, args ...string) string {
+	t.Helper()
+	out, _, err := run(args...)
+	if err != nil {
+		t.Fatalf("Unexpected error when running %q: %s", args, err)
+	}
+	return out
+}
+
+// run runs the client with the given arguments and returns its output, what
+// it wrote to stderr and the error main would exit with.
+func run(args ...string) (string, string, error) {
+	var out, stderr bytes.Buffer
+	rootCmd := newRootCmd()
+	rootCmd.SetArgs(args)
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(&stderr)
+	err := rootCmd.Execute()
+	return out.String(), stderr.String(), err
+}
+
+func TestDryRun(t *testing.T) {
+	ms := newMockServer(t, http.StatusOK)
+	setConfig(t, "dry-run", true)
+
+	table := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"POST", "/k1", "value"}, `would POST 5 bytes of "text/plain; charset=utf-8" to key /k1`},
+		{[]string{"PUT", "/k1", "new value"}, `would PUT 9 bytes of "text/plain; charset=utf-8" to key /k1`},
+		{[]string{"DELETE", "/k1"}, "would DELETE key /k1"},
+	}
+	for _, row := range table {
+		out := execute(t, row.args...)
+		if !strings.Contains(out, row.expected) {
+			t.Errorf("Unexpected output for %q: got %q, expected it to contain %q", row.args, out, row.expected)
+		}
+		if strings.Contains(out, "Posting") || strings.Contains(out, "Putting") {
+			t.Errorf("Dry run of %q reported a request as being sent: %q", row.args, out)
+		}
+	}
+	if methods := ms.methods(); len(methods) != 0 {
+		t.Errorf("Dry run sent requests to the server: %q", methods)
+	}
+
+	// Without --dry-run the same commands reach the server
+	setConfig(t, "dry-run", false)
+	for _, row := range table {
+		execute(t, row.args...)
+	}
+	if methods := ms.methods(); strings.Join(methods, " ") != "POST PUT DELETE" {
+		t.Errorf("Unexpected requests without dry run: got %q", methods)
+	}
+
+	// DELETE --prefix reports each of the listed keys, and deletes none
+	ss := newStoreServer(t, "/foo/1", "/foo/2", "/bar/1")
+	setConfig(t, "dry-run", true)
+	setConfig(t, "prefix", "/foo/")
+	out := execute(t, "DELETE")
+	for _, expected := range []string{"would DELETE key /foo/1", "would DELETE key /foo/2"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Unexpected output for DELETE --prefix: got %q, expected it to contain %q", out, expected)
+		}
+	}
+	if strings.Contains(out, "/bar/1") {
+		t.Errorf("A key outside of the prefix was reported: %q", out)
+	}
+	if keys := ss.remaining(); len(keys) != 3 {
+		t.Errorf("Dry run deleted keys: %q remain", keys)
+	}
+}
+
+func TestStreamingGet(t *testing.T) {
+	value := make([]byte, 32<<20) // 32 MiB
+	if _, err := rand.Read(value); err != nil {
+		t.Fatalf("Failed to generate a random value: %s", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(value)
+	}))
+	defer server.Close()
+	useServer(t, server)
+
+	output := filepath.Join(t.TempDir(), "big")
+	setConfig(t, "output", output)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	execute(t, "GET", "/big")
+	runtime.ReadMemStats(&after)
+
+	written, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read the output file: %s", err)
+	}
+	if !bytes.Equal(written, value) {
+		t.Errorf("Downloaded value differs from the served one (%d bytes vs %d bytes)", len(written), len(value))
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(len(value))/4 {
+		t.Errorf("Value was buffered in memory: %d bytes allocated for a %d bytes value", allocated, len(value))
+	}
+}
+
+// samplePNG is a 1x1 transparent PNG.
+var samplePNG, _ = base64.StdEncoding.DecodeString("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg==")
+
+func TestGetOutput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(samplePNG)
+	}))
+	defer server.Close()
+	useServer(t, server)
+
+	output := filepath.Join(t.TempDir(), "sample.png")
+	setConfig(t, "output", output)
+	var stderr bytes.Buffer
+	rootCmd := newRootCmd()
+	rootCmd.SetArgs([]string{"GET", "/image"})
+	rootCmd.SetOut(&bytes.Buffer{})
+	rootCmd.SetErr(&stderr)
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	written, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read the output file: %s", err)
+	}
+	if !bytes.Equal(written, samplePNG) {
+		t.Errorf("Saved image differs from the served one: got %x, expected %x", written, samplePNG)
+	}
+	if expected := fmt.Sprintf(`Saved %d bytes of "image/png"`, len(samplePNG)); !strings.Contains(stderr.String(), expected) {
+		t.Errorf("Unexpected stderr: got %q, expected it to contain %q", stderr.String(), expected)
+	}
+}
+
+func TestGetOutputFailure(t *testing.T) {
+	newMockServer(t, http.StatusNotFound)
+	dir := t.TempDir()
+	output := filepath.Join(dir, "existing")
+	if err := os.WriteFile(output, []byte("previous value"), 0600); err != nil {
+		t.Fatalf("Failed to write the existing file: %s", err)
+	}
+	setConfig(t, "output", output)
+	rootCmd := newRootCmd()
+	rootCmd.SetArgs([]string{"GET", "/missing"})
+	rootCmd.SetOut(&bytes.Buffer{})
+	rootCmd.SetErr(&bytes.Buffer{})
+	if err := rootCmd.Execute(); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if written, err := os.ReadFile(output); err != nil || string(written) != "previous value" {
+		t.Errorf("A failed GET changed the existing file: %q, %v", written, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("A failed GET left a temporary file behind: %d files", len(entries))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	value := []byte("verified value")
+	var checksum string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checksum != "" {
+			w.Header().Set("X-Nabia-CRC32", checksum)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(value)
+	}))
+	defer server.Close()
+	useServer(t, server)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	correct := fmt.Sprintf("%08x", crc32.ChecksumIEEE(value))
+	table := []struct {
+		verify   bool
+		checksum string
+		ok       bool
+	}{
+		{true, correct, true},
+		{true, strings.ToUpper(correct), true},
+		{true, "00000000", false},
+		{true, "", false},
+		{false, "00000000", true}, // only checked with --verify
+	}
+	for _, row := range table {
+		setConfig(t, "verify", row.verify)
+		checksum = row.checksum
+		// The value is printed by a plain GET and streamed to stdout with
+		// --output -, which reports its progress on stderr
+		for _, output := range []string{"", "-"} {
+			setConfig(t, "output", output)
+			logs.Reset()
+			out, stderr, err := run("GET", "/key")
+			if (err == nil) != row.ok {
+				t.Errorf("Unexpected error with --verify %t, checksum %q and --output %q: %v", row.verify, row.checksum, output, err)
+			}
+			if !row.ok && exitCode(err) != 1 {
+				t.Errorf("Unexpected exit code of a failed verification: %d", exitCode(err))
+			}
+			if row.checksum == "00000000" && row.verify && !errors.Is(err, client.ErrChecksumMismatch) {
+				t.Errorf("A wrong checksum wasn't reported as a mismatch: %v", err)
+			}
+			if row.ok && !strings.Contains(out, string(value)) {
+				t.Errorf("Unexpected output with --output %q: got %q, expected it to contain %q", output, out, value)
+			}
+			if saved := strings.Contains(stderr, "Saved"); output == "-" && saved != row.ok {
+				t.Errorf("Unexpected stderr with checksum %q: %q", row.checksum, stderr)
+			}
+			if verified := strings.Contains(logs.String(), "Verified CRC-32 "+correct); verified != (row.verify && row.ok) {
+				t.Errorf("Unexpected logs with --verify %t and checksum %q: %q", row.verify, row.checksum, logs.String())
+			}
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	first, second := newMockServer(t, http.StatusOK), newMockServer(t, http.StatusOK)
+	// Left to the configuration file
+	setConfig(t, "host", nil)
+	setConfig(t, "port", nil)
+	port := func(ms *mockServer) string {
+		u, _ := url.Parse(ms.URL)
+		_, port, _ := net.SplitHostPort(u.Host)
+		return port
+	}
+	config := filepath.Join(t.TempDir(), "nabia-client.yaml")
+	err := os.WriteFile(config, []byte(fmt.Sprintf(`host: 127.0.0.1
+port: %s
+profiles:
+  first:
+    port: %s
+  second:
+    host: 127.0.0.1
+    port: %s
+`, port(first), port(first), port(second))), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write the configuration: %s", err)
+	}
+	t.Cleanup(func() {
+		viper.SetConfigType("yaml")
+		viper.ReadConfig(strings.NewReader(""))
+	})
+
+	table := []struct {
+		profile  string
+		expected *mockServer
+	}{
+		{"", first}, // the top-level settings
+		{"first", first},
+		{"second", second},
+	}
+	for _, row := range table {
+		setConfig(t, "profile", row.profile)
+		if err := loadConfig(config); err != nil {
+			t.Fatalf("Failed to load the configuration with profile %q: %s", row.profile, err)
+		}
+		before := len(row.expected.methods())
+		execute(t, "DELETE", "/key")
+		if after := len(row.expected.methods()); after != before+1 {
+			t.Errorf("Profile %q didn't reach the expected server", row.profile)
+		}
+	}
+
+	setConfig(t, "profile", "third")
+	if err := loadConfig(config); err == nil || !strings.Contains(err.Error(), "third") {
+		t.Errorf("Unexpected error selecting an undefined profile: %v", err)
+	}
+	setConfig(t, "profile", "")
+	if err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("A missing configuration file given explicitly was ignored")
+	}
+}
+
+func TestPrintable(t *testing.T) {
+	table := []struct {
+		ctype     string
+		data      []byte
+		printable bool
+	}{
+		{"text/plain; charset=utf-8", []byte("value"), true},
+		{"text/html", []byte("<p>value</p>"), true},
+		{"application/json", []byte(`{"key":"value"}`), true},
+		{"application/xml", []byte("<key>value</key>"), true},
+		{"application/vnd.api+json", []byte(`{"data":null}`), true},
+		{"image/svg+xml", []byte("<svg/>"), true},
+		{"text/plain", []byte{0xFF, 0xFE}, false},
+		{"application/json", []byte{0xFF, 0xFE}, false},
+		{"image/png", samplePNG, false},
+		{"application/octet-stream", []byte("value"), false},
+		{"", []byte("value"), false},
+	}
+	for _, row := range table {
+		if printable(row.ctype, row.data) != row.printable {
+			t.Errorf("Unexpected printable(%q, %q): expected %t", row.ctype, row.data, row.printable)
+		}
+	}
+
+	var ctype string
+	var value []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ctype)
+		w.Write(value)
+	}))
+	defer server.Close()
+	useServer(t, server)
+	for _, row := range []struct {
+		ctype    string
+		value    []byte
+		force    bool
+		expected string
+	}{
+		{"application/json", []byte(`{"key":"value"}`), false, `"{\"key\":\"value\"}"`},
+		{"text/html", []byte("<p>value</p>"), false, `"<p>value</p>"`},
+		{"image/png", samplePNG, false, `Data is "image/png", not text, refusing to print`},
+		{"image/png", samplePNG, true, fmt.Sprintf("%q", samplePNG)},
+	} {
+		ctype, value = row.ctype, row.value
+		setConfig(t, "force", row.force)
+		if out := execute(t, "GET", "/key"); !strings.Contains(out, row.expected) {
+			t.Errorf("Unexpected output of GET of %q with --force %t: got %q, expected it to contain %q", row.ctype, row.force, out, row.expected)
+		}
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	setConfig(t, "retries", 0)
+	table := []struct {
+		status   int
+		expected error // nil for success
+		code     int
+	}{
+		{http.StatusOK, nil, 0},
+		{http.StatusCreated, nil, 0},
+		{http.StatusNoContent, nil, 0},
+		{http.StatusBadRequest, client.ErrBadRequest, 2},
+		{http.StatusNotFound, client.ErrNotFound, 3},
+		{http.StatusConflict, client.ErrConflict, 4},
+		{http.StatusInternalServerError, client.ErrServer, 5},
+		{http.StatusServiceUnavailable, client.ErrServer, 5},
+		{http.StatusForbidden, nil, 1}, // an error, but none of the typed ones
+	}
+	typed := []error{client.ErrBadRequest, client.ErrNotFound, client.ErrConflict, client.ErrServer}
+	for _, row := range table {
+		newMockServer(t, row.status)
+		for _, args := range [][]string{{"POST", "/key", "value"}, {"PUT", "/key", "value"}, {"DELETE", "/key"}, {"GET", "/key"}} {
+			_, _, err := run(args...)
+			if row.status/100 == 2 {
+				if err != nil {
+					t.Errorf("%s answered %d failed: %s", args[0], row.status, err)
+				}
+				continue
+			}
+			if err == nil {
+				t.Errorf("%s answered %d succeeded", args[0], row.status)
+				continue
+			}
+			for _, e := range typed {
+				if errors.Is(err, e) != (e == row.expected) {
+					t.Errorf("Unexpected error of %s answered %d: %v", args[0], row.status, err)
+				}
+			}
+			if code := exitCode(err); code != row.code {
+				t.Errorf("Unexpected exit code of %s answered %d: got %d, expected %d", args[0], row.status, code, row.code)
+			}
+		}
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	setConfig(t, "retries", 0)
+	newMockServer(t, http.StatusInternalServerError)
+	for _, args := range [][]string{{"OPTIONS", "/key"}, {"list"}, {"DELETE"}} {
+		if args[0] == "DELETE" {
+			setConfig(t, "prefix", "/foo/")
+		}
+		if _, _, err := run(args...); exitCode(err) != 5 {
+			t.Errorf("Unexpected exit code of %q answered 500: got %d for %v", args, exitCode(err), err)
+		}
+	}
+
+	setConfig(t, "file", filepath.Join(t.TempDir(), "missing"))
+	for _, method := range []string{"POST", "PUT"} {
+		if _, _, err := run(method, "/key"); err == nil || exitCode(err) != 1 {
+			t.Errorf("%s of a missing file didn't fail: %v", method, err)
+		}
+	}
+}
+
+func TestContentTypeFlag(t *testing.T) {
+	ms := newMockServer(t, http.StatusOK)
+
+	// Detected by default
+	execute(t, "PUT", "/k1", "hello")
+	setConfig(t, "content-type", "application/json")
+	execute(t, "PUT", "/k1", "hello")
+	execute(t, "POST", "/k2", "hello")
+	var ctypes []string
+	for _, r := range ms.requests {
+		ctypes = append(ctypes, r.Header.Get("Content-Type"))
+	}
+	expected := []string{"text/plain; charset=utf-8", "application/json", "application/json"}
+	if strings.Join(ctypes, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Unexpected Content-Types: got %q, expected %q", ctypes, expected)
+	}
+
+	setConfig(t, "content-type", "not a media type")
+	if _, err := contentType([]byte("hello")); err == nil {
+		t.Error("An invalid Content-Type was accepted")
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	setConfig(t, "host", "example.com")
+	setConfig(t, "port", 8080)
+	setConfig(t, "https", true)
+	setConfig(t, "token", "secret")
+	setConfig(t, "retries", 3)
+	setConfig(t, "retry-post", true)
+	setConfig(t, "verify", true)
+	c, err := newClient()
+	if err != nil {
+		t.Fatalf("Failed to create the client: %s", err)
+	}
+	if c.Host != "example.com" || c.Port != 8080 || !c.HTTPS || c.Token != "secret" || c.Retries != 3 || !c.RetryPOST || !c.Verify || c.HTTPClient == nil {
+		t.Errorf("The settings weren't passed to the client: %+v", c)
+	}
+}
+
+func TestHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	useServer(t, server)
+	setConfig(t, "https", true)
+	setConfig(t, "retries", 2) // certificate errors are never retried
+
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caCert, certificate, 0600); err != nil {
+		t.Fatalf("Failed to write the CA certificate: %s", err)
+	}
+
+	table := []struct {
+		name     string
+		caCert   string
+		insecure bool
+		succeeds bool
+	}{
+		{"unknown authority", "", false, false},
+		{"trusted CA", caCert, false, true},
+		{"insecure", "", true, true},
+	}
+	for _, row := range table {
+		setConfig(t, "ca-cert", row.caCert)
+		setConfig(t, "insecure", row.insecure)
+		c, err := newClient()
+		if err != nil {
+			t.Fatalf("%s: failed to create the client: %s", row.name, err)
+		}
+		_, err = c.Head("/key")
+		if row.succeeds {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", row.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), "certificate") {
+			t.Errorf("%s: expected a certificate error, got %v", row.name, err)
+		}
+	}
+
+	setConfig(t, "ca-cert", filepath.Join(t.TempDir(), "missing.pem"))
+	if _, err := newClient(); err == nil {
+		t.Error("A missing CA certificate was accepted")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ms := newMockServer(t, http.StatusOK)
+	script := filepath.Join(t.TempDir(), "script")
+	commands := `# seed the keys
+PUT /k1 value with spaces
+POST /k2 value2
+
+GET /k1
+HEAD /k2
+DELETE /k2
+`
+	if err := os.WriteFile(script, []byte(commands), 0600); err != nil {
+		t.Fatalf("Failed to write the script: %s", err)
+	}
+	out := execute(t, "batch", script)
+	for _, expected := range []string{"2: PUT /k1 value with spaces: done", "6: HEAD /k2: exists", "7: DELETE /k2: done", "5 succeeded, 0 failed"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Unexpected output: got %q, expected it to contain %q", out, expected)
+		}
+	}
+	if methods := ms.methods(); strings.Join(methods, " ") != "PUT POST GET HEAD DELETE" {
+		t.Errorf("Unexpected requests: got %q", methods)
+	}
+
+	// Failures are reported without stopping the batch, and read from stdin
+	var stdout bytes.Buffer
+	rootCmd := newRootCmd()
+	rootCmd.SetArgs([]string{"batch"})
+	rootCmd.SetIn(strings.NewReader("FETCH /k1\nPUT /k1\nDELETE /k1\n"))
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetErr(io.Discard)
+	if err := rootCmd.Execute(); err == nil {
+		t.Error("A batch with failures succeeded")
+	}
+	for _, expected := range []string{`1: FETCH /k1: error: unknown command "FETCH"`, "2: PUT /k1: error: a value is required", "1 succeeded, 2 failed"} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Errorf("Unexpected output: got %q, expected it to contain %q", stdout.String(), expected)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	keys := []string{"/a/1", "/a/2", "/a/3", "/b/1"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_keys" {
+			http.NotFound(w, r)
+			return
+		}
+		listing := []client.KeyListing{}
+		for _, key := range keys {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				listing = append(listing, client.KeyListing{Key: key, ContentType: "text/plain; charset=utf-8", Value: []byte("value of " + key)})
+			}
+		}
+		if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit < len(listing) {
+			listing = listing[:limit]
+		}
+		if r.URL.Query().Get("values") == "true" {
+			json.NewEncoder(w).Encode(listing)
+			return
+		}
+		names := []string{}
+		for _, l := range listing {
+			names = append(names, l.Key)
+		}
+		json.NewEncoder(w).Encode(names)
+	}))
+	defer server.Close()
+	useServer(t, server)
+
+	if out := execute(t, "list", "/a/"); out != "/a/1\n/a/2\n/a/3\n" {
+		t.Errorf("Unexpected keys with a prefix: got %q", out)
+	}
+	setConfig(t, "limit", 2)
+	if out := execute(t, "list"); out != "/a/1\n/a/2\n" {
+		t.Errorf("Unexpected keys with a limit: got %q", out)
+	}
+	setConfig(t, "json", true)
+	if out := execute(t, "list"); out != "[\"/a/1\",\"/a/2\"]\n" {
+		t.Errorf("Unexpected JSON keys: got %q", out)
+	}
+	setConfig(t, "json", false)
+	setConfig(t, "values", true)
+	if out := execute(t, "list", "/b"); out != "/b/1\t\"value of /b/1\"\n" {
+		t.Errorf("Unexpected keys with values: got %q", out)
+	}
+
+	// Servers without /_keys answer 404
+	newMockServer(t, http.StatusNotFound)
+	c, _ := newClient()
+	if _, err := c.List("", 0, false); !errors.Is(err, client.ErrListingUnsupported) {
+		t.Errorf("Expected ErrListingUnsupported, got %v", err)
+	}
+}
+
+// storeServer serves a set of keys through /_keys and DELETE.
+type storeServer struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func newStoreServer(t *testing.T, keys ...string) *storeServer {
+	t.Helper()
+	ss := &storeServer{keys: map[string]bool{}}
+	for _, key := range keys {
+		ss.keys[key] = true
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ss.mu.Lock()
+		defer ss.mu.Unlock()
+		switch {
+		case r.URL.Path == "/_keys":
+			listed := []string{}
+			for key := range ss.keys {
+				if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+					listed = append(listed, key)
+				}
+			}
+			sort.Strings(listed)
+			json.NewEncoder(w).Encode(listed)
+		case r.Method == "DELETE" && ss.keys[r.URL.Path]:
+			delete(ss.keys, r.URL.Path)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	useServer(t, server)
+	return ss
+}
+
+// remaining returns the keys left on the server.
+func (ss *storeServer) remaining() []string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	keys := []string{}
+	for key := range ss.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestDeletePrefix(t *testing.T) {
+	ss := newStoreServer(t, "/foo/1", "/foo/2", "/foo/bar/3", "/food", "/bar/1")
+	setConfig(t, "prefix", "/foo/")
+
+	// Nothing is deleted without confirmation
+	cmd := newRootCmd()
+	cmd.SetIn(strings.NewReader("n\n"))
+	cmd.SetOut(io.Discard)
+	c, _ := newClient()
+	if err := deletePrefix(cmd, c, "/foo/"); err == nil {
+		t.Error("Deletion went ahead without confirmation")
+	}
+	if keys := ss.remaining(); len(keys) != 5 {
+		t.Errorf("Keys were deleted without confirmation: %q remain", keys)
+	}
+
+	setConfig(t, "yes", true)
+	out := execute(t, "DELETE")
+	if keys := ss.remaining(); strings.Join(keys, " ") != "/bar/1 /food" {
+		t.Errorf("Unexpected remaining keys: %q", keys)
+	}
+	for _, expected := range []string{"Deleted key /foo/1\n", "Deleted key /foo/bar/3\n", "Deleted 3 of 3 keys\n"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Unexpected output: got %q, expected it to contain %q", out, expected)
+		}
+	}
+
+	// An interactive confirmation works too
+	setConfig(t, "yes", false)
+	setConfig(t, "prefix", "/food")
+	cmd = newRootCmd()
+	cmd.SetArgs([]string{"DELETE"})
+	cmd.SetIn(strings.NewReader("yes\n"))
+	cmd.SetOut(io.Discard)
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if keys := ss.remaining(); strings.Join(keys, " ") != "/bar/1" {
+		t.Errorf("Unexpected remaining keys after a confirmed deletion: %q", keys)
+	}
+}
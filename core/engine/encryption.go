@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// encryptedMagic starts the snapshots saved with a passphrase, in place of
+// snapshotMagic, followed by a byte holding the version of the encryption
+// layout. Version 1 goes on with the number of PBKDF2-HMAC-SHA256 iterations
+// as a big-endian uint32, the salt of the key derivation, and the nonce of
+// AES-256-GCM. The rest of the file is a whole plaintext snapshot, header
+// included, sealed with AES-256-GCM, with everything before it as additional
+// data so that the header can't be tampered with either.
+const (
+	encryptedMagic    = "NABIAENC"
+	encryptionVersion = 1
+)
+
+const (
+	saltSize = 16
+	keySize  = 32 // AES-256
+)
+
+// kdfIterations is the number of PBKDF2 iterations of the keys derived from
+// now on. It is stored in every snapshot, so it can be raised without making
+// older snapshots unreadable.
+var kdfIterations uint32 = 600_000
+
+// ErrEncrypted is returned when loading an encrypted snapshot without a
+// passphrase, see NabiaDBFromEncryptedFile.
+var ErrEncrypted = errors.New("snapshot is encrypted, a passphrase is needed to load it")
+
+// ErrDecryption is returned when an encrypted snapshot can't be decrypted,
+// because the passphrase is wrong or the file was modified.
+var ErrDecryption = errors.New("snapshot cannot be decrypted: wrong passphrase, or corrupted file")
+
+// ErrEncryptedWAL is returned when encryption and the write-ahead log are
+// combined, as the log isn't encrypted.
+var ErrEncryptedWAL = errors.New("the write-ahead log cannot be enabled with encryption, it would hold the writes in plaintext")
+
+// encryptionKey seals the snapshots of a database, with a key derived from
+// its passphrase and salt.
+type encryptionKey struct {
+	salt       []byte
+	iterations uint32
+	aead       cipher.AEAD
+}
+
+// newEncryptionKey derives the key of passphrase and salt.
+func newEncryptionKey(passphrase string, salt []byte, iterations uint32) (*encryptionKey, error) {
+	if iterations == 0 {
+		return nil, fmt.Errorf("%w: no key derivation iterations", ErrDecryption)
+	}
+	block, err := aes.NewCipher(pbkdf2([]byte(passphrase), salt, int(iterations), keySize))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionKey{salt: salt, iterations: iterations, aead: aead}, nil
+}
+
+// newSaltedKey derives the key of passphrase with a new random salt.
+func newSaltedKey(passphrase string) (*encryptionKey, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return newEncryptionKey(passphrase, salt, kdfIterations)
+}
+
+// pbkdf2 derives a key of length bytes from password and salt with
+// PBKDF2-HMAC-SHA256, see RFC 8018.
+func pbkdf2(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key, u []byte
+	for block := uint32(1); len(key) < length; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u = prf.Sum(u[:0])
+		t := bytes.Clone(u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:length]
+}
+
+// header returns the header of the snapshots sealed with k and nonce.
+func (k *encryptionKey) header(nonce []byte) []byte {
+	header := append([]byte(encryptedMagic), encryptionVersion)
+	header = binary.BigEndian.AppendUint32(header, k.iterations)
+	header = append(header, k.salt...)
+	return append(header, nonce...)
+}
+
+// seal writes snapshot to w, encrypted with a fresh nonce.
+func (k *encryptionKey) seal(w io.Writer, snapshot []byte) error {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	header := k.header(nonce)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(k.aead.Seal(nil, nonce, snapshot, header))
+	return err
+}
+
+// isEncrypted tells whether the snapshot read by reader is encrypted.
+func isEncrypted(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(len(encryptedMagic))
+	return err == nil && string(magic) == encryptedMagic
+}
+
+// openEncrypted decrypts the encrypted snapshot read by reader with
+// passphrase, and returns the plaintext snapshot along with the key, which
+// seals the next snapshots with the same passphrase and salt.
+func openEncrypted(reader io.Reader, passphrase string) ([]byte, *encryptionKey, error) {
+	if passphrase == "" {
+		return nil, nil, ErrEncrypted
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	fixed := len(encryptedMagic) + 1 + 4 + saltSize
+	if len(data) < fixed {
+		return nil, nil, fmt.Errorf("encrypted snapshot is truncated")
+	}
+	if version := data[len(encryptedMagic)]; version != encryptionVersion {
+		return nil, nil, fmt.Errorf("encrypted snapshot of version %d is not supported, only %d is", version, encryptionVersion)
+	}
+	iterations := binary.BigEndian.Uint32(data[len(encryptedMagic)+1:])
+	salt := bytes.Clone(data[fixed-saltSize : fixed])
+	key, err := newEncryptionKey(passphrase, salt, iterations)
+	if err != nil {
+		return nil, nil, err
+	}
+	headerSize := fixed + key.aead.NonceSize()
+	if len(data) < headerSize {
+		return nil, nil, fmt.Errorf("encrypted snapshot is truncated")
+	}
+	snapshot, err := key.aead.Open(nil, data[fixed:headerSize], data[headerSize:], data[:headerSize])
+	if err != nil {
+		return nil, nil, ErrDecryption
+	}
+	return snapshot, key, nil
+}
+
+// SetEncryptionPassphrase makes the snapshots saved from then on encrypted
+// with AES-256-GCM, under a key derived from passphrase with a random salt
+// stored in every snapshot. Such snapshots can only be loaded with
+// NabiaDBFromEncryptedFile and the same passphrase. An empty passphrase turns
+// encryption off, so that the next snapshots are saved in plaintext. The
+// write-ahead log would hold every write in plaintext next to the encrypted
+// snapshots, so encryption can't be combined with it. It must be set before
+// the database is in use.
+func (ns *NabiaDB) SetEncryptionPassphrase(passphrase string) error {
+	if passphrase == "" {
+		ns.internals.encryption = nil
+		return nil
+	}
+	if ns.internals.wal != nil {
+		return ErrEncryptedWAL
+	}
+	key, err := newSaltedKey(passphrase)
+	if err != nil {
+		return err
+	}
+	ns.internals.encryption = key
+	return nil
+}
+
+// NabiaDBFromEncryptedFile loads a database saved with a passphrase, see
+// SetEncryptionPassphrase, failing with ErrDecryption if passphrase is wrong.
+// Plaintext snapshots are loaded as well. Either way, the snapshots saved
+// from then on are encrypted with passphrase.
+func NabiaDBFromEncryptedFile(location string, passphrase string) (*NabiaDB, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase cannot be empty")
+	}
+	return loadFromFile(location, passphrase)
+}
@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fastKDF lowers the cost of the key derivation for the duration of a test.
+func fastKDF(t *testing.T) {
+	iterations := kdfIterations
+	kdfIterations = 1000
+	t.Cleanup(func() { kdfIterations = iterations })
+}
+
+func TestPBKDF2(t *testing.T) {
+	// Test vectors of RFC 7914, section 11
+	table := []struct {
+		password, salt string
+		iterations     int
+		expected       string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, row := range table {
+		key := pbkdf2([]byte(row.password), []byte(row.salt), row.iterations, 64)
+		if hex.EncodeToString(key) != row.expected {
+			t.Errorf("Unexpected key of %q and %q: %x", row.password, row.salt, key)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	fastKDF(t)
+	location := filepath.Join(t.TempDir(), "encrypted.db")
+	nabiaDB, _ := NewNabiaDB(location)
+	if err := nabiaDB.SetEncryptionPassphrase("correct horse"); err != nil {
+		t.Fatalf("Failed to set the passphrase: %s", err)
+	}
+	nabiaDB.Write("Secret", []byte("Value_Secret"))
+	if err := nabiaDB.Stop(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+	saved, _ := os.ReadFile(location)
+	if !bytes.HasPrefix(saved, []byte(encryptedMagic)) || bytes.Contains(saved, []byte("Value_Secret")) {
+		t.Fatalf("The snapshot wasn't encrypted: %q", saved)
+	}
+
+	if _, err := NabiaDBFromFile(location); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("Expected ErrEncrypted without a passphrase, got %v", err)
+	}
+	if _, err := NabiaDBFromEncryptedFile(location, "wrong horse"); !errors.Is(err, ErrDecryption) {
+		t.Errorf("Expected ErrDecryption with a wrong passphrase, got %v", err)
+	}
+	if _, err := NabiaDBFromEncryptedFile(location, ""); err == nil {
+		t.Error("An empty passphrase was accepted")
+	}
+
+	// The salt is kept by the next saves, which only change the nonce
+	loaded, err := NabiaDBFromEncryptedFile(location, "correct horse")
+	if err != nil {
+		t.Fatalf("Failed to load the encrypted snapshot: %s", err)
+	}
+	if value, err := loaded.Read("Secret"); err != nil || string(value) != "Value_Secret" {
+		t.Errorf("Unexpected value after a round trip: %q (%v)", value, err)
+	}
+	if err := loaded.Stop(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+	resaved, _ := os.ReadFile(location)
+	saltEnd := len(encryptedMagic) + 1 + 4 + saltSize
+	if !bytes.Equal(resaved[:saltEnd], saved[:saltEnd]) || bytes.Equal(resaved, saved) {
+		t.Error("The snapshot wasn't sealed again under the same key and a new nonce")
+	}
+
+	// Tampering with the header or the ciphertext is detected
+	for _, i := range []int{len(encryptedMagic) + 6, len(saved) - 1} {
+		tampered := bytes.Clone(saved)
+		tampered[i] ^= 0x01
+		os.WriteFile(location, tampered, 0600)
+		if _, err := NabiaDBFromEncryptedFile(location, "correct horse"); !errors.Is(err, ErrDecryption) {
+			t.Errorf("Tampering with byte %d went undetected: %v", i, err)
+		}
+	}
+	os.WriteFile(location, saved[:len(encryptedMagic)+3], 0600)
+	if _, err := NabiaDBFromEncryptedFile(location, "correct horse"); err == nil {
+		t.Error("A truncated snapshot was accepted")
+	}
+}
+
+func TestEncryptionOfPlaintext(t *testing.T) {
+	fastKDF(t)
+	location := filepath.Join(t.TempDir(), "plain.db")
+	nabiaDB, _ := NewNabiaDB(location)
+	nabiaDB.Write("A", []byte("Value_A"))
+	if err := nabiaDB.Stop(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+
+	// Plaintext snapshots load with or without a passphrase, and are
+	// encrypted by the next save with one
+	plain, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("Failed to load the plaintext snapshot: %s", err)
+	}
+	plain.Stop()
+	migrated, err := NabiaDBFromEncryptedFile(location, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to load the plaintext snapshot with a passphrase: %s", err)
+	}
+	if value, err := migrated.Read("A"); err != nil || string(value) != "Value_A" {
+		t.Errorf("Unexpected value: %q (%v)", value, err)
+	}
+	migrated.Stop()
+	if _, err := NabiaDBFromFile(location); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("The snapshot wasn't encrypted by its next save: %v", err)
+	}
+
+	// An empty passphrase turns encryption off again
+	decrypted, err := NabiaDBFromEncryptedFile(location, "passphrase")
+	if err != nil {
+		t.Fatalf("Failed to load the encrypted snapshot: %s", err)
+	}
+	decrypted.SetEncryptionPassphrase("")
+	decrypted.Stop()
+	if _, err := NabiaDBFromFile(location); err != nil {
+		t.Errorf("The snapshot wasn't decrypted by its next save: %v", err)
+	}
+}
+
+func TestEncryptionRefusesWAL(t *testing.T) {
+	fastKDF(t)
+	location := filepath.Join(t.TempDir(), "encrypted.db")
+	nabiaDB, _ := NewNabiaDB(location)
+	nabiaDB.SetEncryptionPassphrase("correct horse")
+	if err := nabiaDB.EnableWAL(FsyncOS, 0); !errors.Is(err, ErrEncryptedWAL) {
+		t.Errorf("Expected ErrEncryptedWAL when enabling the log, got %v", err)
+	}
+
+	plain, _ := NewNabiaDB(filepath.Join(t.TempDir(), "plain.db"))
+	if err := plain.EnableWAL(FsyncOS, 0); err != nil {
+		t.Fatalf("Failed to enable the write-ahead log: %s", err)
+	}
+	defer plain.Stop()
+	if err := plain.SetEncryptionPassphrase("correct horse"); !errors.Is(err, ErrEncryptedWAL) {
+		t.Errorf("Expected ErrEncryptedWAL when encrypting, got %v", err)
+	}
+}
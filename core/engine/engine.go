@@ -2,48 +2,133 @@ package engine
 
 import (
 	"bufio"
-	"encoding/gob"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-type NabiaRecord[T any] struct {
-	RawData T
+// NabiaRecord is a value along with its metadata, as returned by ReadRecord
+// and persisted in snapshots, see snapshotVersion for their layout. ExpiresAt
+// is the zero time for records without a TTL. Snapshots of versions 0 and 1
+// are gob encoded maps of NabiaRecord, which match fields by name, so fields
+// must neither be renamed nor change type.
+type NabiaRecord struct {
+	RawData    []byte
+	ExpiresAt  time.Time
+	CreatedAt  time.Time // when the key was first written
+	ModifiedAt time.Time // when the value was last written
 }
 
+// entry is what the Nabia map holds for every key. Entries are stored as
+// pointers so they can be compared when deleting expired keys.
+type entry struct {
+	data       []byte
+	expiresAt  time.Time // the zero time means the entry never expires
+	createdAt  time.Time // kept when the value is replaced
+	modifiedAt time.Time
+}
+
+// size approximates the memory held by key and the entry stored under it.
+func (e *entry) size(key string) int64 {
+	return int64(len(key) + len(e.data))
+}
+
+// expired reports whether the entry's TTL has run out at the given time.
+func (e *entry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// defaultSweepInterval is how often the background sweeper purges expired keys.
+const defaultSweepInterval = time.Second
+
+// defaultIOConcurrency is how many snapshots may be saved at the same time,
+// unless changed with SetIOConcurrency.
+const defaultIOConcurrency = 1
+
+// dataActivity counts the operations on the database. The number of keys and
+// their size are counted by the shards of the store, see shard.
 type dataActivity struct {
-	reads  int64
-	writes int64
-	size   int64
+	reads     int64
+	writes    int64
+	evictions int64 // keys removed to stay within SetMaxKeys and SetMaxMemory
 }
+
+// timestamps are Unix nanoseconds, as they are updated concurrently, see stamp.
 type timestamps struct {
-	lastSave  time.Time
-	lastLoad  time.Time
-	lastRead  time.Time
-	lastWrite time.Time
+	lastSave  int64
+	lastLoad  int64
+	lastRead  int64
+	lastWrite int64
 }
+
 type metrics struct {
 	dataActivity dataActivity
 	timestamps   timestamps
+	sequence     int64 // bumped on every write
+	diskSize     int64 // of the last snapshot saved to or loaded from the location
 }
-type internals struct {
-	location string
-	metrics  metrics
-}
-type NabiaDB struct {
-	Records   sync.Map
-	internals internals
+
+// stamp atomically sets a timestamp to t.
+func stamp(timestamp *int64, t time.Time) {
+	atomic.StoreInt64(timestamp, t.UnixNano())
 }
 
-func NewNabiaRecord[T any](data T) (*NabiaRecord[T], error) { // TODO this function can be expanded later
-	return &NabiaRecord[T]{RawData: data}, nil
+// loadStamp atomically reads a timestamp.
+func loadStamp(timestamp *int64) time.Time {
+	return time.Unix(0, atomic.LoadInt64(timestamp))
 }
 
-func (nr *NabiaRecord[T]) GetRawData() interface{} {
-	return nr.RawData
+// Stats is a point-in-time copy of the database metrics.
+type Stats struct {
+	Reads     int64     `json:"reads"`
+	Writes    int64     `json:"writes"`
+	Size      int64     `json:"size"`
+	Evictions int64     `json:"evictions"`
+	Memory    int64     `json:"memory_bytes"`
+	DiskSize  int64     `json:"disk_size_bytes"` // of the last snapshot saved or loaded, 0 before any
+	Sequence  int64     `json:"sequence"`
+	LastSave  time.Time `json:"last_save"`
+	LastLoad  time.Time `json:"last_load"`
+	LastRead  time.Time `json:"last_read"`
+	LastWrite time.Time `json:"last_write"`
+}
+type internals struct {
+	location    string
+	metrics     metrics
+	stop        chan struct{} // closed to halt background goroutines
+	stopOnce    sync.Once
+	stopErr     error            // returned by every call to Stop
+	wal         *wal             // nil unless EnableWAL was called
+	ioSlots     chan struct{}    // one token per snapshot being saved
+	barrier     sync.RWMutex     // held shared by writes, and exclusively while the map is copied
+	readOnly    atomic.Bool      // writes are rejected and nothing is saved while set
+	allowEmpty  atomic.Bool      // zero-length values may be written
+	compress    atomic.Bool      // snapshots are gzipped while set
+	lru         *lru             // nil unless SetMaxKeys or SetMaxMemory was called
+	fileMode    os.FileMode      // of the snapshots and the write-ahead log, 0 for the defaults
+	encryption  *encryptionKey   // seals the snapshots, nil unless SetEncryptionPassphrase was called
+	subscribers subscribers      // receive the changes of keys, see Subscribe
+	namespaces  sync.Map         // name of each namespace ever used → *namespaceMetrics
+	quotas      map[string]Quota // by namespace, "" for the default; nil unless SetNamespaceQuota was called
+	quotaMu     sync.Mutex       // serializes writes while quotas are set, see checkQuota
+	// syncSnapshot flushes a saved snapshot to stable storage, nil when that
+	// is left to the operating system
+	syncSnapshot func(syncer) error
+}
+type NabiaDB struct {
+	shards    atomic.Pointer[store] // replaced by SetShards, see records
+	internals internals
 }
 
 // checkOrCreateDB checks if the file exists, and if it doesn't, it creates it.
@@ -74,25 +159,27 @@ func checkOrCreateFile(location string) (bool, error) {
 }
 
 func newEmptyDB() *NabiaDB {
-	return &NabiaDB{
-		Records: sync.Map{},
+	ndb := &NabiaDB{
 		internals: internals{
 			location: "",
+			stop:     make(chan struct{}),
+			ioSlots:  make(chan struct{}, defaultIOConcurrency),
 			metrics: metrics{
 				dataActivity: dataActivity{
 					reads:  0,
 					writes: 0,
-					size:   0,
 				},
 				timestamps: timestamps{
-					lastSave:  time.Now(),
-					lastLoad:  time.Now(),
-					lastRead:  time.Now(),
-					lastWrite: time.Now(),
+					lastSave:  time.Now().UnixNano(),
+					lastLoad:  time.Now().UnixNano(),
+					lastRead:  time.Now().UnixNano(),
+					lastWrite: time.Now().UnixNano(),
 				},
 			},
 		},
 	}
+	ndb.shards.Store(newStore(defaultShards()))
+	return ndb
 }
 
 func NewNabiaDB(location string) (*NabiaDB, error) {
@@ -101,13 +188,147 @@ func NewNabiaDB(location string) (*NabiaDB, error) {
 	//if err := ndb.saveToFile(location); err != nil {
 	//	return nil, err
 	//}
+	ndb.startSweeper(defaultSweepInterval)
 	return ndb, nil
 }
 
-// TODO NabiaDBFromFile must be reimplemented
-//func NabiaDBFromFile(location string) (*NabiaDB, error) {
-//	return loadFromFile(location)
-//}
+// NewInMemoryNabiaDB creates a database which lives in memory only, for tests
+// and ephemeral caches. It has no location, so no file is ever created and
+// Stop saves nothing, but a snapshot can still be written with SaveToFile.
+func NewInMemoryNabiaDB() *NabiaDB {
+	ndb := newEmptyDB()
+	ndb.startSweeper(defaultSweepInterval)
+	return ndb
+}
+
+// NabiaDBFromFile loads a previously saved database from disk. Encrypted
+// snapshots fail with ErrEncrypted, see NabiaDBFromEncryptedFile.
+func NabiaDBFromFile(location string) (*NabiaDB, error) {
+	return loadFromFile(location, "")
+}
+
+// Stats returns the current metrics of the database.
+func (ns *NabiaDB) Stats() Stats {
+	m := &ns.internals.metrics
+	return Stats{
+		Reads:     atomic.LoadInt64(&m.dataActivity.reads),
+		Writes:    atomic.LoadInt64(&m.dataActivity.writes),
+		Size:      ns.records().size(),
+		Evictions: atomic.LoadInt64(&m.dataActivity.evictions),
+		Memory:    ns.records().memory(),
+		DiskSize:  atomic.LoadInt64(&m.diskSize),
+		Sequence:  atomic.LoadInt64(&m.sequence),
+		LastSave:  loadStamp(&m.timestamps.lastSave),
+		LastLoad:  loadStamp(&m.timestamps.lastLoad),
+		LastRead:  loadStamp(&m.timestamps.lastRead),
+		LastWrite: loadStamp(&m.timestamps.lastWrite),
+	}
+}
+
+// Sequence returns the number of writes applied to the database so far. It
+// increases monotonically, so comparing the sequence of two replicas tells
+// whether one has caught up with a write observed on the other.
+func (ns *NabiaDB) Sequence() int64 {
+	return atomic.LoadInt64(&ns.internals.metrics.sequence)
+}
+
+// Ping checks that the database is usable, for liveness and readiness probes.
+// Besides a sanity check of the metrics, it verifies that a file can still be
+// created next to the location, so that a disk which went away is noticed
+// before the next snapshot fails.
+func (ns *NabiaDB) Ping() error {
+	if size := ns.records().size(); size < 0 {
+		return fmt.Errorf("inconsistent size %d", size)
+	}
+	if ns.internals.location == "" {
+		return nil // nothing is persisted
+	}
+	probe, err := os.CreateTemp(filepath.Dir(ns.internals.location), ".nabia-ping-*")
+	if err != nil {
+		return fmt.Errorf("location isn't writable: %w", err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// The errors returned by the primitives, wrapped with the key concerned when
+// there is one, so callers can tell them apart with errors.Is.
+var (
+	// ErrKeyEmpty is returned when the key is the empty string.
+	ErrKeyEmpty = errors.New("key cannot be empty")
+	// ErrValueNil is returned by writes of a nil value.
+	ErrValueNil = errors.New("value cannot be nil")
+	// ErrValueEmpty is returned by writes of a zero-length value, unless
+	// SetAllowEmptyValues was called.
+	ErrValueEmpty = errors.New("value cannot be empty")
+	// ErrKeyNotFound is returned by reads, Update, Copy and Move when the
+	// key doesn't exist.
+	ErrKeyNotFound = errors.New("key doesn't exist")
+	// ErrReadOnly is returned by writes to a database in read-only mode.
+	ErrReadOnly = errors.New("database is read-only")
+)
+
+// SetReadOnly switches read-only mode on or off. While it is on, every write
+// fails with ErrReadOnly, and nothing is saved, not even by Stop, so the file
+// of a frozen dataset is never rewritten. Reads are served as usual.
+func (ns *NabiaDB) SetReadOnly(readOnly bool) {
+	ns.internals.readOnly.Store(readOnly)
+}
+
+// ReadOnly tells whether the database is in read-only mode.
+func (ns *NabiaDB) ReadOnly() bool {
+	return ns.internals.readOnly.Load()
+}
+
+// SetAllowEmptyValues switches whether zero-length values may be written, for
+// keys which only mark that something exists. It is off by default, writes of
+// empty values failing then. A nil value is never accepted.
+func (ns *NabiaDB) SetAllowEmptyValues(allow bool) {
+	ns.internals.allowEmpty.Store(allow)
+}
+
+// AllowEmptyValues tells whether zero-length values may be written.
+func (ns *NabiaDB) AllowEmptyValues() bool {
+	return ns.internals.allowEmpty.Load()
+}
+
+// SetCompression switches whether the snapshots saved from then on are
+// compressed with gzip, which shrinks text-heavy datasets several times over
+// at the cost of slower saves and loads. Snapshots are loaded whether they are
+// compressed or not. It is off by default.
+func (ns *NabiaDB) SetCompression(compress bool) {
+	ns.internals.compress.Store(compress)
+}
+
+// Compression tells whether snapshots are saved compressed.
+func (ns *NabiaDB) Compression() bool {
+	return ns.internals.compress.Load()
+}
+
+// checkValue fails if value may not be written: it is nil, or empty while
+// empty values aren't allowed.
+func (ns *NabiaDB) checkValue(value []byte) error {
+	if value == nil {
+		return ErrValueNil
+	}
+	if len(value) == 0 && !ns.AllowEmptyValues() {
+		return ErrValueEmpty
+	}
+	return nil
+}
+
+// SetFileMode sets the permissions of the files written by the database from
+// then on: its snapshots, which are otherwise only accessible to their owner,
+// and its write-ahead log, which is otherwise created with 0666 less the umask.
+// The mode is applied regardless of the umask. It must be set before EnableWAL
+// for the log to be affected.
+func (ns *NabiaDB) SetFileMode(mode os.FileMode) error {
+	if mode&^os.ModePerm != 0 {
+		return fmt.Errorf("file mode %v has more than permission bits", mode)
+	}
+	ns.internals.fileMode = mode
+	return nil
+}
 
 // Below are the DB primitives.
 
@@ -118,110 +339,1143 @@ func (ns *NabiaDB) Exists(key string) bool {
 	if key == "" { // key cannot be empty
 		return false
 	}
-	ns.internals.metrics.timestamps.lastRead = time.Now()
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
 	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
-	_, ok := ns.Records.Load(key)
+	_, ok := ns.load(key)
 	return ok
 }
 
+// MultiExists checks the existence of many keys at once, and tells for each of
+// them whether it exists. The empty key never does.
+// +1 read per key
+func (ns *NabiaDB) MultiExists(keys []string) map[string]bool {
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, int64(len(keys)))
+	result := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		_, ok := ns.load(key)
+		result[key] = ok && key != ""
+	}
+	return result
+}
+
+// MultiRead reads many keys at once, and returns the data stored under those
+// which exist. Missing, expired and empty keys are left out. The returned bytes
+// must not be modified.
+// +1 read per key
+func (ns *NabiaDB) MultiRead(keys []string) map[string][]byte {
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, int64(len(keys)))
+	result := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if e, ok := ns.load(key); ok {
+			result[key] = e.data
+		}
+	}
+	return result
+}
+
 // Read takes a key name and attempts to pull the data from the Nabia DB map.
-// Returns a NabiaRecord if found and an error if not found. Callers must
+// Returns the stored bytes if found and an error if not found. Callers must
 // always check the error returned in the second parameter, as the result cannot
 // be used if the "error" field is not nil. This function is safe to call even
-// with empty data, because the method applies a mutex.
+// with empty data, because the method applies a mutex. The returned bytes are
+// the stored ones, not a copy, and must not be modified; ReadInto copies them.
+// +1 read
+func (ns *NabiaDB) Read(key string) ([]byte, error) {
+	if key == "" {
+		return nil, ErrKeyEmpty
+	}
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+	if e, ok := ns.load(key); ok {
+		return e.data, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+}
+
+// ReadInto copies the data stored under key into dst, so that reading into a
+// reused buffer allocates nothing, and returns the length of the data. If dst
+// is too short, nothing is copied and the error wraps io.ErrShortBuffer, the
+// length telling how large a buffer is needed.
+// +1 read
+func (ns *NabiaDB) ReadInto(key string, dst []byte) (int, error) {
+	if key == "" {
+		return 0, ErrKeyEmpty
+	}
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+	e, ok := ns.load(key)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+	}
+	if len(dst) < len(e.data) {
+		return len(e.data), fmt.Errorf("%w: %q holds %d bytes", io.ErrShortBuffer, key, len(e.data))
+	}
+	return copy(dst, e.data), nil
+}
+
+// ReadWithExpiry behaves like Read, and also returns when the key expires, or
+// the zero time if it doesn't.
 // +1 read
-func (ns *NabiaDB) Read(key string) (interface{}, error) {
+func (ns *NabiaDB) ReadWithExpiry(key string) ([]byte, time.Time, error) {
 	if key == "" {
-		return nil, fmt.Errorf("key cannot be empty")
+		return nil, time.Time{}, ErrKeyEmpty
+	}
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+	if e, ok := ns.load(key); ok {
+		return e.data, e.expiresAt, nil
+	}
+	return nil, time.Time{}, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+}
+
+// ReadRecord behaves like Read, and also returns when the key expires, was
+// created and was last modified. RawData must not be modified either.
+// +1 read
+func (ns *NabiaDB) ReadRecord(key string) (NabiaRecord, error) {
+	if key == "" {
+		return NabiaRecord{}, ErrKeyEmpty
+	}
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+	if e, ok := ns.load(key); ok {
+		return NabiaRecord{RawData: e.data, ExpiresAt: e.expiresAt, CreatedAt: e.createdAt, ModifiedAt: e.modifiedAt}, nil
+	}
+	return NabiaRecord{}, fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+}
+
+// Keys returns, in lexicographic order, the keys starting with prefix. An empty
+// prefix matches every key. Expired keys are left out.
+// +1 read
+func (ns *NabiaDB) Keys(prefix string) []string {
+	keys, _ := ns.KeysContext(context.Background(), prefix)
+	return keys
+}
+
+// KeysContext behaves like Keys, but gives up with the error of ctx as soon as
+// it is done, so that a scan isn't carried on for a caller who left.
+// +1 read
+func (ns *NabiaDB) KeysContext(ctx context.Context, prefix string) ([]string, error) {
+	records, err := ns.ReadPrefixContext(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// ReadPrefix returns the data stored under every key starting with prefix. An
+// empty prefix matches every key. Expired keys are left out. The returned
+// bytes must not be modified.
+// +1 read
+func (ns *NabiaDB) ReadPrefix(prefix string) map[string][]byte {
+	result, _ := ns.ReadPrefixContext(context.Background(), prefix)
+	return result
+}
+
+// ReadPrefixContext behaves like ReadPrefix, but checks ctx between keys and
+// gives up with its error as soon as it is done.
+// +1 read
+func (ns *NabiaDB) ReadPrefixContext(ctx context.Context, prefix string) (map[string][]byte, error) {
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+	result := make(map[string][]byte)
+	now := time.Now()
+	var err error
+	ns.records().Range(func(key, value interface{}) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		k, e := key.(string), value.(*entry)
+		if strings.HasPrefix(k, prefix) && !e.expired(now) {
+			result[k] = e.data
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
-	ns.internals.metrics.timestamps.lastRead = time.Now()
+	return result, nil
+}
+
+// Clone returns an independent in-memory copy of the database, for long
+// analyses or backups which shouldn't hold up live writes. Values are copied,
+// so neither database sees the other's changes. Like a snapshot, the copy is a
+// consistent point in time, see snapshotEntries. Expired keys are left out.
+// The clone has no location and no background sweeper, so it needn't be
+// stopped and is only saved by SaveToFile; its sequence starts at the
+// original's.
+// +1 read
+func (ns *NabiaDB) Clone() *NabiaDB {
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
 	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
-	if value, ok := ns.Records.Load(key); ok {
-		return value, nil
+	clone := newEmptyDB()
+	entries, sequence := ns.snapshotEntries()
+	for key, e := range entries {
+		data := make([]byte, len(e.data))
+		copy(data, e.data)
+		clone.records().Store(key, &entry{data: data, expiresAt: e.expiresAt, createdAt: e.createdAt, modifiedAt: e.modifiedAt})
+		clone.records().addSize(key, 1)
+		clone.records().addMemory(key, e.size(key))
+		clone.countNamespace(key, 1, e.size(key), 0)
 	}
-	return nil, fmt.Errorf("key %q doesn't exist", key)
+	clone.internals.metrics.sequence = sequence
+	return clone
 }
 
-// Write takes the key and a value of NabiaRecord datatype and places it on the
-// database, potentially overwriting whatever was there before, because Write
-// has no data safety features preventing the overwriting of data.
+// ExportedRecord is an element of the JSON array written by ExportJSON. Values
+// are base64-encoded by encoding/json. ExpiresAt is nil for keys without a
+// TTL.
+type ExportedRecord struct {
+	Key         string     `json:"key"`
+	Value       []byte     `json:"value"`
+	ContentType string     `json:"content_type,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ModifiedAt  time.Time  `json:"modified_at"`
+}
+
+// ExportJSON writes every key of the database to w as a JSON array of
+// ExportedRecord, in no particular order, for debugging and migrations.
+// Records are encoded one at a time while ranging over the map, so large
+// databases are never held in memory twice; as a consequence, writes made
+// during the export may or may not be part of it. Expired keys are left out.
+// +1 read
+func (ns *NabiaDB) ExportJSON(w io.Writer) error {
+	return ns.ExportJSONWith(w, nil)
+}
+
+// ExportJSONWith behaves like ExportJSON, but passes every record to convert
+// before it is written. This lets callers storing their own encoding in
+// values, such as the server, export the data and its Content-Type instead.
+// An error returned by convert aborts the export, leaving w with an
+// incomplete document.
+// +1 read
+func (ns *NabiaDB) ExportJSONWith(w io.Writer, convert func(record *ExportedRecord) error) error {
+	return ns.ExportJSONContext(context.Background(), w, convert)
+}
+
+// ExportJSONContext behaves like ExportJSONWith, but checks ctx between
+// records and aborts the export with its error as soon as it is done, leaving
+// w with an incomplete document.
+// +1 read
+func (ns *NabiaDB) ExportJSONContext(ctx context.Context, w io.Writer, convert func(record *ExportedRecord) error) error {
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+	writer := bufio.NewWriter(w)
+	separator := "[\n"
+	var err error
+	now := time.Now()
+	ns.records().Range(func(key, value interface{}) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		e := value.(*entry)
+		if e.expired(now) {
+			return true
+		}
+		record := ExportedRecord{Key: key.(string), Value: e.data, CreatedAt: e.createdAt, ModifiedAt: e.modifiedAt}
+		if !e.expiresAt.IsZero() {
+			expiresAt := e.expiresAt
+			record.ExpiresAt = &expiresAt
+		}
+		if convert != nil {
+			if err = convert(&record); err != nil {
+				return false
+			}
+		}
+		var encoded []byte
+		if encoded, err = json.Marshal(record); err != nil {
+			return false
+		}
+		writer.WriteString(separator)
+		_, err = writer.Write(encoded) // errors of the buffered writer are sticky
+		separator = ",\n"
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if separator == "[\n" { // nothing was written yet
+		writer.WriteString("[")
+	}
+	writer.WriteString("\n]\n")
+	return writer.Flush()
+}
+
+// ImportOptions control how ImportJSONWith imports records.
+type ImportOptions struct {
+	// Overwrite replaces the value of existing keys, which are otherwise
+	// skipped.
+	Overwrite bool
+	// DryRun only counts the records which would be imported, without
+	// writing anything.
+	DryRun bool
+	// Strict aborts the import at the first invalid record, instead of
+	// reporting it and carrying on. Records imported before it are kept.
+	Strict bool
+	// Convert, if set, is called with every record before it is validated,
+	// and may rewrite it. An error rejects the record.
+	Convert func(record *ExportedRecord) error
+}
+
+// ImportError reports a record which couldn't be imported, by its index in
+// the array.
+type ImportError struct {
+	Index   int    `json:"index"`
+	Key     string `json:"key,omitempty"`
+	Message string `json:"error"`
+}
+
+func (ie ImportError) Error() string {
+	return fmt.Sprintf("record %d: %s", ie.Index, ie.Message)
+}
+
+// ImportResult tells how many records were imported, or would have been in a
+// dry run, and which were skipped or rejected.
+type ImportResult struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"` // existing keys, and expired records
+	Failed   []ImportError `json:"failed"`
+}
+
+// ImportJSON writes every record of a JSON array in the format of ExportJSON
+// to the database, overwriting existing keys. Invalid records are skipped,
+// and reported together in the returned error once the others were imported.
+func (ns *NabiaDB) ImportJSON(r io.Reader) error {
+	result, err := ns.ImportJSONWith(r, ImportOptions{Overwrite: true})
+	if err != nil {
+		return err
+	}
+	errs := make([]error, len(result.Failed))
+	for i, failure := range result.Failed {
+		errs[i] = failure
+	}
+	return errors.Join(errs...)
+}
+
+// ImportJSONWith behaves like ImportJSON, with the given options. The
+// document is decoded one record at a time, so it is never held in memory as
+// a whole. Records keep their absolute expiry time, and those already expired
+// are skipped. An error is returned when the document isn't a JSON array, in
+// which case the records before the malformed part were imported, or, in
+// strict mode, for the first invalid record.
+func (ns *NabiaDB) ImportJSONWith(r io.Reader, options ImportOptions) (ImportResult, error) {
+	result := ImportResult{Failed: []ImportError{}}
+	decoder := json.NewDecoder(r)
+	if token, err := decoder.Token(); err != nil {
+		return result, err
+	} else if token != json.Delim('[') {
+		return result, fmt.Errorf("expected a JSON array of records")
+	}
+	for index := 0; decoder.More(); index++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return result, err // the rest of the document can't be read
+		}
+		skipped, err := ns.importRecord(raw, options)
+		if failure, ok := err.(ImportError); ok {
+			failure.Index = index
+			result.Failed = append(result.Failed, failure)
+			if options.Strict {
+				return result, failure
+			}
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if skipped {
+			result.Skipped++
+		} else {
+			result.Imported++
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// importRecord validates and writes a single record of ImportJSONWith. It
+// tells whether the record was skipped. Invalid records are reported with an
+// ImportError.
+func (ns *NabiaDB) importRecord(raw json.RawMessage, options ImportOptions) (bool, error) {
+	var record ExportedRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return false, ImportError{Message: err.Error()}
+	}
+	if options.Convert != nil {
+		if err := options.Convert(&record); err != nil {
+			return false, ImportError{Key: record.Key, Message: err.Error()}
+		}
+	}
+	if record.Key == "" {
+		return false, ImportError{Message: ErrKeyEmpty.Error()}
+	}
+	if err := ns.checkValue(record.Value); err != nil {
+		return false, ImportError{Key: record.Key, Message: err.Error()}
+	}
+	var expiresAt time.Time
+	if record.ExpiresAt != nil {
+		expiresAt = *record.ExpiresAt
+		if !time.Now().Before(expiresAt) {
+			return true, nil
+		}
+	}
+	if options.DryRun {
+		_, exists := ns.load(record.Key)
+		return !options.Overwrite && exists, nil
+	}
+	if options.Overwrite {
+		return false, ns.write(record.Key, record.Value, expiresAt)
+	}
+	written, err := ns.writeIfAbsent(record.Key, record.Value, expiresAt)
+	return !written, err
+}
+
+// Write takes the key and a value, non-empty unless SetAllowEmptyValues was
+// called, and places it on the database, potentially overwriting whatever was
+// there before, because Write has no data safety features preventing the
+// overwriting of data. The value is copied, as are those of every other write,
+// so the caller is free to modify it afterwards.
+// +1 write when validation passes
+// +1 size if the key is new
+func (ns *NabiaDB) Write(key string, value []byte) error {
+	return ns.write(key, value, time.Time{})
+}
+
+// WriteWithTTL behaves like Write, but the key is treated as absent once the
+// ttl has elapsed. Expired keys are removed lazily when accessed and
+// periodically by a background sweeper.
 // +1 write when validation passes
 // +1 size if the key is new
-func (ns *NabiaDB) Write(key string, value interface{}) error {
+func (ns *NabiaDB) WriteWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+	return ns.write(key, value, time.Now().Add(ttl))
+}
+
+func (ns *NabiaDB) write(key string, value []byte, expiresAt time.Time) error {
 	// validation
 	if key == "" {
-		return fmt.Errorf("key cannot be empty")
+		return ErrKeyEmpty
+	}
+	if err := ns.checkValue(value); err != nil {
+		return err
+	}
+	if ns.ReadOnly() {
+		return ErrReadOnly
+	}
+	if err := ns.checkBudget(key, value); err != nil {
+		return err
 	}
 	// writing
-	ns.internals.metrics.timestamps.lastWrite = time.Now()
+	unlock := ns.lockWrite()
+	defer unlock()
+	current, _ := ns.load(key)
+	if err := ns.checkStore(key, value, current); err != nil {
+		return err
+	}
+	now := time.Now()
+	stamp(&ns.internals.metrics.timestamps.lastWrite, now)
 	atomic.AddInt64(&ns.internals.metrics.dataActivity.writes, 1)
-	if !ns.Exists(key) {
-		atomic.AddInt64(&ns.internals.metrics.dataActivity.size, 1)
+	e := &entry{data: bytes.Clone(value), expiresAt: expiresAt, createdAt: now, modifiedAt: now}
+	if current != nil { // an overwrite keeps the creation time
+		e.createdAt = current.createdAt
 	}
-	ns.Records.Store(key, value)
-	return nil
+	previous := ns.swap(key, e)
+	if previous == nil {
+		ns.records().addSize(key, 1)
+	}
+	ns.replaced(key, e, previous)
+	atomic.AddInt64(&ns.internals.metrics.sequence, 1)
+	err := ns.logStore(key, e)
+	ns.evictLeastRecentlyUsed()
+	return err
+}
+
+// WriteIfAbsent stores the value under key only if the key doesn't exist yet,
+// as a single atomic step. It returns true if the value was written.
+// +1 read
+// +1 write and +1 size if the key was absent
+func (ns *NabiaDB) WriteIfAbsent(key string, value []byte) (bool, error) {
+	return ns.writeIfAbsent(key, value, time.Time{})
+}
+
+func (ns *NabiaDB) writeIfAbsent(key string, value []byte, expiresAt time.Time) (bool, error) {
+	// validation
+	if key == "" {
+		return false, ErrKeyEmpty
+	}
+	if err := ns.checkValue(value); err != nil {
+		return false, err
+	}
+	if ns.ReadOnly() {
+		return false, ErrReadOnly
+	}
+	if err := ns.checkBudget(key, value); err != nil {
+		return false, err
+	}
+	// writing
+	unlock := ns.lockWrite()
+	defer unlock()
+	stamp(&ns.internals.metrics.timestamps.lastRead, time.Now())
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+	if _, exists := ns.load(key); !exists {
+		if err := ns.checkStore(key, value, nil); err != nil {
+			return false, err
+		}
+	}
+	now := time.Now()
+	e := &entry{data: bytes.Clone(value), expiresAt: expiresAt, createdAt: now, modifiedAt: now}
+	for {
+		actual, loaded := ns.records().LoadOrStore(key, e)
+		if !loaded {
+			break
+		}
+		if e := actual.(*entry); e.expired(time.Now()) {
+			ns.evictExpired(key, e) // an expired key counts as absent, retry
+			continue
+		}
+		return false, nil
+	}
+	ns.replaced(key, e, nil)
+	stamp(&ns.internals.metrics.timestamps.lastWrite, time.Now())
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.writes, 1)
+	ns.records().addSize(key, 1)
+	atomic.AddInt64(&ns.internals.metrics.sequence, 1)
+	err := ns.logStore(key, e)
+	ns.evictLeastRecentlyUsed()
+	return true, err
+}
+
+// CompareAndSwap replaces the value stored under key with new, but only if the
+// current value equals old. It returns true when the swap took place. Missing
+// and expired keys never match. A TTL set on the key is kept by the swap.
+// +1 read and +1 write if the swap succeeds
+func (ns *NabiaDB) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	// validation
+	if key == "" {
+		return false, ErrKeyEmpty
+	}
+	if err := ns.checkValue(new); err != nil {
+		return false, err
+	}
+	if ns.ReadOnly() {
+		return false, ErrReadOnly
+	}
+	if err := ns.checkBudget(key, new); err != nil {
+		return false, err
+	}
+	// swapping
+	unlock := ns.lockWrite()
+	defer unlock()
+	current, ok := ns.load(key)
+	if !ok || !bytes.Equal(current.data, old) {
+		return false, nil
+	}
+	if err := ns.checkStore(key, new, current); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	next := &entry{data: bytes.Clone(new), expiresAt: current.expiresAt, createdAt: current.createdAt, modifiedAt: now}
+	if !ns.records().CompareAndSwap(key, current, next) {
+		return false, nil // the value changed since it was loaded
+	}
+	ns.replaced(key, next, current)
+	stamp(&ns.internals.metrics.timestamps.lastRead, now)
+	stamp(&ns.internals.metrics.timestamps.lastWrite, now)
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.writes, 1)
+	atomic.AddInt64(&ns.internals.metrics.sequence, 1)
+	err := ns.logStore(key, next)
+	ns.evictLeastRecentlyUsed()
+	return true, err
+}
+
+// Increment interprets the value stored under key as an ASCII decimal integer,
+// adds delta to it and stores the result, which is also returned. Missing keys
+// start from zero, and overflows wrap around. If the stored value isn't an
+// integer an error is returned and nothing is modified. Concurrent increments
+// never lose updates, as the value is only replaced if it didn't change since
+// it was read. A TTL set on the key is kept.
+// +1 read and +1 write
+// +1 size if the key is new
+func (ns *NabiaDB) Increment(key string, delta int64) (int64, error) {
+	if key == "" {
+		return 0, ErrKeyEmpty
+	}
+	if ns.ReadOnly() {
+		return 0, ErrReadOnly
+	}
+	unlock := ns.lockWrite()
+	defer unlock()
+	for {
+		current, ok := ns.load(key)
+		var n int64
+		if ok {
+			parsed, err := strconv.ParseInt(string(current.data), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("value of key %q is not an integer", key)
+			}
+			n = parsed
+		}
+		result := n + delta
+		now := time.Now()
+		next := &entry{data: []byte(strconv.FormatInt(result, 10)), createdAt: now, modifiedAt: now}
+		if err := ns.checkBudget(key, next.data); err != nil {
+			return 0, err
+		}
+		if err := ns.checkStore(key, next.data, current); err != nil {
+			return 0, err
+		}
+		var previous *entry
+		if ok {
+			next.expiresAt, next.createdAt = current.expiresAt, current.createdAt
+			if !ns.records().CompareAndSwap(key, current, next) {
+				continue // lost the race against another writer, retry
+			}
+			previous = current
+		} else {
+			if _, loaded := ns.records().LoadOrStore(key, next); loaded {
+				continue // the key was created meanwhile, retry
+			}
+			ns.records().addSize(key, 1)
+		}
+		ns.replaced(key, next, previous)
+		stamp(&ns.internals.metrics.timestamps.lastRead, now)
+		stamp(&ns.internals.metrics.timestamps.lastWrite, now)
+		atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+		atomic.AddInt64(&ns.internals.metrics.dataActivity.writes, 1)
+		atomic.AddInt64(&ns.internals.metrics.sequence, 1)
+		err := ns.logStore(key, next)
+		ns.evictLeastRecentlyUsed()
+		return result, err
+	}
+}
+
+// Update atomically replaces the value stored under an existing key with the
+// result of fn, which receives the current value and must not modify it. If
+// another writer changes the value while fn runs, fn is called again with the
+// new value, so no update is ever lost. An error returned by fn aborts the
+// update and is returned as is. A TTL set on the key is kept.
+// +1 read and +1 write
+func (ns *NabiaDB) Update(key string, fn func(current []byte) ([]byte, error)) error {
+	if key == "" {
+		return ErrKeyEmpty
+	}
+	if ns.ReadOnly() {
+		return ErrReadOnly
+	}
+	unlock := ns.lockWrite()
+	defer unlock()
+	for {
+		current, ok := ns.load(key)
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrKeyNotFound, key)
+		}
+		value, err := fn(current.data)
+		if err != nil {
+			return err
+		}
+		if err := ns.checkValue(value); err != nil {
+			return err
+		}
+		if err := ns.checkBudget(key, value); err != nil {
+			return err
+		}
+		if err := ns.checkStore(key, value, current); err != nil {
+			return err
+		}
+		now := time.Now()
+		next := &entry{data: bytes.Clone(value), expiresAt: current.expiresAt, createdAt: current.createdAt, modifiedAt: now}
+		if !ns.records().CompareAndSwap(key, current, next) {
+			continue // lost the race against another writer, retry
+		}
+		ns.replaced(key, next, current)
+		stamp(&ns.internals.metrics.timestamps.lastRead, now)
+		stamp(&ns.internals.metrics.timestamps.lastWrite, now)
+		atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+		atomic.AddInt64(&ns.internals.metrics.dataActivity.writes, 1)
+		atomic.AddInt64(&ns.internals.metrics.sequence, 1)
+		err = ns.logStore(key, next)
+		ns.evictLeastRecentlyUsed()
+		return err
+	}
+}
+
+// ErrKeyExists is returned, wrapped, by Copy and Move when the destination
+// exists and overwrite wasn't requested.
+var ErrKeyExists = errors.New("key already exists")
+
+// Copy stores the value of src under dst as well, as a single atomic step, so
+// the copy is the value src held at one point in time. A TTL set on src is
+// copied along. It fails with ErrKeyNotFound if src doesn't exist, and with
+// ErrKeyExists if dst does unless overwrite is set.
+// +1 read and +1 write
+// +1 size if dst is new
+func (ns *NabiaDB) Copy(src, dst string, overwrite bool) error {
+	if src == "" || dst == "" {
+		return ErrKeyEmpty
+	}
+	if ns.ReadOnly() {
+		return ErrReadOnly
+	}
+	unlock := ns.lockWrite()
+	defer unlock()
+	source, ok := ns.load(src)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrKeyNotFound, src)
+	}
+	if err := ns.checkBudget(dst, source.data); err != nil {
+		return err
+	}
+	now := time.Now()
+	e := &entry{data: source.data, expiresAt: source.expiresAt, createdAt: now, modifiedAt: now}
+	for {
+		current, exists := ns.load(dst)
+		if exists && !overwrite {
+			return fmt.Errorf("%w: %q", ErrKeyExists, dst)
+		}
+		if err := ns.checkStore(dst, source.data, current); err != nil {
+			return err
+		}
+		if exists {
+			e.createdAt = current.createdAt // an overwrite keeps the creation time
+			if !ns.records().CompareAndSwap(dst, current, e) {
+				continue // lost the race against another writer, retry
+			}
+		} else {
+			if _, loaded := ns.records().LoadOrStore(dst, e); loaded {
+				continue // the key was created meanwhile, retry
+			}
+			ns.records().addSize(dst, 1)
+		}
+		ns.replaced(dst, e, current)
+		break
+	}
+	stamp(&ns.internals.metrics.timestamps.lastRead, now)
+	stamp(&ns.internals.metrics.timestamps.lastWrite, now)
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.writes, 1)
+	atomic.AddInt64(&ns.internals.metrics.sequence, 1)
+	err := ns.logStore(dst, e)
+	ns.evictLeastRecentlyUsed()
+	return err
+}
+
+// Move renames src to dst as a single atomic step: either the value is stored
+// under dst and src is removed, or nothing changes. Of concurrent moves of the
+// same key, only one succeeds; the others find src missing. The TTL and the
+// creation time of src are kept. It fails with ErrKeyNotFound if src doesn't
+// exist, and with ErrKeyExists if dst does unless overwrite is set.
+// +1 read and +1 write
+// -1 size if dst is overwritten
+func (ns *NabiaDB) Move(src, dst string, overwrite bool) error {
+	if src == "" || dst == "" {
+		return ErrKeyEmpty
+	}
+	if ns.ReadOnly() {
+		return ErrReadOnly
+	}
+	unlock := ns.lockWrite()
+	defer unlock()
+	var source *entry
+	for { // claim the source, so that no other move gets it
+		current, ok := ns.load(src)
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrKeyNotFound, src)
+		}
+		if err := ns.checkBudget(dst, current.data); err != nil {
+			return err
+		}
+		existing, exists := ns.load(dst)
+		if exists && !overwrite && existing != current {
+			return fmt.Errorf("%w: %q", ErrKeyExists, dst)
+		}
+		if err := ns.checkMove(src, dst, current, existing); err != nil {
+			return err
+		}
+		if ns.records().CompareAndDelete(src, current) {
+			source = current
+			break
+		}
+	}
+	ns.records().addSize(src, -1)
+	ns.removed(src, source)
+	now := time.Now()
+	e := &entry{data: source.data, expiresAt: source.expiresAt, createdAt: source.createdAt, modifiedAt: now}
+	if overwrite {
+		previous := ns.swap(dst, e)
+		if previous == nil {
+			ns.records().addSize(dst, 1)
+		}
+		ns.replaced(dst, e, previous)
+	} else {
+		for {
+			actual, loaded := ns.records().LoadOrStore(dst, e)
+			if !loaded {
+				break
+			}
+			if existing := actual.(*entry); existing.expired(time.Now()) {
+				ns.evictExpired(dst, existing) // an expired key counts as absent, retry
+				continue
+			}
+			// dst was created since it was checked: put the source back, unless
+			// it was written meanwhile, which supersedes it anyway
+			if _, loaded := ns.records().LoadOrStore(src, source); !loaded {
+				ns.records().addSize(src, 1)
+				ns.replaced(src, source, nil)
+			}
+			return fmt.Errorf("%w: %q", ErrKeyExists, dst)
+		}
+		ns.records().addSize(dst, 1)
+		ns.replaced(dst, e, nil)
+	}
+	stamp(&ns.internals.metrics.timestamps.lastRead, now)
+	stamp(&ns.internals.metrics.timestamps.lastWrite, now)
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.reads, 1)
+	atomic.AddInt64(&ns.internals.metrics.dataActivity.writes, 1)
+	atomic.AddInt64(&ns.internals.metrics.sequence, 1)
+	// The destination is logged first: a crash in between replays a copy
+	// rather than losing the value
+	err := ns.logStore(dst, e)
+	if deleteErr := ns.logDelete(src); err == nil {
+		err = deleteErr
+	}
+	ns.evictLeastRecentlyUsed()
+	return err
 }
 
 // Delete takes a key and removes it from the map. This method doesn't have
 // existence-checking logic. It is safe to use on empty data, it simply doesn't
-// do anything if the record doesn't exist.
+// do anything if the record doesn't exist. It only fails with ErrKeyEmpty, and
+// with ErrReadOnly in read-only mode.
 // -1 size if the key exists
 // +1 write
-func Delete(ns *NabiaDB, key string) {
-	if ns.Exists(key) {
-		atomic.AddInt64(&ns.internals.metrics.dataActivity.size, -1)
+func (ns *NabiaDB) Delete(key string) error {
+	if key == "" {
+		return ErrKeyEmpty
 	}
-	ns.Records.Delete(key)
-	ns.internals.metrics.timestamps.lastWrite = time.Now()
+	if ns.ReadOnly() {
+		return ErrReadOnly
+	}
+	unlock := ns.lockWrite()
+	defer unlock()
+	if previous, loaded := ns.records().LoadAndDelete(key); loaded {
+		ns.records().addSize(key, -1)
+		ns.removed(key, previous.(*entry))
+		ns.logDelete(key) // Delete can't fail, a log error resurfaces on the next write
+	}
+	stamp(&ns.internals.metrics.timestamps.lastWrite, time.Now())
 	atomic.AddInt64(&ns.internals.metrics.dataActivity.writes, 1)
+	atomic.AddInt64(&ns.internals.metrics.sequence, 1)
+	return nil
+}
+
+// lockWrite is held by every mutation of the map. It serializes them while the
+// write-ahead log is enabled, the keys or memory are bounded, or namespaces
+// have quotas, and otherwise only keeps them out of the way of
+// snapshotEntries. It returns the function releasing it.
+func (ns *NabiaDB) lockWrite() func() {
+	unlockWAL := ns.lockWAL()
+	l := ns.internals.lru
+	if l != nil {
+		l.writeMu.Lock()
+	}
+	quotas := ns.internals.quotas != nil
+	if quotas {
+		ns.internals.quotaMu.Lock()
+	}
+	ns.internals.barrier.RLock()
+	return func() {
+		ns.internals.barrier.RUnlock()
+		if quotas {
+			ns.internals.quotaMu.Unlock()
+		}
+		if l != nil {
+			l.writeMu.Unlock()
+		}
+		unlockWAL()
+	}
+}
+
+// snapshotEntries returns the live entries of the map, along with the sequence
+// they are current as of. Writes wait while the map is copied, so the copy is
+// a single point in time: every write is either entirely in it or not at all,
+// and the sequence counts exactly the writes it holds. Entries are replaced
+// rather than modified, so only pointers are copied and writes are held up
+// briefly.
+func (ns *NabiaDB) snapshotEntries() (map[string]*entry, int64) {
+	ns.internals.barrier.Lock()
+	defer ns.internals.barrier.Unlock()
+	entries := make(map[string]*entry)
+	now := time.Now()
+	ns.records().Range(func(key, value interface{}) bool {
+		if e := value.(*entry); !e.expired(now) {
+			entries[key.(string)] = e
+		}
+		return true
+	})
+	return entries, atomic.LoadInt64(&ns.internals.metrics.sequence)
+}
+
+// swap stores e under key, and returns the entry it replaced, if any.
+func (ns *NabiaDB) swap(key string, e *entry) *entry {
+	if previous, loaded := ns.records().Swap(key, e); loaded {
+		return previous.(*entry)
+	}
+	return nil
+}
+
+// replaced accounts for e being stored under key in place of previous, which
+// is nil for new keys.
+func (ns *NabiaDB) replaced(key string, e, previous *entry) {
+	delta := e.size(key)
+	if previous != nil {
+		delta -= previous.size(key)
+	}
+	ns.records().addMemory(key, delta)
+	ns.internals.lru.stored(key, e)
+	var added int64
+	if previous == nil {
+		added = 1
+	}
+	ns.countNamespace(key, added, delta, 1)
+	ns.notify(OpWrite, key)
+}
+
+// removed accounts for e being deleted from under key.
+func (ns *NabiaDB) removed(key string, e *entry) {
+	ns.records().addMemory(key, -e.size(key))
+	ns.internals.lru.removed(key, e)
+	ns.countNamespace(key, -1, -e.size(key), 1)
+	ns.notify(OpDelete, key)
+}
+
+// load returns the live entry stored under key. Expired entries are deleted
+// on the spot and reported as absent.
+func (ns *NabiaDB) load(key string) (*entry, bool) {
+	value, ok := ns.records().Load(key)
+	if !ok {
+		return nil, false
+	}
+	e := value.(*entry)
+	if e.expired(time.Now()) {
+		ns.evictExpired(key, e)
+		return nil, false
+	}
+	ns.internals.lru.touch(key)
+	return e, true
+}
+
+// evictExpired removes an expired entry, unless it has been replaced in the
+// meantime.
+// -1 size if the entry was removed
+func (ns *NabiaDB) evictExpired(key string, e *entry) {
+	if ns.records().CompareAndDelete(key, e) {
+		ns.records().addSize(key, -1)
+		ns.removed(key, e)
+	}
+}
+
+// purgeExpired removes every expired entry from the map.
+func (ns *NabiaDB) purgeExpired() {
+	now := time.Now()
+	ns.records().Range(func(key, value interface{}) bool {
+		if e := value.(*entry); e.expired(now) {
+			ns.evictExpired(key.(string), e)
+		}
+		return true
+	})
+}
+
+// startSweeper launches the goroutine which purges expired keys every
+// interval, until the database is stopped.
+func (ns *NabiaDB) startSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ns.purgeExpired()
+			case <-ns.internals.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the background goroutines and saves a final snapshot, unless the
+// database is read-only or in memory only. It returns the error of that save,
+// so callers can tell whether data was lost. The channels of Subscribe are
+// closed. Only the first call stops the database, concurrent and later calls
+// wait for it and return the same error.
+func (ns *NabiaDB) Stop() error {
+	ns.internals.stopOnce.Do(func() {
+		unlock := ns.lockWAL() // no compaction starts once stopped
+		close(ns.internals.stop)
+		unlock()
+		if w := ns.internals.wal; w != nil {
+			w.compactions.Wait()
+		}
+		if !ns.ReadOnly() && ns.internals.location != "" {
+			ns.internals.stopErr = ns.saveToFile(ns.internals.location)
+		}
+		if w := ns.internals.wal; w != nil {
+			unlock := ns.lockWAL() // the log may be syncing
+			w.file.Close()
+			unlock()
+		}
+		ns.closeSubscribers()
+	})
+	return ns.internals.stopErr
+}
+
+// Save writes a snapshot of the database to its location. At most as many
+// saves as allowed by SetIOConcurrency run at once, the others wait for their
+// turn. It fails with ErrReadOnly in read-only mode.
+func (ns *NabiaDB) Save() error {
+	if ns.ReadOnly() {
+		return ErrReadOnly
+	}
+	if ns.internals.location == "" {
+		return fmt.Errorf("location cannot be empty")
+	}
+	return ns.saveToFile(ns.internals.location)
+}
+
+// SaveToFile writes a snapshot of the database to location, which needn't be
+// the location of the database, for backups and for databases in memory only.
+// It is subject to SetIOConcurrency like Save, and is allowed in read-only
+// mode unless location is the database's own.
+func (ns *NabiaDB) SaveToFile(location string) error {
+	if location == "" {
+		return fmt.Errorf("location cannot be empty")
+	}
+	if ns.ReadOnly() && location == ns.internals.location {
+		return ErrReadOnly
+	}
+	return ns.saveToFile(location)
 }
 
-func (ns *NabiaDB) Stop() {
-	ns.saveToFile(ns.internals.location)
-	// TODO emit a shutdown signal
+// SetIOConcurrency sets how many snapshots may be saved at the same time,
+// which bounds the disk activity of overlapping saves. It defaults to
+// defaultIOConcurrency, and must be set before the database is in use.
+func (ns *NabiaDB) SetIOConcurrency(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("IO concurrency must be positive")
+	}
+	ns.internals.ioSlots = make(chan struct{}, n)
+	return nil
 }
 
-// TODO: Saving and loading must be reimplemented because of generics
 func (ns *NabiaDB) saveToFile(filename string) error {
-	// Open or create the file for writing. os.Create truncates the file if it already exists.
-	file, err := os.Create(filename)
+	ns.internals.ioSlots <- struct{}{} // wait for a free slot
+	defer func() { <-ns.internals.ioSlots }()
+	w := ns.internals.wal
+	emptiesWAL := w != nil && filename == ns.internals.location
+	if emptiesWAL {
+		w.saveMu.Lock()
+		defer w.saveMu.Unlock()
+	}
+
+	// The snapshot is written next to its destination and renamed into place
+	// once complete, so concurrent saves never interleave in the same file
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-*")
 	if err != nil {
 		return err // Return the error if file creation fails
 	}
-	defer file.Close() // Ensure the file is closed after writing is complete
+	defer os.Remove(file.Name()) // Only left behind if the save failed
+	defer file.Close()           // Ensure the file is closed after writing is complete
+	if mode := ns.internals.fileMode; mode != 0 {
+		if err := file.Chmod(mode); err != nil {
+			return fmt.Errorf("setting the mode of %s: %w", filename, err)
+		}
+	}
 
 	// Use a buffered writer for efficient file writing
 	writer := bufio.NewWriter(file)
-	defer writer.Flush() // Ensure buffered data is flushed to file
-
-	// Create a new gob encoder that writes to the buffered writer
-	encoder := gob.NewEncoder(writer)
-
-	// Prepare a regular map to hold the data from sync.Map
-	// This is necessary because gob cannot directly encode/decode sync.Map
-	data := make(map[string]NabiaRecord[interface{}])
 
-	// Copy data from sync.Map to the regular map
-	ns.Records.Range(func(key, value interface{}) bool {
-		k, okKey := key.(K)                            // Ensure the key is of type K
-		nabiaRecord, okValue := value.(NabiaRecord[V]) // Ensure the value is of type NabiaRecord[V]
-		if okKey && okValue {
-			data[k] = nabiaRecord
+	// The copy is consistent, see snapshotEntries. The absolute expiry time
+	// is persisted, so keys expire at the same moment after being loaded
+	// again. The length of the write-ahead log is taken along with the copy:
+	// the records past it are the writes the snapshot misses, and all the log
+	// keeps once the snapshot is in place. Writes only wait while the map is
+	// copied.
+	unlock := ns.lockWAL()
+	entries, _ := ns.snapshotEntries()
+	var logged int64
+	if emptiesWAL {
+		logged = w.size
+	}
+	unlock()
+	key := ns.internals.encryption
+	var out io.Writer = writer
+	var snapshot bytes.Buffer
+	if key != nil {
+		out = &snapshot // sealed at once, see encryptedMagic
+	}
+	// Compression comes first, as ciphertext doesn't compress
+	if err := writeCompressedSnapshot(out, entries, ns.Compression()); err != nil {
+		return err
+	}
+	if key != nil {
+		if err := key.seal(writer, snapshot.Bytes()); err != nil {
+			return err
 		}
-		return true // Continue iterating over all entries in the sync.Map
-	})
-
-	// Encode the regular map into the file
-	err = encoder.Encode(data)
+	}
+	if err := writer.Flush(); err != nil { // Ensure buffered data is flushed to file
+		return err
+	}
+	if sync := ns.internals.syncSnapshot; sync != nil {
+		if err := sync(file); err != nil {
+			return err
+		}
+	}
+	info, err := file.Stat()
 	if err != nil {
-		return err // Return the error if encoding fails
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), filename); err != nil {
+		return err
+	}
+
+	// The snapshot now holds the start of the write-ahead log
+	if emptiesWAL {
+		unlock := ns.lockWAL()
+		err := ns.truncateWAL(logged)
+		unlock()
+		if err != nil {
+			return err
+		}
 	}
 
-	ns.internals.metrics.timestamps.lastSave = time.Now()
+	if filename == ns.internals.location {
+		atomic.StoreInt64(&ns.internals.metrics.diskSize, info.Size())
+	}
+	stamp(&ns.internals.metrics.timestamps.lastSave, time.Now())
 	return nil // Return nil if the function completes successfully
 }
 
-func loadFromFile(filename string) (*NabiaDB, error) {
+// loadFromFile loads the snapshot at filename, decrypting it with passphrase
+// if it is encrypted. With a passphrase, the database keeps saving encrypted
+// snapshots.
+func loadFromFile(filename string, passphrase string) (*NabiaDB, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
@@ -230,23 +1484,61 @@ func loadFromFile(filename string) (*NabiaDB, error) {
 
 	// Use a buffered reader for better performance
 	reader := bufio.NewReader(file)
-	decoder := gob.NewDecoder(reader)
-
-	// Decode the map
-	data := make(map[K]NabiaRecord[V])
-	if err := decoder.Decode(&data); err != nil {
+	var key *encryptionKey
+	if isEncrypted(reader) {
+		snapshot, k, err := openEncrypted(reader, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+		reader = bufio.NewReader(bytes.NewReader(snapshot))
+	} else if passphrase != "" {
+		// A plaintext snapshot, encrypted from its next save on
+		if key, err = newSaltedKey(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	reader, err = decompress(reader)
+	if err != nil {
+		return nil, err
+	}
+	version, err := readSnapshotHeader(reader)
+	if err != nil {
 		return nil, err
 	}
+	data, err := readSnapshot(reader, version)
+	if err != nil {
+		return nil, fmt.Errorf("decoding a snapshot of version %d: %w", version, err)
+	}
 
 	// Convert the regular map back to a sync.Map
 	ndb := newEmptyDB()
 	ndb.internals.location = filename
+	ndb.internals.encryption = key
+	if info, err := file.Stat(); err == nil {
+		ndb.internals.metrics.diskSize = info.Size()
+	}
+	now := time.Now()
 	for key, value := range data {
-		ndb.Write(fmt.Sprintf("%v", key), value)
-		ndb.internals.metrics.dataActivity.size++
+		e := &entry{data: value.RawData, expiresAt: value.ExpiresAt, createdAt: value.CreatedAt, modifiedAt: value.ModifiedAt}
+		if e.expired(now) { // expired while the database was offline
+			continue
+		}
+		// Files saved before timestamps were recorded have none
+		if e.createdAt.IsZero() {
+			e.createdAt = now
+		}
+		if e.modifiedAt.IsZero() {
+			e.modifiedAt = now
+		}
+		ndb.records().Store(key, e)
+		ndb.records().addSize(key, 1)
+		ndb.records().addMemory(key, e.size(key))
+		ndb.countNamespace(key, 1, e.size(key), 0)
 	}
 
-	ndb.internals.metrics.timestamps.lastLoad = time.Now()
+	stamp(&ndb.internals.metrics.timestamps.lastLoad, time.Now())
+	ndb.startSweeper(defaultSweepInterval)
 
 	return ndb, nil
 }
@@ -2,14 +2,23 @@ package engine
 
 import (
 	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestFileSavingAndLoading(t *testing.T) {
@@ -30,14 +39,13 @@ func TestFileSavingAndLoading(t *testing.T) {
 		t.Fatalf("failed to create NabiaDB: %s", err) // Unknown error
 	}
 	defer os.Remove(location)
-	value_a, _ := NewNabiaRecord("Value_A")
-	if err := nabiaDB.Write("A", value_a); err != nil { // Failure when writing a value
+	if err := nabiaDB.Write("A", []byte("Value_A")); err != nil { // Failure when writing a value
 		t.Errorf("failed to write to NabiaDB: %s", err) // Unknown error
 	}
 	if err := nabiaDB.saveToFile(location); err != nil {
 		t.Fatalf("failed to save NabiaDB to file: %s", err) // Unknown error
 	}
-	nabiaDB, err = loadFromFile(location)
+	nabiaDB, err = loadFromFile(location, "")
 	if err != nil {
 		t.Fatalf("failed to load NabiaDB from file: %s", err) // Unknown error
 	}
@@ -52,14 +60,14 @@ func TestFileSavingAndLoading(t *testing.T) {
 	if err := os.Remove(location); err != nil { // Deleting DB from disk
 		t.Fatalf("failed to remove test.db: %s", err)
 	}
-	_, err = loadFromFile(location)
+	_, err = loadFromFile(location, "")
 	if !strings.Contains(err.Error(), "no such file or directory") { // Attempting to read a file that doesn't exist should never succeed
 		t.Errorf("should not succeed when attempting to load a non-existant file: %s", err)
 	}
 	if err := nabiaDB.saveToFile(location); err != nil { // Attempting to save after deletion
 		t.Fatalf("failed to save NabiaDB to file: %s", err)
 	}
-	nabiaDB, err = loadFromFile(location) // Attempting to load the database once again
+	nabiaDB, err = loadFromFile(location, "") // Attempting to load the database once again
 	if err != nil {
 		t.Fatalf("failed to load NabiaDB from file: %s", err) // Unknown error
 	}
@@ -68,11 +76,11 @@ func TestFileSavingAndLoading(t *testing.T) {
 		t.Fatalf("failed to read from NabiaDB: %s", err) // Unknown error
 	} else {
 		expectedData := []byte("Value_A")
-		if !bytes.Equal(nr, expectedData) { //TODO fix this ???
+		if !bytes.Equal(nr, expectedData) {
 			t.Errorf("failed to read the correct value from NabiaDB: %s", err)
 		}
 	}
-	nr, err = nabiaDB.Read("B")
+	_, err = nabiaDB.Read("B")
 	if err == nil {
 		t.Error("should not succeed when attempting to read a non-existent key")
 	}
@@ -81,52 +89,65 @@ func TestFileSavingAndLoading(t *testing.T) {
 	}
 }
 
+// activity holds the counters of a database, those of dataActivity along with
+// the number and size of the keys counted by the shards.
+type activity struct {
+	reads     int64
+	writes    int64
+	size      int64
+	evictions int64
+	memory    int64
+}
+
+func activityOf(ns *NabiaDB) activity {
+	da := &ns.internals.metrics.dataActivity
+	return activity{
+		reads:     atomic.LoadInt64(&da.reads),
+		writes:    atomic.LoadInt64(&da.writes),
+		size:      ns.records().size(),
+		evictions: atomic.LoadInt64(&da.evictions),
+		memory:    ns.records().memory(),
+	}
+}
+
 func TestCRUD(t *testing.T) { // Create, Read, Update, Destroy
 
-	var nabia_read NabiaRecord[string]
+	var nabia_read []byte
 	var expected []byte
-	expected_stats := dataActivity{reads: 0, writes: 0, size: 0}
+	expected_stats := activity{}
 
-	nabiaDB, err := NewNabiaDB("crud.db")
-	if err != nil {
-		t.Errorf("Failed to create NabiaDB: %s", err)
-	}
-	defer os.Remove("crud.db")
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
 
 	if nabiaDB.Exists("A") {
 		t.Error("Uninitialised database contains elements!")
 	}
 	atomic.AddInt64(&expected_stats.reads, 1)
 	//CREATE
-	s, err := NewNabiaRecord("Value_A")
-	if err != nil {
-		t.Errorf("error when creating a record")
-	}
-	nabiaDB.Write("A", *s)
-	atomic.AddInt64(&expected_stats.reads, 1)
+	s := []byte("Value_A")
+	nabiaDB.Write("A", s)
 	atomic.AddInt64(&expected_stats.writes, 1)
 	atomic.AddInt64(&expected_stats.size, 1)
+	atomic.AddInt64(&expected_stats.memory, int64(len("A")+len(s)))
 	if !nabiaDB.Exists("A") {
 		t.Error("Database is not writing items correctly!")
 	}
 	atomic.AddInt64(&expected_stats.reads, 1)
 	//READ
-	nabia_read, err = nabiaDB.Read("A")
+	nabia_read, err := nabiaDB.Read("A")
 	atomic.AddInt64(&expected_stats.reads, 1)
 	if err != nil {
 		t.Errorf("\"Read\" returns an unexpected error:\n%q", err.Error())
 	}
 	expected = []byte("Value_A")
-	for i, e := range nabia_read.RawData {
-		if e != expected[i] {
-			t.Errorf("\"Read\" returns unexpected data or ContentType!\nGot %q, expected %q", nabia_read, expected)
-		}
+	if !bytes.Equal(nabia_read, expected) {
+		t.Errorf("\"Read\" returns unexpected data!\nGot %q, expected %q", nabia_read, expected)
 	}
 	//UPDATE
-	s1 := NewNabiaRecord([]byte("Modified value"), "application/json; charset=UTF-8")
-	nabiaDB.Write("A", *s1)
-	atomic.AddInt64(&expected_stats.reads, 1)
+	s1 := []byte("Modified value")
+	nabiaDB.Write("A", s1)
 	atomic.AddInt64(&expected_stats.writes, 1)
+	atomic.AddInt64(&expected_stats.memory, int64(len(s1)-len(s)))
 	if !nabiaDB.Exists("A") {
 		t.Errorf("Overwritten item doesn't exist!")
 	}
@@ -137,70 +158,62 @@ func TestCRUD(t *testing.T) { // Create, Read, Update, Destroy
 	}
 	atomic.AddInt64(&expected_stats.reads, 1)
 	expected = []byte("Modified value")
-	expected_content_type = "application/json; charset=UTF-8"
-	for i, e := range nabia_read.RawData {
-		if e != expected[i] || nabia_read.ContentType != expected_content_type {
-			t.Errorf("\"Write\" on an existing item saves unexpected data or ContentType!\nGot %q, expected %q", nabia_read, expected)
-		}
+	if !bytes.Equal(nabia_read, expected) {
+		t.Errorf("\"Write\" on an existing item saves unexpected data!\nGot %q, expected %q", nabia_read, expected)
 	}
 	//DESTROY
 	if !nabiaDB.Exists("A") {
 		t.Error("Can't destroy item because it doesn't exist!")
 	}
 	atomic.AddInt64(&expected_stats.reads, 1)
-	nabiaDB.Destroy("A")
-	atomic.AddInt64(&expected_stats.reads, 1)
+	nabiaDB.Delete("A")
 	atomic.AddInt64(&expected_stats.writes, 1)
 	atomic.AddInt64(&expected_stats.size, -1)
+	atomic.AddInt64(&expected_stats.memory, -int64(len("A")+len(s1)))
 	if nabiaDB.Exists("A") {
-		t.Error("\"Destroy\" isn't working!\nDeleted item still exists in DB.")
+		t.Error("\"Delete\" isn't working!\nDeleted item still exists in DB.")
 	}
 	atomic.AddInt64(&expected_stats.reads, 1)
 
-	// Test for unknown ContentType
-	s2, err := NewNabiaRecord([]byte("Unknown ContentType Value"))
-	if err := nabiaDB.Write("B", *s2); err != nil {
+	// Test for a second item
+	s2 := []byte("Second Value")
+	if err := nabiaDB.Write("B", s2); err != nil {
 		t.Errorf("\"Write\" returns an unexpected error:\n%q", err.Error())
 	}
-	atomic.AddInt64(&expected_stats.reads, 1)
 	atomic.AddInt64(&expected_stats.writes, 1)
 	atomic.AddInt64(&expected_stats.size, 1)
-	nabia_read, err = nabiaDB.Read("B")
+	atomic.AddInt64(&expected_stats.memory, int64(len("B")+len(s2)))
+	_, err = nabiaDB.Read("B")
 	if err != nil {
 		t.Errorf("\"Read\" returns an unexpected error:\n%q", err.Error())
 	}
 	atomic.AddInt64(&expected_stats.reads, 1)
 
 	// Test for non-existent item
-	nabiaDB.Destroy("C")
-	atomic.AddInt64(&expected_stats.reads, 1)
+	nabiaDB.Delete("C")
 	atomic.AddInt64(&expected_stats.writes, 1)
 	if nabiaDB.Exists("C") {
-		t.Error("\"Destroy\" isn't working!\nNon-existent item appears to exist in DB.")
+		t.Error("\"Delete\" isn't working!\nNon-existent item appears to exist in DB.")
 	}
 	atomic.AddInt64(&expected_stats.reads, 1)
 
 	// Test for incorrect key
-	incorrect_key := nabiaDB.Write("", *s) // This should not be allowed
-	if !strings.Contains(incorrect_key.Error(), "key cannot be empty") {
+	incorrect_key := nabiaDB.Write("", s) // This should not be allowed
+	if !errors.Is(incorrect_key, ErrKeyEmpty) {
 		t.Error("Empty key should not be allowed")
 	}
 
 	// Test for incorrect values
-	incorrect_value1 := nabiaDB.Write("/A", NabiaRecord{}) // This should not be allowed
-	if !strings.Contains(incorrect_value1.Error(), "value cannot be nil") {
-		t.Error("Empty NabiaRecord should not be allowed")
-	}
-	incorrect_value2 := nabiaDB.Write("/A", NabiaRecord{nil, "application/json; charset=UTF-8"}) // This should not be allowed
-	if !strings.Contains(incorrect_value2.Error(), "value cannot be nil") {
-		t.Error("nil NabiaRecord RawData should not be allowed")
+	incorrect_value1 := nabiaDB.Write("/A", []byte{}) // This should not be allowed
+	if !errors.Is(incorrect_value1, ErrValueEmpty) {
+		t.Error("Empty value should not be allowed")
 	}
-	incorrect_value3 := nabiaDB.Write("/A", NabiaRecord{[]byte("Value_A"), ""}) // This should not be allowed
-	if !strings.Contains(incorrect_value3.Error(), "Content-Type cannot be empty") {
-		t.Error("Empty NabiaRecord ContentType should not be allowed")
+	incorrect_value2 := nabiaDB.Write("/A", nil) // This should not be allowed
+	if !errors.Is(incorrect_value2, ErrValueNil) {
+		t.Error("nil value should not be allowed")
 	}
-	if !reflect.DeepEqual(nabiaDB.internals.metrics.dataActivity, expected_stats) {
-		t.Errorf("Stats are not as expected.\nExpected: %+v\nGot: %+v", expected_stats, nabiaDB.internals.metrics.dataActivity)
+	if got := activityOf(nabiaDB); got != expected_stats {
+		t.Errorf("Stats are not as expected.\nExpected: %+v\nGot: %+v", expected_stats, got)
 	}
 
 	// TODO move this to a separate function
@@ -208,83 +221,1475 @@ func TestCRUD(t *testing.T) { // Create, Read, Update, Destroy
 }
 
 func TestConcurrency(t *testing.T) {
-	expected_stats := dataActivity{reads: 0, writes: 0, size: 0}
-	nabiaDB, err := NewNabiaDB("concurrency.db")
-	if err != nil {
-		t.Errorf("Failed to create NabiaDB: %s", err)
-	}
-	defer os.Remove("concurrency.db")
-	// Concurrency test with Destroy operation
+	expected_stats := activity{}
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	// Concurrency test with Delete operation
 	var wg sync.WaitGroup
 	for i := 0; i < 1000000; i++ {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
 			key := fmt.Sprintf("Key_%d", i)
-			value, err := NewNabiaRecord([]byte(fmt.Sprintf("Value_%d", i)))
-			if err != nil {
-				t.Errorf("error creating a random record")
-			}
+			value := []byte(fmt.Sprintf("Value_%d", i))
 			operation := rand.Intn(3)
 			switch operation {
 			case 0:
-				// Destroy before writing
-				nabiaDB.Destroy(key)
-				atomic.AddInt64(&expected_stats.reads, 1)
+				// Delete before writing
+				nabiaDB.Delete(key)
 				atomic.AddInt64(&expected_stats.writes, 1)
 				if nabiaDB.Exists(key) {
-					t.Errorf("Destroy operation failed before writing for key: %s", key)
+					t.Errorf("Delete operation failed before writing for key: %s", key)
 				}
 				atomic.AddInt64(&expected_stats.reads, 1)
-				nabiaDB.Write(key, *value)
-				atomic.AddInt64(&expected_stats.reads, 1)
+				nabiaDB.Write(key, value)
 				atomic.AddInt64(&expected_stats.size, 1)
 				atomic.AddInt64(&expected_stats.writes, 1)
+				atomic.AddInt64(&expected_stats.memory, int64(len(key)+len(value)))
 			case 1:
-				// Destroy after writing and verifying the value
-				nabiaDB.Write(key, *value)
-				atomic.AddInt64(&expected_stats.reads, 1)
+				// Delete after writing and verifying the value
+				nabiaDB.Write(key, value)
 				atomic.AddInt64(&expected_stats.writes, 1)
 				atomic.AddInt64(&expected_stats.size, 1)
 				readValue, err := nabiaDB.Read(key)
-				if err != nil || !bytes.Equal(readValue.RawData, value.RawData) || readValue.ContentType != value.ContentType {
+				if err != nil || !bytes.Equal(readValue, value) {
 					t.Errorf("Write or Read operation failed for key: %s", key)
 				}
 				atomic.AddInt64(&expected_stats.reads, 1)
-				nabiaDB.Destroy(key)
-				atomic.AddInt64(&expected_stats.reads, 1)
+				nabiaDB.Delete(key)
 				atomic.AddInt64(&expected_stats.writes, 1)
 				atomic.AddInt64(&expected_stats.size, -1)
 				if nabiaDB.Exists(key) {
-					t.Errorf("Destroy operation failed after writing for key: %s", key)
+					t.Errorf("Delete operation failed after writing for key: %s", key)
 				}
 				atomic.AddInt64(&expected_stats.reads, 1)
 			case 2:
 				// Overwrite and check value again after checking value with first write
-				nabiaDB.Write(key, *value) // first write
-				atomic.AddInt64(&expected_stats.reads, 1)
+				nabiaDB.Write(key, value) // first write
 				atomic.AddInt64(&expected_stats.writes, 1)
 				atomic.AddInt64(&expected_stats.size, 1)
 				readValue, err := nabiaDB.Read(key)
 				atomic.AddInt64(&expected_stats.reads, 1)
-				if err != nil || !bytes.Equal(readValue.RawData, value.RawData) || readValue.ContentType != value.ContentType {
+				if err != nil || !bytes.Equal(readValue, value) {
 					t.Errorf("First Write or Read operation failed for key: %s", key)
 				}
-				value2 := NewNabiaRecord([]byte(fmt.Sprintf("New_Value_%d", i)), "application/json; charset=UTF-8")
-				nabiaDB.Write(key, *value2) // overwrite
-				atomic.AddInt64(&expected_stats.reads, 1)
+				value2 := []byte(fmt.Sprintf("New_Value_%d", i))
+				nabiaDB.Write(key, value2) // overwrite
 				atomic.AddInt64(&expected_stats.writes, 1)
+				atomic.AddInt64(&expected_stats.memory, int64(len(key)+len(value2)))
 				readValue2, err := nabiaDB.Read(key)
 				atomic.AddInt64(&expected_stats.reads, 1)
-				if err != nil || !bytes.Equal(readValue2.RawData, value2.RawData) || readValue2.ContentType != value2.ContentType {
+				if err != nil || !bytes.Equal(readValue2, value2) {
 					t.Errorf("Second Write or Read operation failed for key: %s", key)
 				}
 			}
 		}(i)
 	}
 	wg.Wait()
-	if !reflect.DeepEqual(nabiaDB.internals.metrics.dataActivity, expected_stats) {
-		t.Errorf("Stats are not as expected.\nExpected: %+v\nGot: %+v", expected_stats, nabiaDB.internals.metrics.dataActivity)
+	if got := activityOf(nabiaDB); got != expected_stats {
+		t.Errorf("Stats are not as expected.\nExpected: %+v\nGot: %+v", expected_stats, got)
+	}
+
+}
+
+func TestTTL(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	if err := nabiaDB.WriteWithTTL("A", []byte("Value_A"), 0); err == nil {
+		t.Error("A non-positive TTL should not be allowed")
+	}
+	if err := nabiaDB.WriteWithTTL("A", []byte("Value_A"), 50*time.Millisecond); err != nil {
+		t.Fatalf("\"WriteWithTTL\" returns an unexpected error:\n%q", err.Error())
+	}
+	if err := nabiaDB.Write("B", []byte("Value_B")); err != nil {
+		t.Fatalf("\"Write\" returns an unexpected error:\n%q", err.Error())
+	}
+	if value, err := nabiaDB.Read("A"); err != nil || !bytes.Equal(value, []byte("Value_A")) {
+		t.Errorf("Key with a TTL can't be read before expiring")
+	}
+	if _, expiresAt, err := nabiaDB.ReadWithExpiry("A"); err != nil || time.Until(expiresAt) <= 0 || time.Until(expiresAt) > 50*time.Millisecond {
+		t.Errorf("Unexpected expiry of a key with a TTL: %v (%v)", expiresAt, err)
+	}
+	if _, expiresAt, err := nabiaDB.ReadWithExpiry("B"); err != nil || !expiresAt.IsZero() {
+		t.Errorf("Unexpected expiry of a key without a TTL: %v (%v)", expiresAt, err)
+	}
+	if size := nabiaDB.records().size(); size != 2 {
+		t.Errorf("Unexpected size before expiry: got %d, expected 2", size)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := nabiaDB.Read("A"); err == nil {
+		t.Error("Expired key can still be read")
+	}
+	if _, _, err := nabiaDB.ReadWithExpiry("A"); err == nil {
+		t.Error("Expired key can still be read with its expiry")
+	}
+	if nabiaDB.Exists("A") {
+		t.Error("Expired key still exists")
+	}
+	if _, ok := nabiaDB.records().Load("A"); ok {
+		t.Error("Expired key wasn't lazily deleted")
+	}
+	if !nabiaDB.Exists("B") {
+		t.Error("Key without a TTL expired")
+	}
+	if size := nabiaDB.records().size(); size != 1 {
+		t.Errorf("Unexpected size after expiry: got %d, expected 1", size)
+	}
+
+	// Overwriting a key with Write removes its TTL
+	nabiaDB.WriteWithTTL("C", []byte("Value_C"), 50*time.Millisecond)
+	nabiaDB.Write("C", []byte("Value_C"))
+	time.Sleep(100 * time.Millisecond)
+	if !nabiaDB.Exists("C") {
+		t.Error("Overwritten key kept its TTL")
+	}
+}
+
+func TestTTLSweeper(t *testing.T) {
+	nabiaDB := newEmptyDB()
+	nabiaDB.startSweeper(10 * time.Millisecond)
+	defer close(nabiaDB.internals.stop)
+
+	for i := 0; i < 100; i++ {
+		nabiaDB.WriteWithTTL(fmt.Sprintf("Key_%d", i), []byte("Value"), 20*time.Millisecond)
+	}
+	nabiaDB.Write("Persistent", []byte("Value"))
+
+	time.Sleep(100 * time.Millisecond)
+	remaining := 0
+	nabiaDB.records().Range(func(key, value interface{}) bool {
+		remaining++
+		return true
+	})
+	if remaining != 1 { // Only counting what's physically in the map, without calling Read
+		t.Errorf("Sweeper didn't reclaim expired keys: %d keys remain, expected 1", remaining)
+	}
+	if size := nabiaDB.records().size(); size != 1 {
+		t.Errorf("Unexpected size after sweeping: got %d, expected 1", size)
+	}
+}
+
+func TestTTLPersistence(t *testing.T) {
+	location := "ttlpersistence.db"
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	defer os.Remove(location)
+
+	nabiaDB.WriteWithTTL("Short", []byte("Value"), 50*time.Millisecond)
+	nabiaDB.WriteWithTTL("Long", []byte("Value"), time.Hour)
+	nabiaDB.Write("Forever", []byte("Value"))
+	e, _ := nabiaDB.load("Long")
+	expiresAt := e.expiresAt
+	if err := nabiaDB.saveToFile(location); err != nil {
+		t.Fatalf("failed to save NabiaDB to file: %s", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	loaded, err := loadFromFile(location, "")
+	if err != nil {
+		t.Fatalf("failed to load NabiaDB from file: %s", err)
+	}
+	if loaded.Exists("Short") {
+		t.Error("Key which expired while saved on disk was loaded")
+	}
+	if e, ok := loaded.load("Long"); !ok || !e.expiresAt.Equal(expiresAt) {
+		t.Error("Remaining TTL wasn't preserved when saving to disk")
+	}
+	if e, ok := loaded.load("Forever"); !ok || !e.expiresAt.IsZero() {
+		t.Error("Key without a TTL was given one when saving to disk")
+	}
+	if size := loaded.records().size(); size != 2 {
+		t.Errorf("Unexpected size after loading: got %d, expected 2", size)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	if swapped, err := nabiaDB.CompareAndSwap("A", nil, []byte("Value_A")); swapped || err != nil {
+		t.Error("\"CompareAndSwap\" on a missing key should neither swap nor fail")
+	}
+	if _, err := nabiaDB.CompareAndSwap("", []byte("old"), []byte("new")); err == nil {
+		t.Error("Empty key should not be allowed")
+	}
+	if _, err := nabiaDB.CompareAndSwap("A", []byte("old"), []byte{}); err == nil {
+		t.Error("Empty value should not be allowed")
+	}
+	nabiaDB.Write("A", []byte("Value_A"))
+	before := activityOf(nabiaDB)
+	if swapped, err := nabiaDB.CompareAndSwap("A", []byte("Wrong"), []byte("Value_B")); swapped || err != nil {
+		t.Error("\"CompareAndSwap\" swapped a value which didn't match")
+	}
+	if got := activityOf(nabiaDB); got != before {
+		t.Errorf("Failed swap changed the stats.\nExpected: %+v\nGot: %+v", before, got)
+	}
+	if swapped, err := nabiaDB.CompareAndSwap("A", []byte("Value_A"), []byte("Value_B")); !swapped || err != nil {
+		t.Error("\"CompareAndSwap\" didn't swap a matching value")
+	}
+	expected_stats := before
+	expected_stats.reads++
+	expected_stats.writes++
+	if got := activityOf(nabiaDB); got != expected_stats {
+		t.Errorf("Stats are not as expected.\nExpected: %+v\nGot: %+v", expected_stats, got)
+	}
+	if value, _ := nabiaDB.Read("A"); !bytes.Equal(value, []byte("Value_B")) {
+		t.Errorf("Unexpected value after swapping: got %q, expected %q", value, "Value_B")
+	}
+}
+
+func TestCompareAndSwapConcurrency(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	nabiaDB.Write("Counter", []byte("0"))
+
+	// Every goroutine increments the counter once, retrying until its swap wins
+	goroutines := 1000
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				old, err := nabiaDB.Read("Counter")
+				if err != nil {
+					t.Errorf("\"Read\" returns an unexpected error:\n%q", err.Error())
+					return
+				}
+				n, _ := strconv.Atoi(string(old))
+				swapped, err := nabiaDB.CompareAndSwap("Counter", old, []byte(strconv.Itoa(n+1)))
+				if err != nil {
+					t.Errorf("\"CompareAndSwap\" returns an unexpected error:\n%q", err.Error())
+					return
+				}
+				if swapped {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	value, _ := nabiaDB.Read("Counter")
+	if string(value) != strconv.Itoa(goroutines) {
+		t.Errorf("Lost updates under contention: got %s, expected %d", value, goroutines)
+	}
+	if writes := nabiaDB.internals.metrics.dataActivity.writes; writes != int64(goroutines)+1 {
+		t.Errorf("Only successful swaps should count as writes: got %d, expected %d", writes, goroutines+1)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	expected := int64(0)
+	check := func(operation string) {
+		t.Helper()
+		if got := nabiaDB.Sequence(); got != expected {
+			t.Errorf("Unexpected sequence after %s: got %d, expected %d", operation, got, expected)
+		}
+		if got := nabiaDB.Stats().Sequence; got != expected {
+			t.Errorf("Unexpected sequence in Stats after %s: got %d, expected %d", operation, got, expected)
+		}
+	}
+	check("creation")
+	nabiaDB.Write("A", []byte("Value_A"))
+	expected++
+	check("Write")
+	nabiaDB.WriteWithTTL("B", []byte("Value_B"), time.Hour)
+	expected++
+	check("WriteWithTTL")
+	nabiaDB.CompareAndSwap("A", []byte("Value_A"), []byte("Value_A2"))
+	expected++
+	check("a successful CompareAndSwap")
+	nabiaDB.CompareAndSwap("A", []byte("Value_A"), []byte("Value_A3"))
+	check("a failed CompareAndSwap")
+	nabiaDB.Delete("A")
+	expected++
+	check("Delete")
+	nabiaDB.Read("B")
+	nabiaDB.Exists("B")
+	nabiaDB.Write("", []byte("Value"))
+	check("reads and invalid writes")
+}
+
+func TestIncrement(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	table := []struct {
+		delta    int64
+		expected int64
+	}{
+		{5, 5}, // missing keys start from zero
+		{-7, -2},
+		{2, 0},
+		{math.MaxInt64, math.MaxInt64},
+		{1, math.MinInt64}, // wraparound
+		{-1, math.MaxInt64},
 	}
+	for _, row := range table {
+		got, err := nabiaDB.Increment("Counter", row.delta)
+		if err != nil {
+			t.Fatalf("\"Increment\" returns an unexpected error:\n%q", err.Error())
+		}
+		if got != row.expected {
+			t.Errorf("Unexpected result when incrementing by %d: got %d, expected %d", row.delta, got, row.expected)
+		}
+		if value, _ := nabiaDB.Read("Counter"); string(value) != strconv.FormatInt(row.expected, 10) {
+			t.Errorf("Unexpected stored value: got %q, expected %d", value, row.expected)
+		}
+	}
+	if size := nabiaDB.records().size(); size != 1 {
+		t.Errorf("Unexpected size: got %d, expected 1", size)
+	}
+
+	// Non-numeric values are left untouched
+	for _, value := range []string{"abc", "12a", " 1", "1.5", "99999999999999999999"} {
+		nabiaDB.Write("NaN", []byte(value))
+		if _, err := nabiaDB.Increment("NaN", 1); err == nil {
+			t.Errorf("Incrementing the non-numeric value %q should fail", value)
+		}
+		if got, _ := nabiaDB.Read("NaN"); string(got) != value {
+			t.Errorf("Failed increment modified the value: got %q, expected %q", got, value)
+		}
+	}
+	if _, err := nabiaDB.Increment("", 1); err == nil {
+		t.Error("Empty key should not be allowed")
+	}
+}
+
+func TestIncrementConcurrency(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	goroutines := 1000
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := nabiaDB.Increment("Counter", int64(i)); err != nil {
+				t.Errorf("\"Increment\" returns an unexpected error:\n%q", err.Error())
+			}
+		}(i)
+	}
+	wg.Wait()
+	expected := strconv.Itoa(goroutines * (goroutines - 1) / 2)
+	if value, _ := nabiaDB.Read("Counter"); string(value) != expected {
+		t.Errorf("Lost increments under contention: got %s, expected %s", value, expected)
+	}
+	if size := nabiaDB.records().size(); size != 1 {
+		t.Errorf("Unexpected size: got %d, expected 1", size)
+	}
+}
+
+func TestWriteIfAbsent(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	if written, err := nabiaDB.WriteIfAbsent("A", []byte("Value_A")); !written || err != nil {
+		t.Error("\"WriteIfAbsent\" didn't write a missing key")
+	}
+	if written, err := nabiaDB.WriteIfAbsent("A", []byte("Value_B")); written || err != nil {
+		t.Error("\"WriteIfAbsent\" overwrote an existing key")
+	}
+	if value, _ := nabiaDB.Read("A"); !bytes.Equal(value, []byte("Value_A")) {
+		t.Errorf("Unexpected value: got %q, expected %q", value, "Value_A")
+	}
+	nabiaDB.WriteWithTTL("B", []byte("Value_B"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if written, err := nabiaDB.WriteIfAbsent("B", []byte("Value_B2")); !written || err != nil {
+		t.Error("\"WriteIfAbsent\" didn't write over an expired key")
+	}
+	if _, err := nabiaDB.WriteIfAbsent("", []byte("Value")); err == nil {
+		t.Error("Empty key should not be allowed")
+	}
+	if _, err := nabiaDB.WriteIfAbsent("C", nil); err == nil {
+		t.Error("Empty value should not be allowed")
+	}
+	if size := nabiaDB.records().size(); size != 2 {
+		t.Errorf("Unexpected size: got %d, expected 2", size)
+	}
+
+	// Only one of many concurrent writers can win
+	var wins int64
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if written, _ := nabiaDB.WriteIfAbsent("Contended", []byte(strconv.Itoa(i))); written {
+				atomic.AddInt64(&wins, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Errorf("Unexpected number of successful concurrent writes: got %d, expected 1", wins)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	appendX := func(current []byte) ([]byte, error) {
+		return append(bytes.Clone(current), 'x'), nil
+	}
+	if err := nabiaDB.Update("Missing", appendX); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Unexpected error when updating a missing key: %v", err)
+	}
+	nabiaDB.WriteWithTTL("A", []byte("Value"), time.Hour)
+	e, _ := nabiaDB.load("A")
+	if err := nabiaDB.Update("A", appendX); err != nil {
+		t.Fatalf("\"Update\" returns an unexpected error:\n%q", err.Error())
+	}
+	if value, _ := nabiaDB.Read("A"); string(value) != "Valuex" {
+		t.Errorf("Unexpected value: got %q, expected %q", value, "Valuex")
+	}
+	if updated, _ := nabiaDB.load("A"); !updated.expiresAt.Equal(e.expiresAt) {
+		t.Error("\"Update\" didn't keep the TTL")
+	}
+	failure := errors.New("failure")
+	if err := nabiaDB.Update("A", func([]byte) ([]byte, error) { return nil, failure }); err != failure {
+		t.Errorf("Error of the update function wasn't returned: %v", err)
+	}
+	if value, _ := nabiaDB.Read("A"); string(value) != "Valuex" {
+		t.Errorf("Failed update modified the value: got %q", value)
+	}
+
+	nabiaDB.Write("Counter", []byte("0"))
+	goroutines := 1000
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nabiaDB.Update("Counter", func(current []byte) ([]byte, error) {
+				n, _ := strconv.Atoi(string(current))
+				return []byte(strconv.Itoa(n + 1)), nil
+			})
+		}()
+	}
+	wg.Wait()
+	if value, _ := nabiaDB.Read("Counter"); string(value) != strconv.Itoa(goroutines) {
+		t.Errorf("Lost updates under contention: got %s, expected %d", value, goroutines)
+	}
+}
+
+func TestPing(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Failed to create the data directory: %s", err)
+	}
+	nabiaDB, err := NewNabiaDB(filepath.Join(dir, "ping.db"))
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	if err := nabiaDB.Ping(); err != nil {
+		t.Errorf("\"Ping\" returns an unexpected error:\n%q", err.Error())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("\"Ping\" left %d files behind", len(entries))
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("Failed to remove the data directory: %s", err)
+	}
+	if err := nabiaDB.Ping(); err == nil {
+		t.Error("\"Ping\" succeeded although the location's directory was removed")
+	}
+}
+
+func TestStop(t *testing.T) {
+	dir := t.TempDir()
+	nabiaDB, err := NewNabiaDB(filepath.Join(dir, "stop.db"))
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	var saves atomic.Int32
+	nabiaDB.internals.syncSnapshot = func(s syncer) error {
+		saves.Add(1)
+		return nil
+	}
+	nabiaDB.Write("A", []byte("Value_A"))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := nabiaDB.Stop(); err != nil {
+				t.Errorf("Failed to stop: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := nabiaDB.Stop(); err != nil {
+		t.Errorf("Failed to stop again: %s", err)
+	}
+	if n := saves.Load(); n != 1 {
+		t.Errorf("Stopping saved %d times, expected once", n)
+	}
+
+	// Every call returns the error of the final save
+	failing, err := NewNabiaDB(filepath.Join(dir, "missing", "stop.db"))
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	first, second := failing.Stop(), failing.Stop()
+	if first == nil || first != second {
+		t.Errorf("Unexpected errors stopping twice: %v and %v", first, second)
+	}
+}
+
+func TestIOConcurrency(t *testing.T) {
+	if err := newEmptyDB().SetIOConcurrency(0); err == nil {
+		t.Error("\"SetIOConcurrency\" accepted a limit of 0")
+	}
+	for _, limit := range []int{1, 2, 4} {
+		nabiaDB, err := NewNabiaDB(filepath.Join(t.TempDir(), "io.db"))
+		if err != nil {
+			t.Fatalf("Failed to create NabiaDB: %s", err)
+		}
+		if err := nabiaDB.SetIOConcurrency(limit); err != nil {
+			t.Fatalf("\"SetIOConcurrency\" returns an unexpected error:\n%q", err.Error())
+		}
+		nabiaDB.Write("A", []byte("Value_A"))
+
+		// Every save syncs its snapshot, which is where the concurrency is
+		// observed
+		var active, highest int64
+		nabiaDB.internals.syncSnapshot = func(s syncer) error {
+			n := atomic.AddInt64(&active, 1)
+			for {
+				h := atomic.LoadInt64(&highest)
+				if n <= h || atomic.CompareAndSwapInt64(&highest, h, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt64(&active, -1)
+			return s.Sync()
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 4*limit; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := nabiaDB.Save(); err != nil {
+					t.Errorf("\"Save\" returns an unexpected error:\n%q", err.Error())
+				}
+			}()
+		}
+		wg.Wait()
+		if highest != int64(limit) {
+			t.Errorf("Unexpected number of concurrent saves: got %d, expected %d", highest, limit)
+		}
+		loaded, err := loadFromFile(nabiaDB.internals.location, "")
+		if err != nil {
+			t.Fatalf("failed to load NabiaDB from file: %s", err)
+		}
+		if value, _ := loaded.Read("A"); !bytes.Equal(value, []byte("Value_A")) {
+			t.Errorf("Concurrent saves corrupted the snapshot: got %q", value)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	for _, key := range []string{"/foo/b", "/foo/a", "/foobar", "/bar"} {
+		nabiaDB.Write(key, []byte("Value"+key))
+	}
+	nabiaDB.WriteWithTTL("/foo/expired", []byte("Value"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	table := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"", []string{"/bar", "/foo/a", "/foo/b", "/foobar"}},
+		{"/foo", []string{"/foo/a", "/foo/b", "/foobar"}},
+		{"/foo/", []string{"/foo/a", "/foo/b"}},
+		{"/missing", []string{}},
+	}
+	for _, row := range table {
+		if keys := nabiaDB.Keys(row.prefix); !reflect.DeepEqual(keys, row.expected) {
+			t.Errorf("Unexpected keys for prefix %q: got %q, expected %q", row.prefix, keys, row.expected)
+		}
+	}
+	values := nabiaDB.ReadPrefix("/foo/")
+	if len(values) != 2 || string(values["/foo/a"]) != "Value/foo/a" || string(values["/foo/b"]) != "Value/foo/b" {
+		t.Errorf("Unexpected values for prefix \"/foo/\": got %q", values)
+	}
+}
+
+// countdownContext is canceled once its error has been checked n times, so
+// that scans can be canceled at a given point.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (cc *countdownContext) Err() error {
+	if cc.n--; cc.n < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestContextCancellation(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	for i := 0; i < 1000; i++ {
+		nabiaDB.Write(fmt.Sprintf("/key/%d", i), []byte("Value"))
+	}
+
+	// Scans stop as soon as the context is canceled
+	ctx := &countdownContext{Context: context.Background(), n: 10}
+	if values, err := nabiaDB.ReadPrefixContext(ctx, "/key/"); !errors.Is(err, context.Canceled) || values != nil {
+		t.Errorf("Unexpected result of a canceled ReadPrefixContext: %d values (%v)", len(values), err)
+	}
+	if ctx.n != -1 {
+		t.Errorf("The scan went on after the context was canceled: %d checks left", ctx.n)
+	}
+	ctx = &countdownContext{Context: context.Background(), n: 10}
+	if keys, err := nabiaDB.KeysContext(ctx, ""); !errors.Is(err, context.Canceled) || keys != nil {
+		t.Errorf("Unexpected result of a canceled KeysContext: %d keys (%v)", len(keys), err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	converted := 0
+	err := nabiaDB.ExportJSONContext(canceled, io.Discard, func(record *ExportedRecord) error {
+		if converted++; converted == 10 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || converted != 10 {
+		t.Errorf("Unexpected result of a canceled export: %d records converted (%v)", converted, err)
+	}
+
+	// A live context changes nothing
+	if keys, err := nabiaDB.KeysContext(context.Background(), "/key/1"); err != nil || len(keys) != 111 {
+		t.Errorf("Unexpected keys: got %d (%v), expected 111", len(keys), err)
+	}
+}
+
+func TestValueIsolation(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	// Values written are copied, whichever way they were written
+	value := []byte("Value")
+	nabiaDB.Write("write", value)
+	nabiaDB.WriteIfAbsent("absent", value)
+	nabiaDB.Write("swap", []byte("Old"))
+	nabiaDB.CompareAndSwap("swap", []byte("Old"), value)
+	nabiaDB.Write("update", []byte("Old"))
+	nabiaDB.Update("update", func(current []byte) ([]byte, error) { return value, nil })
+	copy(value, "XXXXX")
+	for _, key := range []string{"write", "absent", "swap", "update"} {
+		if data, _ := nabiaDB.Read(key); string(data) != "Value" {
+			t.Errorf("Modifying the value written changed %q: got %q", key, data)
+		}
+	}
+
+	// ReadInto copies, and reports buffers too short
+	buffer := make([]byte, 8)
+	n, err := nabiaDB.ReadInto("write", buffer)
+	if err != nil || string(buffer[:n]) != "Value" {
+		t.Errorf("Unexpected ReadInto: %q (%v)", buffer[:n], err)
+	}
+	copy(buffer, "XXXXX")
+	if data, _ := nabiaDB.Read("write"); string(data) != "Value" {
+		t.Errorf("Modifying the buffer of ReadInto changed the value: got %q", data)
+	}
+	if n, err := nabiaDB.ReadInto("write", buffer[:2]); !errors.Is(err, io.ErrShortBuffer) || n != 5 {
+		t.Errorf("Unexpected ReadInto into a short buffer: %d (%v)", n, err)
+	}
+	if _, err := nabiaDB.ReadInto("missing", buffer); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { nabiaDB.ReadInto("write", buffer) }); allocs != 0 {
+		t.Errorf("ReadInto allocated %.0f times", allocs)
+	}
+}
+
+func TestMultiExists(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	nabiaDB.Write("A", []byte("Value_A"))
+	nabiaDB.Write("B", []byte("Value_B"))
+	nabiaDB.WriteWithTTL("C", []byte("Value_C"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	reads := nabiaDB.Stats().Reads
 
+	result := nabiaDB.MultiExists([]string{"A", "B", "C", "D", ""})
+	expected := map[string]bool{"A": true, "B": true, "C": false, "D": false, "": false}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected result: got %v, expected %v", result, expected)
+	}
+	if got := nabiaDB.Stats().Reads - reads; got != 5 {
+		t.Errorf("Unexpected number of reads: got %d, expected 5", got)
+	}
+}
+
+func TestMultiRead(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	nabiaDB.Write("A", []byte("Value_A"))
+	nabiaDB.Write("B", []byte("Value_B"))
+	nabiaDB.WriteWithTTL("C", []byte("Value_C"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	reads := nabiaDB.Stats().Reads
+
+	result := nabiaDB.MultiRead([]string{"A", "B", "C", "D", ""})
+	expected := map[string][]byte{"A": []byte("Value_A"), "B": []byte("Value_B")}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected result: got %q, expected %q", result, expected)
+	}
+	if got := nabiaDB.Stats().Reads - reads; got != 5 {
+		t.Errorf("Unexpected number of reads: got %d, expected 5", got)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	nabiaDB.WriteWithTTL("A", []byte("Value_A"), time.Hour)
+	nabiaDB.Write("B", []byte("Value_B"))
+	if err := nabiaDB.Copy("A", "C", false); err != nil {
+		t.Fatalf("Failed to copy: %s", err)
+	}
+	value, expiresAt, err := nabiaDB.ReadWithExpiry("C")
+	if err != nil || string(value) != "Value_A" || expiresAt.IsZero() {
+		t.Errorf("Unexpected copy: got %q expiring at %s, %v", value, expiresAt, err)
+	}
+	if size := nabiaDB.Stats().Size; size != 3 {
+		t.Errorf("Unexpected size: got %d, expected 3", size)
+	}
+
+	if err := nabiaDB.Copy("missing", "D", false); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if err := nabiaDB.Copy("A", "B", false); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	if value, _ := nabiaDB.Read("B"); string(value) != "Value_B" {
+		t.Errorf("A refused copy changed the destination: got %q", value)
+	}
+	if err := nabiaDB.Copy("A", "B", true); err != nil {
+		t.Errorf("Failed to copy over an existing key: %s", err)
+	}
+	if value, _ := nabiaDB.Read("B"); string(value) != "Value_A" || nabiaDB.Stats().Size != 3 {
+		t.Errorf("Unexpected value after an overwriting copy: got %q", value)
+	}
+	if err := nabiaDB.Copy("A", "", false); err == nil {
+		t.Error("Copied to the empty key")
+	}
+}
+
+func TestMove(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	nabiaDB.WriteWithTTL("A", []byte("Value_A"), time.Hour)
+	nabiaDB.Write("B", []byte("Value_B"))
+	if err := nabiaDB.Move("A", "C", false); err != nil {
+		t.Fatalf("Failed to move: %s", err)
+	}
+	value, expiresAt, err := nabiaDB.ReadWithExpiry("C")
+	if err != nil || string(value) != "Value_A" || expiresAt.IsZero() {
+		t.Errorf("Unexpected destination: got %q expiring at %s, %v", value, expiresAt, err)
+	}
+	if stats := nabiaDB.Stats(); nabiaDB.Exists("A") || stats.Size != 2 || stats.Memory != 16 {
+		t.Errorf("Unexpected state after a move: %q, size %d, memory %d", nabiaDB.Keys(""), stats.Size, stats.Memory)
+	}
+
+	if err := nabiaDB.Move("A", "D", false); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if err := nabiaDB.Move("C", "B", false); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	if !nabiaDB.Exists("C") || nabiaDB.Stats().Size != 2 {
+		t.Errorf("A refused move changed the keys: %q", nabiaDB.Keys(""))
+	}
+	if err := nabiaDB.Move("C", "B", true); err != nil {
+		t.Errorf("Failed to move onto an existing key: %s", err)
+	}
+	if value, _ := nabiaDB.Read("B"); string(value) != "Value_A" || nabiaDB.Exists("C") || nabiaDB.Stats().Size != 1 {
+		t.Errorf("Unexpected state after an overwriting move: %q holds %q", nabiaDB.Keys(""), value)
+	}
+
+	// Of concurrent moves of the same key, exactly one succeeds
+	var wg sync.WaitGroup
+	var moved atomic.Int64
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if nabiaDB.Move("B", fmt.Sprintf("B%d", i), false) == nil {
+				moved.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if keys := nabiaDB.Keys(""); moved.Load() != 1 || len(keys) != 1 || nabiaDB.Stats().Size != 1 {
+		t.Errorf("Unexpected keys after concurrent moves: %d moves succeeded, leaving %q", moved.Load(), keys)
+	}
+}
+
+func TestClone(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	nabiaDB.Write("A", []byte("Value_A"))
+	nabiaDB.WriteWithTTL("B", []byte("Value_B"), time.Hour)
+	nabiaDB.WriteWithTTL("C", []byte("Value_C"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	clone := nabiaDB.Clone()
+	nabiaDB.Write("A", []byte("Changed"))
+	nabiaDB.Delete("B")
+	nabiaDB.Write("D", []byte("Value_D"))
+	original, _ := nabiaDB.Read("A")
+	original[0] = 'X' // the returned bytes are the stored ones
+
+	if data, err := clone.Read("A"); err != nil || string(data) != "Value_A" {
+		t.Errorf("Clone saw a change of the original: got %q (%v)", data, err)
+	}
+	if _, expiresAt, err := clone.ReadWithExpiry("B"); err != nil || expiresAt.IsZero() {
+		t.Errorf("Clone lost a key with a TTL: %v", err)
+	}
+	if clone.Exists("C") || clone.Exists("D") {
+		t.Error("Clone holds a key which was expired or written after cloning")
+	}
+	if size := clone.Stats().Size; size != 2 {
+		t.Errorf("Unexpected size of the clone: got %d, expected 2", size)
+	}
+
+	clone.Write("B", []byte("Cloned"))
+	if nabiaDB.Exists("B") {
+		t.Error("Original saw a write to the clone")
+	}
+	cloned, _ := nabiaDB.Clone().Read("D")
+	cloned[0] = 'X'
+	if data, _ := nabiaDB.Read("D"); string(data) != "Value_D" {
+		t.Errorf("Clone shares its values with the original: got %q", data)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "timestamps.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	before := time.Now()
+	nabiaDB.Write("A", []byte("Value_A"))
+	created, err := nabiaDB.ReadRecord("A")
+	if err != nil {
+		t.Fatalf("Failed to read record: %s", err)
+	}
+	if created.CreatedAt.Before(before) || !created.ModifiedAt.Equal(created.CreatedAt) {
+		t.Errorf("Unexpected timestamps of a new key: %+v", created)
+	}
+
+	steps := []struct {
+		name  string
+		write func()
+	}{
+		{"overwrite", func() { nabiaDB.Write("A", []byte("Overwritten")) }},
+		{"swap", func() { nabiaDB.CompareAndSwap("A", []byte("Overwritten"), []byte("Swapped")) }},
+		{"update", func() {
+			nabiaDB.Update("A", func(current []byte) ([]byte, error) { return []byte("Updated"), nil })
+		}},
+	}
+	last := created.ModifiedAt
+	for _, step := range steps {
+		time.Sleep(time.Millisecond)
+		step.write()
+		record, _ := nabiaDB.ReadRecord("A")
+		if !record.CreatedAt.Equal(created.CreatedAt) {
+			t.Errorf("%s changed the creation time: got %s, expected %s", step.name, record.CreatedAt, created.CreatedAt)
+		}
+		if !record.ModifiedAt.After(last) {
+			t.Errorf("%s didn't advance the modification time: got %s, previously %s", step.name, record.ModifiedAt, last)
+		}
+		last = record.ModifiedAt
+	}
+
+	if err := nabiaDB.saveToFile(location); err != nil {
+		t.Fatalf("failed to save NabiaDB to file: %s", err)
+	}
+	loaded, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("failed to load NabiaDB from file: %s", err)
+	}
+	if record, _ := loaded.ReadRecord("A"); !record.CreatedAt.Equal(created.CreatedAt) || !record.ModifiedAt.Equal(last) {
+		t.Errorf("Timestamps weren't persisted: %+v", record)
+	}
+
+	// Files saved before timestamps were recorded default to the load time
+	legacy := filepath.Join(t.TempDir(), "legacy.db")
+	file, err := os.Create(legacy)
+	if err != nil {
+		t.Fatalf("Failed to create file: %s", err)
+	}
+	type legacyRecord struct {
+		RawData   []byte
+		ExpiresAt time.Time
+	}
+	gob.NewEncoder(file).Encode(map[string]legacyRecord{"A": {RawData: []byte("Value_A")}})
+	file.Close()
+	before = time.Now()
+	loaded, err = NabiaDBFromFile(legacy)
+	if err != nil {
+		t.Fatalf("failed to load legacy file: %s", err)
+	}
+	if record, err := loaded.ReadRecord("A"); err != nil || record.CreatedAt.Before(before) || record.ModifiedAt.Before(before) {
+		t.Errorf("Unexpected timestamps of a legacy record: %+v (%v)", record, err)
+	}
+}
+
+func TestSnapshotVersions(t *testing.T) {
+	dir := t.TempDir()
+	location := filepath.Join(dir, "current.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	nabiaDB.Write("A", []byte("Value_A"))
+	if err := nabiaDB.Stop(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+	saved, _ := os.ReadFile(location)
+	if !bytes.HasPrefix(saved, append([]byte(snapshotMagic), snapshotVersion)) {
+		t.Errorf("The snapshot doesn't start with its header: %q", saved[:min(len(saved), 16)])
+	}
+
+	// A gob snapshot of version 1 written by an older NabiaRecord, as if a
+	// field was added since, loads with the zero value of that field
+	type olderRecord struct {
+		RawData   []byte
+		CreatedAt time.Time
+	}
+	snapshot := func(version byte, header bool) string {
+		var buffer bytes.Buffer
+		if header {
+			buffer.WriteString(snapshotMagic)
+			buffer.WriteByte(version)
+		}
+		created := time.Date(2024, 2, 9, 21, 5, 23, 0, time.UTC)
+		gob.NewEncoder(&buffer).Encode(map[string]olderRecord{"A": {RawData: []byte("Value_A"), CreatedAt: created}})
+		location := filepath.Join(dir, fmt.Sprintf("version-%d-%t.db", version, header))
+		os.WriteFile(location, buffer.Bytes(), 0600)
+		return location
+	}
+	for _, location := range []string{snapshot(1, true), snapshot(0, false)} {
+		loaded, err := NabiaDBFromFile(location)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %s", location, err)
+		}
+		record, err := loaded.ReadRecord("A")
+		if err != nil || string(record.RawData) != "Value_A" || !record.ExpiresAt.IsZero() ||
+			record.CreatedAt.Year() != 2024 || record.ModifiedAt.IsZero() {
+			t.Errorf("Unexpected record loaded from %s: %+v (%v)", location, record, err)
+		}
+		loaded.Stop()
+	}
+
+	// Snapshots of a newer version are refused rather than misread
+	if _, err := NabiaDBFromFile(snapshot(snapshotVersion+1, true)); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Unexpected error loading a newer snapshot: %v", err)
+	}
+}
+
+func TestSnapshotConsistency(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "consistency.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	// Each writer adds numbered keys in order, and records the last one it
+	// committed. A snapshot holding a record must hold every key before it.
+	// Writers stop after a while, so the map can't outgrow the saves.
+	const writers, writes = 8, 2000
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < writes; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				nabiaDB.Write(fmt.Sprintf("w%d/%d", w, n), []byte("Value"))
+				nabiaDB.Write(fmt.Sprintf("w%d/last", w), []byte(strconv.Itoa(n)))
+			}
+		}(w)
+	}
+	for i := 0; i < 20; i++ {
+		if err := nabiaDB.saveToFile(location); err != nil {
+			t.Fatalf("failed to save NabiaDB to file: %s", err)
+		}
+		loaded, err := NabiaDBFromFile(location)
+		if err != nil {
+			t.Fatalf("failed to load NabiaDB from file: %s", err)
+		}
+		keys := loaded.Keys("")
+		if size := loaded.Stats().Size; size != int64(len(keys)) {
+			t.Errorf("Size doesn't match the saved keys: got %d, expected %d", size, len(keys))
+		}
+		for w := 0; w < writers; w++ {
+			last, err := loaded.Read(fmt.Sprintf("w%d/last", w))
+			if err != nil {
+				continue // the writer hadn't committed anything yet
+			}
+			n, _ := strconv.Atoi(string(last))
+			for k := 0; k <= n; k++ {
+				if !loaded.Exists(fmt.Sprintf("w%d/%d", w, k)) {
+					t.Fatalf("Snapshot holds the last write %d of writer %d but not its write %d", n, w, k)
+				}
+			}
+			if loaded.Exists(fmt.Sprintf("w%d/%d", w, n+2)) {
+				t.Fatalf("Snapshot holds a write of writer %d made after its last recorded one", w)
+			}
+		}
+		loaded.Stop()
+	}
+	close(stop)
+	wg.Wait()
+	nabiaDB.Stop()
+}
+
+func TestExportJSON(t *testing.T) {
+	nabiaDB, err := NewNabiaDB(filepath.Join(t.TempDir(), "export.db"))
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	defer nabiaDB.Stop()
+
+	var empty bytes.Buffer
+	if err := nabiaDB.ExportJSON(&empty); err != nil || empty.String() != "[\n]\n" {
+		t.Errorf("Unexpected export of an empty database: got %q (%v)", empty.String(), err)
+	}
+
+	nabiaDB.Write("A", []byte("Value_A"))
+	nabiaDB.Write("B\x00/binary", []byte{0, 1, 2, 255})
+	nabiaDB.WriteWithTTL("C", []byte("Value_C"), time.Hour)
+	nabiaDB.WriteWithTTL("D", []byte("Value_D"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	var exported bytes.Buffer
+	if err := nabiaDB.ExportJSON(&exported); err != nil {
+		t.Fatalf("Failed to export: %s", err)
+	}
+	var records []ExportedRecord
+	if err := json.Unmarshal(exported.Bytes(), &records); err != nil {
+		t.Fatalf("Export isn't a JSON array of records: %s\n%s", err, exported.String())
+	}
+	if len(records) != 3 {
+		t.Fatalf("Unexpected number of exported records: got %d, expected 3", len(records))
+	}
+
+	// Importing the records again yields the same database
+	imported := newEmptyDB()
+	for _, record := range records {
+		if record.ExpiresAt != nil {
+			err = imported.WriteWithTTL(record.Key, record.Value, time.Until(*record.ExpiresAt))
+		} else {
+			err = imported.Write(record.Key, record.Value)
+		}
+		if err != nil {
+			t.Fatalf("Failed to import %q: %s", record.Key, err)
+		}
+	}
+	for _, key := range []string{"A", "B\x00/binary", "C"} {
+		original, _ := nabiaDB.ReadRecord(key)
+		copied, err := imported.ReadRecord(key)
+		if err != nil || !bytes.Equal(copied.RawData, original.RawData) {
+			t.Errorf("Unexpected value of %q after a round trip: got %q, expected %q (%v)", key, copied.RawData, original.RawData, err)
+		}
+		if copied.ExpiresAt.IsZero() != original.ExpiresAt.IsZero() {
+			t.Errorf("TTL of %q was lost in a round trip", key)
+		}
+	}
+	if imported.Exists("D") {
+		t.Error("An expired key was exported")
+	}
+
+	// A conversion can rewrite records, or abort the export
+	var converted bytes.Buffer
+	err = nabiaDB.ExportJSONWith(&converted, func(record *ExportedRecord) error {
+		record.ContentType = "text/plain"
+		return nil
+	})
+	if err != nil || strings.Count(converted.String(), `"content_type":"text/plain"`) != 3 {
+		t.Errorf("Unexpected converted export: %s (%v)", converted.String(), err)
+	}
+	failure := errors.New("conversion failed")
+	err = nabiaDB.ExportJSONWith(io.Discard, func(record *ExportedRecord) error { return failure })
+	if !errors.Is(err, failure) {
+		t.Errorf("Unexpected error of a failed conversion: %v", err)
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	nabiaDB, err := NewNabiaDB(filepath.Join(t.TempDir(), "import.db"))
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	defer nabiaDB.Stop()
+
+	// Values are base64-encoded: "Value_A", "Value_B" and "Value_C"
+	document := `[
+		{"key":"A","value":"VmFsdWVfQQ=="},
+		{"key":"B","value":"VmFsdWVfQg==","expires_at":"2999-01-01T00:00:00Z"},
+		{"key":"C","value":"VmFsdWVfQw==","expires_at":"2000-01-01T00:00:00Z"}
+	]`
+	if err := nabiaDB.ImportJSON(strings.NewReader(document)); err != nil {
+		t.Fatalf("Failed to import: %s", err)
+	}
+	if data, err := nabiaDB.Read("A"); err != nil || string(data) != "Value_A" {
+		t.Errorf("Unexpected imported value: got %q (%v)", data, err)
+	}
+	if _, expiresAt, _ := nabiaDB.ReadWithExpiry("B"); !expiresAt.Equal(time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected expiry of an imported key: got %s", expiresAt)
+	}
+	if nabiaDB.Exists("C") {
+		t.Error("An expired record was imported")
+	}
+
+	// Duplicates are either overwritten or skipped
+	duplicates := `[{"key":"A","value":"Q2hhbmdlZA=="},{"key":"D","value":"VmFsdWVfRA=="}]`
+	table := []struct {
+		options  ImportOptions
+		expected ImportResult
+		valueA   string
+	}{
+		{ImportOptions{Overwrite: false, DryRun: true}, ImportResult{Imported: 1, Skipped: 1}, "Value_A"},
+		{ImportOptions{Overwrite: true, DryRun: true}, ImportResult{Imported: 2}, "Value_A"},
+		{ImportOptions{Overwrite: false}, ImportResult{Imported: 1, Skipped: 1}, "Value_A"},
+		{ImportOptions{Overwrite: true}, ImportResult{Imported: 2}, "Changed"},
+	}
+	for _, row := range table {
+		nabiaDB.Delete("D")
+		result, err := nabiaDB.ImportJSONWith(strings.NewReader(duplicates), row.options)
+		if err != nil || result.Imported != row.expected.Imported || result.Skipped != row.expected.Skipped || len(result.Failed) != 0 {
+			t.Errorf("Unexpected result with %+v: got %+v (%v), expected %+v", row.options, result, err, row.expected)
+		}
+		if data, _ := nabiaDB.Read("A"); string(data) != row.valueA {
+			t.Errorf("Unexpected value of a duplicate with %+v: got %q, expected %q", row.options, data, row.valueA)
+		}
+		if nabiaDB.Exists("D") == row.options.DryRun {
+			t.Errorf("Unexpected existence of a new key with %+v", row.options)
+		}
+	}
+
+	// Malformed records are reported by index, and only abort strict imports
+	malformed := `[{"key":"E","value":"VmFsdWVfRQ=="},{"key":"","value":"VmFsdWU="},42,{"key":"F","value":""},{"key":"G","value":"VmFsdWVfRw=="}]`
+	result, err := nabiaDB.ImportJSONWith(strings.NewReader(malformed), ImportOptions{Overwrite: true})
+	if err != nil || result.Imported != 2 {
+		t.Errorf("Unexpected result of a lenient import: got %+v (%v)", result, err)
+	}
+	var indexes []int
+	for _, failure := range result.Failed {
+		indexes = append(indexes, failure.Index)
+	}
+	if !reflect.DeepEqual(indexes, []int{1, 2, 3}) || result.Failed[2].Key != "F" {
+		t.Errorf("Unexpected failures of a lenient import: got %+v", result.Failed)
+	}
+	if err := nabiaDB.ImportJSON(strings.NewReader(malformed)); err == nil || !strings.Contains(err.Error(), "record 2:") {
+		t.Errorf("ImportJSON didn't report the malformed records: %v", err)
+	}
+	nabiaDB.Delete("E")
+	nabiaDB.Delete("G")
+	result, err = nabiaDB.ImportJSONWith(strings.NewReader(malformed), ImportOptions{Overwrite: true, Strict: true})
+	var failure ImportError
+	if !errors.As(err, &failure) || failure.Index != 1 || result.Imported != 1 {
+		t.Errorf("Unexpected result of a strict import: got %+v (%v)", result, err)
+	}
+	if !nabiaDB.Exists("E") || nabiaDB.Exists("G") {
+		t.Error("A strict import didn't stop at the first malformed record")
+	}
+
+	for _, document := range []string{`{"key":"A"}`, `[{"key":"A","value":"VmFsdWU="}`, `not json`} {
+		if err := nabiaDB.ImportJSON(strings.NewReader(document)); err == nil {
+			t.Errorf("Importing %q didn't fail", document)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "readonly.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	nabiaDB.Write("A", []byte("Value_A"))
+	nabiaDB.Write("counter", []byte("1"))
+	if err := nabiaDB.Stop(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+	saved, _ := os.Stat(location)
+
+	frozen, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("Failed to load NabiaDB: %s", err)
+	}
+	frozen.SetReadOnly(true)
+	if !frozen.ReadOnly() {
+		t.Error("Database isn't read-only")
+	}
+	if data, err := frozen.Read("A"); err != nil || string(data) != "Value_A" {
+		t.Errorf("Failed to read from a read-only database: got %q (%v)", data, err)
+	}
+	writes := map[string]func() error{
+		"Write":        func() error { return frozen.Write("B", []byte("Value_B")) },
+		"WriteWithTTL": func() error { return frozen.WriteWithTTL("B", []byte("Value_B"), time.Hour) },
+		"WriteIfAbsent": func() error {
+			_, err := frozen.WriteIfAbsent("B", []byte("Value_B"))
+			return err
+		},
+		"CompareAndSwap": func() error {
+			_, err := frozen.CompareAndSwap("A", []byte("Value_A"), []byte("Changed"))
+			return err
+		},
+		"Increment": func() error {
+			_, err := frozen.Increment("counter", 1)
+			return err
+		},
+		"Update": func() error {
+			return frozen.Update("A", func(current []byte) ([]byte, error) { return []byte("Changed"), nil })
+		},
+		"Delete": func() error { return frozen.Delete("A") },
+		"Save":   frozen.Save,
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Unexpected error of %s in read-only mode: %v", name, err)
+		}
+	}
+	if data, _ := frozen.Read("A"); string(data) != "Value_A" || frozen.Exists("B") || frozen.Stats().Writes != 0 {
+		t.Error("A read-only database was modified")
+	}
+
+	if err := frozen.Stop(); err != nil {
+		t.Errorf("Failed to stop a read-only database: %s", err)
+	}
+	if stopped, _ := os.Stat(location); !stopped.ModTime().Equal(saved.ModTime()) {
+		t.Error("Stopping a read-only database rewrote its file")
+	}
+	frozen.SetReadOnly(false)
+	if err := frozen.Write("B", []byte("Value_B")); err != nil {
+		t.Errorf("Failed to write once read-only mode is off: %s", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	nabiaDB.Write("A", []byte("Value_A"))
+
+	_, readErr := nabiaDB.Read("missing")
+	_, _, expiryErr := nabiaDB.ReadWithExpiry("missing")
+	_, recordErr := nabiaDB.ReadRecord("missing")
+	_, emptyReadErr := nabiaDB.Read("")
+	cases := []struct {
+		name     string
+		err      error
+		sentinel error
+	}{
+		{"Read of a missing key", readErr, ErrKeyNotFound},
+		{"ReadWithExpiry of a missing key", expiryErr, ErrKeyNotFound},
+		{"ReadRecord of a missing key", recordErr, ErrKeyNotFound},
+		{"Read of the empty key", emptyReadErr, ErrKeyEmpty},
+		{"Write of the empty key", nabiaDB.Write("", []byte("Value")), ErrKeyEmpty},
+		{"Write of an empty value", nabiaDB.Write("B", []byte{}), ErrValueEmpty},
+		{"Write of a nil value", nabiaDB.Write("B", nil), ErrValueNil},
+		{"Delete of the empty key", nabiaDB.Delete(""), ErrKeyEmpty},
+		{"Update of a missing key", nabiaDB.Update("missing", func(current []byte) ([]byte, error) { return current, nil }), ErrKeyNotFound},
+	}
+	for _, c := range cases {
+		if !errors.Is(c.err, c.sentinel) {
+			t.Errorf("Unexpected error of %s: got %v, expected %v", c.name, c.err, c.sentinel)
+		}
+	}
+	if !strings.Contains(readErr.Error(), `"missing"`) {
+		t.Errorf("The error of a missing key doesn't name it: %s", readErr)
+	}
+
+	nabiaDB.SetReadOnly(true)
+	if err := nabiaDB.Delete("A"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Unexpected error of Delete in read-only mode: %v", err)
+	}
+	if err := nabiaDB.Write("A", []byte("Changed")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Unexpected error of Write in read-only mode: %v", err)
+	}
+}
+
+func TestEmptyValues(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "empty.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	nabiaDB.Write("A", []byte("Value_A"))
+	writes := map[string]func() error{
+		"Write":        func() error { return nabiaDB.Write("marker", []byte{}) },
+		"WriteWithTTL": func() error { return nabiaDB.WriteWithTTL("expiring", []byte{}, time.Hour) },
+		"WriteIfAbsent": func() error {
+			_, err := nabiaDB.WriteIfAbsent("absent", []byte{})
+			return err
+		},
+		"CompareAndSwap": func() error {
+			_, err := nabiaDB.CompareAndSwap("A", []byte("Value_A"), []byte{})
+			return err
+		},
+		"Update": func() error {
+			return nabiaDB.Update("A", func(current []byte) ([]byte, error) { return []byte{}, nil })
+		},
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrValueEmpty) {
+			t.Errorf("Unexpected error of %s with an empty value by default: %v", name, err)
+		}
+	}
+	if nabiaDB.AllowEmptyValues() || nabiaDB.Exists("marker") || nabiaDB.Stats().Writes != 1 {
+		t.Error("An empty value was written by default")
+	}
+
+	nabiaDB.SetAllowEmptyValues(true)
+	if !nabiaDB.AllowEmptyValues() {
+		t.Error("Empty values aren't allowed")
+	}
+	for name, write := range writes {
+		if err := write(); err != nil {
+			t.Errorf("Failed to %s an empty value: %s", name, err)
+		}
+	}
+	for _, key := range []string{"A", "marker", "expiring", "absent"} {
+		if data, err := nabiaDB.Read(key); err != nil || len(data) != 0 {
+			t.Errorf("Unexpected value of %q: got %q (%v)", key, data, err)
+		}
+	}
+	if err := nabiaDB.Write("B", nil); !errors.Is(err, ErrValueNil) {
+		t.Errorf("Unexpected error with a nil value: %v", err)
+	}
+
+	if err := nabiaDB.Stop(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+	loaded, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("Failed to load NabiaDB: %s", err)
+	}
+	defer loaded.Stop()
+	if data, err := loaded.Read("marker"); err != nil || len(data) != 0 {
+		t.Errorf("Unexpected value of an empty marker once loaded: got %q (%v)", data, err)
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "mode.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	defer nabiaDB.Stop()
+	nabiaDB.Write("A", []byte("Value_A"))
+	mode := func(location string) os.FileMode {
+		t.Helper()
+		info, err := os.Stat(location)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %s", location, err)
+		}
+		return info.Mode().Perm()
+	}
+	if err := nabiaDB.Save(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+	if m := mode(location); m != 0600 {
+		t.Errorf("Unexpected default mode of a snapshot: got %v", m)
+	}
+
+	if err := nabiaDB.SetFileMode(os.ModeDir | 0700); err == nil {
+		t.Error("A mode with more than permission bits was accepted")
+	}
+	if err := nabiaDB.SetFileMode(0640); err != nil {
+		t.Fatalf("Failed to set the file mode: %s", err)
+	}
+	if err := nabiaDB.Save(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+	if m := mode(location); m != 0640 {
+		t.Errorf("Unexpected mode of a snapshot: got %v, expected %v", m, os.FileMode(0640))
+	}
+	if err := nabiaDB.EnableWAL(FsyncOS, 0); err != nil {
+		t.Fatalf("Failed to enable the write-ahead log: %s", err)
+	}
+	if m := mode(walLocation(location)); m != 0640 {
+		t.Errorf("Unexpected mode of the write-ahead log: got %v, expected %v", m, os.FileMode(0640))
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Failed to change directory: %s", err)
+	}
+	defer os.Chdir(wd)
+
+	nabiaDB := NewInMemoryNabiaDB()
+	if err := nabiaDB.Write("A", []byte("Value_A")); err != nil {
+		t.Errorf("Failed to write in memory: %s", err)
+	}
+	if data, err := nabiaDB.Read("A"); err != nil || string(data) != "Value_A" {
+		t.Errorf("Failed to read in memory: got %q (%v)", data, err)
+	}
+	nabiaDB.Delete("A")
+	nabiaDB.Write("B", []byte("Value_B"))
+	if nabiaDB.Exists("A") || !nabiaDB.Exists("B") {
+		t.Error("Unexpected keys in memory")
+	}
+	if err := nabiaDB.Ping(); err != nil {
+		t.Errorf("Failed to ping a database in memory: %s", err)
+	}
+	if err := nabiaDB.Save(); err == nil {
+		t.Error("Saving a database without a location didn't fail")
+	}
+	if err := nabiaDB.Stop(); err != nil {
+		t.Errorf("Failed to stop a database in memory: %s", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("A database in memory created files: %v", entries)
+	}
+
+	// A snapshot can still be taken explicitly
+	location := filepath.Join(dir, "snapshot.db")
+	if err := nabiaDB.SaveToFile(location); err != nil {
+		t.Fatalf("Failed to save a database in memory: %s", err)
+	}
+	loaded, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("Failed to load the snapshot: %s", err)
+	}
+	defer loaded.Stop()
+	if data, err := loaded.Read("B"); err != nil || string(data) != "Value_B" {
+		t.Errorf("Unexpected value in the snapshot: got %q (%v)", data, err)
+	}
 }
@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Op is the kind of change reported by a ChangeEvent.
+type Op int
+
+const (
+	// OpWrite reports that a key was created or given a new value, by any
+	// write, including Copy and the destination of Move.
+	OpWrite Op = iota + 1
+	// OpDelete reports that a key was removed: deleted, moved away, expired
+	// or evicted to stay within SetMaxKeys and SetMaxMemory.
+	OpDelete
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpWrite:
+		return "write"
+	case OpDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// ChangeEvent is a change of a key, delivered to the subscribers of the
+// database, see Subscribe.
+type ChangeEvent struct {
+	Op  Op
+	Key string
+}
+
+// ErrTooManyWatchers is returned by Subscribe while the database has as many
+// subscribers as SetMaxWatchers allows.
+var ErrTooManyWatchers = errors.New("too many watchers")
+
+// subscriberBuffer is how many events a subscriber may lag behind before the
+// next ones are dropped.
+const subscriberBuffer = 256
+
+// subscribers are the channels events are delivered to.
+type subscribers struct {
+	mu       sync.RWMutex // held shared while delivering, exclusively to add or remove a channel
+	count    atomic.Int32 // spares writes the lock while nobody subscribed
+	channels map[chan ChangeEvent]struct{}
+	max      int  // most subscribers at once, 0 for unlimited
+	closed   bool // by Stop, no subscriber is added anymore
+}
+
+// SetMaxWatchers bounds the number of subscribers at once to n, each of which
+// holds a buffer of events: Subscribe fails with ErrTooManyWatchers beyond it,
+// until a subscriber unsubscribes. Zero removes the bound.
+func (ns *NabiaDB) SetMaxWatchers(n int) error {
+	if n < 0 {
+		return fmt.Errorf("max watchers cannot be negative")
+	}
+	s := &ns.internals.subscribers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.max = n
+	return nil
+}
+
+// Subscribe returns a channel receiving an event for every change of a key,
+// along with the function unsubscribing it, which closes the channel. Events
+// are delivered without ever blocking writers: a subscriber lagging more than
+// 256 events behind misses the next ones until it catches up, so the channel
+// should be drained promptly. While writes are serialized, with the
+// write-ahead log or bounds on the keys or memory, events arrive in the order
+// the changes were applied; otherwise concurrent changes may arrive in any
+// order. The channel is closed when the database is stopped. It fails with
+// ErrTooManyWatchers while there are as many subscribers as SetMaxWatchers
+// allows.
+func (ns *NabiaDB) Subscribe() (<-chan ChangeEvent, func(), error) {
+	s := &ns.internals.subscribers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.max > 0 && len(s.channels) >= s.max {
+		return nil, nil, fmt.Errorf("%w: at most %d", ErrTooManyWatchers, s.max)
+	}
+	ch := make(chan ChangeEvent, subscriberBuffer)
+	if s.closed {
+		close(ch)
+		return ch, func() {}, nil
+	}
+	if s.channels == nil {
+		s.channels = make(map[chan ChangeEvent]struct{})
+	}
+	s.channels[ch] = struct{}{}
+	s.count.Add(1)
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if _, ok := s.channels[ch]; ok { // not closed by Stop already
+				delete(s.channels, ch)
+				s.count.Add(-1)
+				close(ch)
+			}
+		})
+	}, nil
+}
+
+// notify delivers an event to every subscriber with room for it.
+func (ns *NabiaDB) notify(op Op, key string) {
+	s := &ns.internals.subscribers
+	if s.count.Load() == 0 {
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	event := ChangeEvent{Op: op, Key: key}
+	for ch := range s.channels {
+		select {
+		case ch <- event:
+		default: // lagging behind, see Subscribe
+		}
+	}
+}
+
+// closeSubscribers closes the channels of every subscriber, once the
+// database is stopped.
+func (ns *NabiaDB) closeSubscribers() {
+	s := &ns.internals.subscribers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.channels {
+		close(ch)
+	}
+	s.channels = nil
+	s.count.Store(0)
+	s.closed = true
+}
@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// receive returns the next event of events, failing the test if none comes.
+func receive(t *testing.T, events <-chan ChangeEvent) ChangeEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("No event was received")
+		return ChangeEvent{}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	events, unsubscribe, _ := nabiaDB.Subscribe()
+	defer unsubscribe()
+
+	nabiaDB.Write("A", []byte("Value_A"))
+	nabiaDB.Write("A", []byte("Value_A2"))
+	nabiaDB.CompareAndSwap("A", []byte("Value_A2"), []byte("Value_A3"))
+	nabiaDB.Move("A", "B", false)
+	nabiaDB.Delete("B")
+	nabiaDB.Delete("Missing") // nothing changes
+	nabiaDB.WriteWithTTL("C", []byte("Value_C"), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	nabiaDB.Read("C") // expired keys are removed when read
+
+	expected := []ChangeEvent{
+		{OpWrite, "A"},
+		{OpWrite, "A"},
+		{OpWrite, "A"},
+		{OpDelete, "A"},
+		{OpWrite, "B"},
+		{OpDelete, "B"},
+		{OpWrite, "C"},
+		{OpDelete, "C"},
+	}
+	for i, want := range expected {
+		if event := receive(t, events); event != want {
+			t.Errorf("Unexpected event %d: got %s of %q, expected %s of %q", i, event.Op, event.Key, want.Op, want.Key)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event: %s of %q", event.Op, event.Key)
+	default:
+	}
+
+	// Every subscriber gets the events, until it unsubscribes
+	other, unsubscribeOther, _ := nabiaDB.Subscribe()
+	nabiaDB.Write("D", []byte("Value_D"))
+	if event := receive(t, other); event != (ChangeEvent{OpWrite, "D"}) {
+		t.Errorf("Unexpected event of the second subscriber: %+v", event)
+	}
+	receive(t, events)
+	unsubscribeOther()
+	unsubscribeOther() // unsubscribing twice is harmless
+	if _, open := <-other; open {
+		t.Error("The channel wasn't closed by unsubscribing")
+	}
+	nabiaDB.Write("E", []byte("Value_E"))
+	if event := receive(t, events); event.Key != "E" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
+
+func TestSubscribeEvictions(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	nabiaDB.SetMaxKeys(1)
+	events, unsubscribe, _ := nabiaDB.Subscribe()
+	defer unsubscribe()
+
+	nabiaDB.Write("A", []byte("Value_A"))
+	nabiaDB.Write("B", []byte("Value_B"))
+	for i, want := range []ChangeEvent{{OpWrite, "A"}, {OpWrite, "B"}, {OpDelete, "A"}} {
+		if event := receive(t, events); event != want {
+			t.Errorf("Unexpected event %d: got %+v, expected %+v", i, event, want)
+		}
+	}
+}
+
+func TestSubscribeNeverBlocks(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	events, unsubscribe, _ := nabiaDB.Subscribe()
+	defer unsubscribe()
+
+	// Writes go on while nobody reads the events, which are dropped past the
+	// buffer
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*subscriberBuffer; i++ {
+			nabiaDB.Write("Key", []byte("Value"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writes were blocked by a lagging subscriber")
+	}
+	if len(events) != subscriberBuffer {
+		t.Errorf("Unexpected number of buffered events: got %d, expected %d", len(events), subscriberBuffer)
+	}
+
+	// Stopping closes the channels, once the buffered events are received
+	nabiaDB.Stop()
+	received := 0
+	for range events {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("Unexpected number of events before the close: got %d", received)
+	}
+	late, _, _ := nabiaDB.Subscribe()
+	if _, open := <-late; open {
+		t.Error("Subscribing after Stop didn't return a closed channel")
+	}
+}
+
+func TestMaxWatchers(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	if err := nabiaDB.SetMaxWatchers(2); err != nil {
+		t.Fatalf("Failed to bound the watchers: %s", err)
+	}
+	_, unsubscribe, _ := nabiaDB.Subscribe()
+	nabiaDB.Subscribe()
+	if _, _, err := nabiaDB.Subscribe(); !errors.Is(err, ErrTooManyWatchers) {
+		t.Errorf("Expected ErrTooManyWatchers, got %v", err)
+	}
+
+	// Unsubscribing frees a slot, once
+	unsubscribe()
+	unsubscribe()
+	if _, _, err := nabiaDB.Subscribe(); err != nil {
+		t.Errorf("Unsubscribing didn't free a slot: %s", err)
+	}
+	if _, _, err := nabiaDB.Subscribe(); !errors.Is(err, ErrTooManyWatchers) {
+		t.Errorf("Expected ErrTooManyWatchers, got %v", err)
+	}
+	if err := nabiaDB.SetMaxWatchers(-1); err == nil {
+		t.Error("A negative bound was accepted")
+	}
+}
@@ -0,0 +1,197 @@
+package engine
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// lru tracks the order in which keys were last used, so that the least
+// recently used ones can be evicted once the database holds too many keys or
+// bytes. Reads and writes count as uses. A nil *lru tracks nothing.
+type lru struct {
+	writeMu   sync.Mutex // held while mutating the map, so the order matches it
+	mu        sync.Mutex // guards order and elements
+	order     *list.List // of lruItem, the most recently used first
+	elements  map[string]*list.Element
+	maxKeys   int64 // 0 when unbounded
+	maxMemory int64 // 0 when unbounded
+}
+
+// lruItem is an element of the order: a key, and the entry last stored under
+// it, so that an outdated entry being removed doesn't untrack its successor.
+type lruItem struct {
+	key   string
+	entry *entry
+}
+
+// ErrValueTooLarge is returned, wrapped, by writes of values which wouldn't
+// fit in the memory budget even if every other key was evicted.
+var ErrValueTooLarge = errors.New("value exceeds the memory budget")
+
+// SetMaxKeys bounds the number of keys in the database: whenever a write adds
+// a key beyond n, the least recently used key is evicted, and counted in the
+// evictions of Stats. Zero removes the bound. Writes are serialized while a
+// bound is set, so the order of use matches the map. Existing keys are ordered
+// by their last modification. It must be set once the database is loaded, and
+// after EnableWAL, before the database is in use.
+func (ns *NabiaDB) SetMaxKeys(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("max keys cannot be negative")
+	}
+	var maxMemory int64
+	if l := ns.internals.lru; l != nil {
+		maxMemory = l.maxMemory
+	}
+	ns.setBounds(n, maxMemory)
+	return nil
+}
+
+// SetMaxMemory bounds the memory held by the database, approximated as the
+// sum of the lengths of its keys and values, and reported by Stats: whenever a
+// write takes it beyond n bytes, the least recently used keys are evicted
+// until the budget is met again. Writes of values larger than the whole budget
+// fail with ErrValueTooLarge. Zero removes the bound. It behaves like
+// SetMaxKeys otherwise, and both bounds can be set at once.
+func (ns *NabiaDB) SetMaxMemory(n int64) error {
+	if n < 0 {
+		return fmt.Errorf("max memory cannot be negative")
+	}
+	var maxKeys int64
+	if l := ns.internals.lru; l != nil {
+		maxKeys = l.maxKeys
+	}
+	ns.setBounds(maxKeys, n)
+	return nil
+}
+
+// setBounds starts tracking the order of use if needed, and evicts keys until
+// the database is within the new bounds.
+func (ns *NabiaDB) setBounds(maxKeys, maxMemory int64) {
+	if maxKeys == 0 && maxMemory == 0 {
+		ns.internals.lru = nil
+		return
+	}
+	if ns.internals.lru == nil {
+		var items []lruItem
+		ns.records().Range(func(key, value interface{}) bool {
+			items = append(items, lruItem{key: key.(string), entry: value.(*entry)})
+			return true
+		})
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].entry.modifiedAt.Before(items[j].entry.modifiedAt)
+		})
+		l := &lru{order: list.New(), elements: make(map[string]*list.Element)}
+		for _, item := range items {
+			l.stored(item.key, item.entry)
+		}
+		ns.internals.lru = l
+	}
+	ns.internals.lru.maxKeys, ns.internals.lru.maxMemory = maxKeys, maxMemory
+	unlock := ns.lockWrite()
+	defer unlock()
+	ns.evictLeastRecentlyUsed()
+}
+
+// checkBudget fails with ErrValueTooLarge if value couldn't be stored under
+// key without exceeding the memory budget on its own.
+func (ns *NabiaDB) checkBudget(key string, value []byte) error {
+	l := ns.internals.lru
+	if l == nil || l.maxMemory == 0 {
+		return nil
+	}
+	if size := int64(len(key) + len(value)); size > l.maxMemory {
+		return fmt.Errorf("%w: %d bytes, the budget is %d", ErrValueTooLarge, size, l.maxMemory)
+	}
+	return nil
+}
+
+// overBounds tells whether the database holds more keys or bytes than allowed.
+func (ns *NabiaDB) overBounds(l *lru) bool {
+	return (l.maxKeys > 0 && ns.records().size() > l.maxKeys) ||
+		(l.maxMemory > 0 && ns.records().memory() > l.maxMemory)
+}
+
+// evictLeastRecentlyUsed removes keys, least recently used first, until the
+// database is within its bounds. It must be called with writes locked, right
+// after a write, which checkBudget guarantees is never evicted itself.
+// -1 size and +1 eviction per key removed
+func (ns *NabiaDB) evictLeastRecentlyUsed() {
+	l := ns.internals.lru
+	if l == nil {
+		return
+	}
+	for ns.overBounds(l) {
+		item, ok := l.pop()
+		if !ok {
+			return
+		}
+		if ns.records().CompareAndDelete(item.key, item.entry) {
+			ns.records().addSize(item.key, -1)
+			atomic.AddInt64(&ns.internals.metrics.dataActivity.evictions, 1)
+			ns.records().addMemory(item.key, -item.entry.size(item.key))
+			ns.countNamespace(item.key, -1, -item.entry.size(item.key), 1)
+			ns.notify(OpDelete, item.key)
+			ns.logDelete(item.key) // an error resurfaces on the next write, as with Delete
+		}
+	}
+}
+
+// stored records that e was written under key, making it the most recently
+// used key.
+func (l *lru) stored(key string, e *entry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.elements[key]; ok {
+		element.Value = lruItem{key: key, entry: e}
+		l.order.MoveToFront(element)
+		return
+	}
+	l.elements[key] = l.order.PushFront(lruItem{key: key, entry: e})
+}
+
+// touch records that key was read, making it the most recently used key.
+func (l *lru) touch(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.elements[key]; ok {
+		l.order.MoveToFront(element)
+	}
+}
+
+// removed stops tracking key, unless an entry other than e was stored under it
+// since. A nil e stops tracking key regardless.
+func (l *lru) removed(key string, e *entry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.elements[key]; ok && (e == nil || element.Value.(lruItem).entry == e) {
+		l.order.Remove(element)
+		delete(l.elements, key)
+	}
+}
+
+// pop stops tracking the least recently used key, and returns it.
+func (l *lru) pop() (lruItem, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element := l.order.Back()
+	if element == nil {
+		return lruItem{}, false
+	}
+	l.order.Remove(element)
+	item := element.Value.(lruItem)
+	delete(l.elements, item.key)
+	return item, true
+}
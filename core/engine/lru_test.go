@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxKeys(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "lru.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	if err := nabiaDB.SetMaxKeys(-1); err == nil {
+		t.Error("Negative max keys were accepted")
+	}
+	if err := nabiaDB.SetMaxKeys(3); err != nil {
+		t.Fatalf("Failed to set max keys: %s", err)
+	}
+	for _, key := range []string{"A", "B", "C"} {
+		nabiaDB.Write(key, []byte("Value_"+key))
+	}
+	nabiaDB.Read("A") // B is now the least recently used key
+	nabiaDB.Write("D", []byte("Value_D"))
+	if nabiaDB.Exists("B") {
+		t.Error("The least recently used key wasn't evicted")
+	}
+	for _, key := range []string{"A", "C", "D"} {
+		if !nabiaDB.Exists(key) {
+			t.Errorf("Recently used key %q was evicted", key)
+		}
+	}
+	// Overwrites and other writes to existing keys evict nothing
+	nabiaDB.Write("C", []byte("Changed"))
+	nabiaDB.CompareAndSwap("D", []byte("Value_D"), []byte("Swapped"))
+	nabiaDB.Update("A", func(current []byte) ([]byte, error) { return []byte("Updated"), nil })
+	if stats := nabiaDB.Stats(); stats.Size != 3 || stats.Evictions != 1 {
+		t.Errorf("Unexpected size and evictions: got %d and %d, expected 3 and 1", stats.Size, stats.Evictions)
+	}
+	// C is now the least recently used key, deleted keys free their slot
+	nabiaDB.Delete("A")
+	nabiaDB.Increment("counter", 1)
+	nabiaDB.WriteIfAbsent("E", []byte("Value_E"))
+	if nabiaDB.Exists("C") || !nabiaDB.Exists("D") || !nabiaDB.Exists("counter") || !nabiaDB.Exists("E") {
+		t.Errorf("Unexpected keys after more writes: %q", nabiaDB.Keys(""))
+	}
+
+	// Only the surviving keys are saved
+	if err := nabiaDB.Stop(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+	loaded, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("Failed to load NabiaDB: %s", err)
+	}
+	defer loaded.Stop()
+	if keys := loaded.Keys(""); fmt.Sprint(keys) != "[D E counter]" {
+		t.Errorf("Unexpected saved keys: got %q", keys)
+	}
+
+	// Bounding a loaded database evicts its oldest keys right away
+	time.Sleep(time.Millisecond)
+	loaded.Write("D", []byte("Newest"))
+	if err := loaded.SetMaxKeys(1); err != nil {
+		t.Fatalf("Failed to set max keys: %s", err)
+	}
+	if keys := loaded.Keys(""); fmt.Sprint(keys) != "[D]" {
+		t.Errorf("Unexpected keys after bounding a loaded database: got %q", keys)
+	}
+	if evictions := loaded.Stats().Evictions; evictions != 2 {
+		t.Errorf("Unexpected evictions: got %d, expected 2", evictions)
+	}
+}
+
+func TestMaxKeysConcurrency(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	nabiaDB.SetMaxKeys(10)
+	done := make(chan struct{})
+	for w := 0; w < 8; w++ {
+		go func(w int) {
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("%d/%d", w, i%20)
+				nabiaDB.Write(key, []byte("Value"))
+				nabiaDB.Read(key)
+				if i%3 == 0 {
+					nabiaDB.Delete(key)
+				}
+			}
+			done <- struct{}{}
+		}(w)
+	}
+	for w := 0; w < 8; w++ {
+		<-done
+	}
+	stats := nabiaDB.Stats()
+	if keys := nabiaDB.Keys(""); stats.Size != int64(len(keys)) || stats.Size > 10 {
+		t.Errorf("Size doesn't match the keys: got %d for %d keys", stats.Size, len(keys))
+	}
+	if tracked := len(nabiaDB.internals.lru.elements); int64(tracked) != stats.Size {
+		t.Errorf("The order of use tracks %d keys, expected %d", tracked, stats.Size)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	if err := nabiaDB.SetMaxMemory(-1); err == nil {
+		t.Error("Negative max memory was accepted")
+	}
+	// Every key and value below takes 10 bytes
+	nabiaDB.Write("A", []byte("123456789"))
+	nabiaDB.Write("B", []byte("123456789"))
+	if memory := nabiaDB.Stats().Memory; memory != 20 {
+		t.Errorf("Unexpected memory: got %d, expected 20", memory)
+	}
+	if err := nabiaDB.SetMaxMemory(30); err != nil {
+		t.Fatalf("Failed to set max memory: %s", err)
+	}
+	nabiaDB.Write("C", []byte("123456789"))
+	nabiaDB.Read("A") // B is now the least recently used key
+	nabiaDB.Write("D", []byte("123456789"))
+	if nabiaDB.Exists("B") || !nabiaDB.Exists("A") || !nabiaDB.Exists("C") || !nabiaDB.Exists("D") {
+		t.Errorf("Unexpected keys after crossing the budget: %q", nabiaDB.Keys(""))
+	}
+	// A larger value evicts as many keys as needed
+	nabiaDB.Write("E", []byte("1234567890123456789"))
+	if keys := nabiaDB.Keys(""); fmt.Sprint(keys) != "[D E]" {
+		t.Errorf("Unexpected keys after a larger write: got %q", keys)
+	}
+	if stats := nabiaDB.Stats(); stats.Memory != 30 || stats.Evictions != 3 {
+		t.Errorf("Unexpected memory and evictions: got %d and %d, expected 30 and 3", stats.Memory, stats.Evictions)
+	}
+	// Values which can't fit are rejected, and evict nothing
+	if err := nabiaDB.Write("F", make([]byte, 30)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	err := nabiaDB.Update("D", func(current []byte) ([]byte, error) { return make([]byte, 30), nil })
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge from Update, got %v", err)
+	}
+	if nabiaDB.Exists("F") || nabiaDB.Stats().Size != 2 {
+		t.Errorf("A rejected write changed the keys: %q", nabiaDB.Keys(""))
+	}
+	// Overwrites and deletes are accounted for
+	nabiaDB.Write("E", []byte("1"))
+	if memory := nabiaDB.Stats().Memory; memory != 12 {
+		t.Errorf("Unexpected memory after an overwrite: got %d, expected 12", memory)
+	}
+	nabiaDB.Delete("D")
+	if memory := nabiaDB.Stats().Memory; memory != 2 {
+		t.Errorf("Unexpected memory after a delete: got %d, expected 2", memory)
+	}
+	// Lowering the budget evicts right away
+	nabiaDB.Write("G", []byte("123456789"))
+	if err := nabiaDB.SetMaxMemory(5); err != nil {
+		t.Fatalf("Failed to set max memory: %s", err)
+	}
+	if keys := nabiaDB.Keys(""); fmt.Sprint(keys) != "[]" {
+		t.Errorf("Unexpected keys after lowering the budget: got %q", keys)
+	}
+	if memory := nabiaDB.Stats().Memory; memory != 0 {
+		t.Errorf("Unexpected memory after lowering the budget: got %d, expected 0", memory)
+	}
+}
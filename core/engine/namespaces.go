@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// namespaceSeparator ends the namespace of the keys stored in one, see
+// NamespaceKey. It is a control character, so that it can't appear in the keys
+// of the server's URL paths, nor in namespaces.
+const namespaceSeparator = "\x1f"
+
+// ErrNamespaceInvalid is returned for an empty namespace, or one holding
+// namespaceSeparator.
+var ErrNamespaceInvalid = errors.New("invalid namespace")
+
+// namespaceMetrics counts the keys of a namespace and their changes, kept up
+// to date with every change of a key, like the counters of the shards.
+type namespaceMetrics struct {
+	size   int64
+	memory int64 // sum of the sizes of the entries, see entry.size
+	writes int64 // changes of the keys: writes, deletes, expiries and evictions
+}
+
+// NamespaceStats is a point-in-time copy of the metrics of a namespace.
+type NamespaceStats struct {
+	Size   int64 `json:"size"`
+	Memory int64 `json:"memory_bytes"`
+	Writes int64 `json:"writes"`
+}
+
+// checkNamespace fails with ErrNamespaceInvalid if namespace can't be used.
+func checkNamespace(namespace string) error {
+	if namespace == "" || strings.Contains(namespace, namespaceSeparator) {
+		return fmt.Errorf("%w: %q", ErrNamespaceInvalid, namespace)
+	}
+	return nil
+}
+
+// NamespaceKey returns the key under which key is stored in namespace: the
+// namespace and namespaceSeparator, followed by key. Namespaced keys are
+// ordinary keys, so every method of the database works on them, and the
+// methods taking a namespace, such as ReadNS, are shorthands building the key.
+// The keys of different namespaces never collide, and the methods taking a
+// namespace only see the keys of theirs.
+func NamespaceKey(namespace, key string) string {
+	return namespace + namespaceSeparator + key
+}
+
+// splitNamespace returns the namespace of a stored key and the key within it,
+// and false for keys outside of any namespace.
+func splitNamespace(stored string) (string, string, bool) {
+	return strings.Cut(stored, namespaceSeparator)
+}
+
+// namespaceKey checks namespace and returns the key of key in it.
+func namespaceKey(namespace, key string) (string, error) {
+	if err := checkNamespace(namespace); err != nil {
+		return "", err
+	}
+	if key == "" {
+		return "", ErrKeyEmpty
+	}
+	return NamespaceKey(namespace, key), nil
+}
+
+// ReadNS reads key in namespace, see Read.
+// +1 read
+func (ns *NabiaDB) ReadNS(namespace, key string) ([]byte, error) {
+	stored, err := namespaceKey(namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	return ns.Read(stored)
+}
+
+// WriteNS writes key in namespace, see Write.
+// +1 size if the key is new
+// +1 write
+func (ns *NabiaDB) WriteNS(namespace, key string, value []byte) error {
+	stored, err := namespaceKey(namespace, key)
+	if err != nil {
+		return err
+	}
+	return ns.Write(stored, value)
+}
+
+// DeleteNS deletes key in namespace, see Delete.
+// -1 size if the key exists
+// +1 write
+func (ns *NabiaDB) DeleteNS(namespace, key string) error {
+	stored, err := namespaceKey(namespace, key)
+	if err != nil {
+		return err
+	}
+	return ns.Delete(stored)
+}
+
+// KeysNS returns the keys of namespace starting with prefix, without their
+// namespace, in lexicographic order.
+// +1 read
+func (ns *NabiaDB) KeysNS(namespace, prefix string) ([]string, error) {
+	if err := checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	keys := ns.Keys(NamespaceKey(namespace, prefix))
+	for i, key := range keys {
+		keys[i] = key[len(namespace)+len(namespaceSeparator):]
+	}
+	return keys, nil
+}
+
+// Namespaces returns the namespaces holding at least one key, in lexicographic
+// order.
+func (ns *NabiaDB) Namespaces() []string {
+	var namespaces []string
+	ns.internals.namespaces.Range(func(key, value interface{}) bool {
+		if atomic.LoadInt64(&value.(*namespaceMetrics).size) > 0 {
+			namespaces = append(namespaces, key.(string))
+		}
+		return true
+	})
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// NamespaceStats returns the metrics of namespace, which are all zero for a
+// namespace which never held a key.
+func (ns *NabiaDB) NamespaceStats(namespace string) NamespaceStats {
+	value, ok := ns.internals.namespaces.Load(namespace)
+	if !ok {
+		return NamespaceStats{}
+	}
+	m := value.(*namespaceMetrics)
+	return NamespaceStats{
+		Size:   atomic.LoadInt64(&m.size),
+		Memory: atomic.LoadInt64(&m.memory),
+		Writes: atomic.LoadInt64(&m.writes),
+	}
+}
+
+// countNamespace accounts for key in the metrics of its namespace, if it has
+// one: size keys more, memory bytes more, and writes changes more, which is
+// 0 when the key is loaded rather than written.
+func (ns *NabiaDB) countNamespace(key string, size, memory, writes int64) {
+	namespace, _, ok := splitNamespace(key)
+	if !ok {
+		return
+	}
+	value, ok := ns.internals.namespaces.Load(namespace)
+	if !ok {
+		value, _ = ns.internals.namespaces.LoadOrStore(namespace, &namespaceMetrics{})
+	}
+	m := value.(*namespaceMetrics)
+	atomic.AddInt64(&m.size, size)
+	atomic.AddInt64(&m.memory, memory)
+	atomic.AddInt64(&m.writes, writes)
+}
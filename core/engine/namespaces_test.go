@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNamespaces(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+
+	if err := nabiaDB.WriteNS("acme", "/key", []byte("Value_Acme")); err != nil {
+		t.Fatalf("Failed to write in a namespace: %s", err)
+	}
+	nabiaDB.WriteNS("acme", "/other", []byte("Value_Other"))
+	nabiaDB.WriteNS("globex", "/key", []byte("Value_Globex"))
+	nabiaDB.Write("/key", []byte("Value"))
+
+	// The same key holds a different value in every namespace
+	for namespace, expected := range map[string]string{"acme": "Value_Acme", "globex": "Value_Globex"} {
+		if value, err := nabiaDB.ReadNS(namespace, "/key"); err != nil || string(value) != expected {
+			t.Errorf("Unexpected value in %s: %q (%v)", namespace, value, err)
+		}
+	}
+	if value, _ := nabiaDB.Read("/key"); string(value) != "Value" {
+		t.Errorf("Unexpected value outside of namespaces: %q", value)
+	}
+	if _, err := nabiaDB.ReadNS("globex", "/other"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("A key of acme was visible to globex: %v", err)
+	}
+	if keys, err := nabiaDB.KeysNS("acme", ""); err != nil || !reflect.DeepEqual(keys, []string{"/key", "/other"}) {
+		t.Errorf("Unexpected keys of acme: %q (%v)", keys, err)
+	}
+	if keys, _ := nabiaDB.KeysNS("globex", "/o"); len(keys) != 0 {
+		t.Errorf("Unexpected keys of globex: %q", keys)
+	}
+	if namespaces := nabiaDB.Namespaces(); !reflect.DeepEqual(namespaces, []string{"acme", "globex"}) {
+		t.Errorf("Unexpected namespaces: %q", namespaces)
+	}
+
+	// Every namespace has its own metrics, and those of the database hold
+	// them all
+	acme := nabiaDB.NamespaceStats("acme")
+	memory := int64(len(NamespaceKey("acme", "/key")) + len("Value_Acme") + len(NamespaceKey("acme", "/other")) + len("Value_Other"))
+	if acme != (NamespaceStats{Size: 2, Memory: memory, Writes: 2}) {
+		t.Errorf("Unexpected stats of acme: %+v, expected a memory of %d", acme, memory)
+	}
+	if nabiaDB.NamespaceStats("globex").Size != 1 || nabiaDB.Stats().Size != 4 {
+		t.Errorf("Unexpected sizes: %+v of globex, %d in all", nabiaDB.NamespaceStats("globex"), nabiaDB.Stats().Size)
+	}
+	if err := nabiaDB.DeleteNS("globex", "/key"); err != nil {
+		t.Fatalf("Failed to delete in a namespace: %s", err)
+	}
+	if stats := nabiaDB.NamespaceStats("globex"); stats != (NamespaceStats{Size: 0, Memory: 0, Writes: 2}) {
+		t.Errorf("Unexpected stats of globex after a delete: %+v", stats)
+	}
+	if namespaces := nabiaDB.Namespaces(); !reflect.DeepEqual(namespaces, []string{"acme"}) {
+		t.Errorf("An empty namespace was listed: %q", namespaces)
+	}
+	if value, _ := nabiaDB.ReadNS("acme", "/key"); string(value) != "Value_Acme" {
+		t.Error("Deleting in globex deleted in acme")
+	}
+
+	// Expiries count as changes of the namespace
+	nabiaDB.WriteWithTTL(NamespaceKey("acme", "/expiring"), []byte("Value"), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	nabiaDB.purgeExpired()
+	if stats := nabiaDB.NamespaceStats("acme"); stats.Size != 2 || stats.Memory != memory || stats.Writes != 4 {
+		t.Errorf("Unexpected stats of acme after an expiry: %+v", stats)
+	}
+
+	for _, namespace := range []string{"", "a" + namespaceSeparator + "b"} {
+		if err := nabiaDB.WriteNS(namespace, "/key", []byte("Value")); !errors.Is(err, ErrNamespaceInvalid) {
+			t.Errorf("Expected ErrNamespaceInvalid for %q, got %v", namespace, err)
+		}
+	}
+	if err := nabiaDB.WriteNS("acme", "", []byte("Value")); !errors.Is(err, ErrKeyEmpty) {
+		t.Errorf("Expected ErrKeyEmpty, got %v", err)
+	}
+}
+
+func TestNamespacesReloaded(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "namespaces.db")
+	nabiaDB, _ := NewNabiaDB(location)
+	nabiaDB.WriteNS("acme", "/a", []byte("Value_A"))
+	nabiaDB.WriteNS("acme", "/b", []byte("Value_B"))
+	nabiaDB.WriteNS("globex", "/a", []byte("Value_A"))
+	nabiaDB.DeleteNS("globex", "/a")
+	expected := nabiaDB.NamespaceStats("acme")
+	if err := nabiaDB.Stop(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+
+	// Loading isn't counted as writing
+	expected.Writes = 0
+	for name, loaded := range map[string]func() (*NabiaDB, error){
+		"loaded": func() (*NabiaDB, error) { return NabiaDBFromFile(location) },
+		"cloned": func() (*NabiaDB, error) { return nabiaDB.Clone(), nil },
+	} {
+		db, err := loaded()
+		if err != nil {
+			t.Fatalf("Failed to load NabiaDB: %s", err)
+		}
+		if stats := db.NamespaceStats("acme"); stats != expected {
+			t.Errorf("Unexpected stats of acme once %s: got %+v, expected %+v", name, stats, expected)
+		}
+		if namespaces := db.Namespaces(); !reflect.DeepEqual(namespaces, []string{"acme"}) {
+			t.Errorf("Unexpected namespaces once %s: %q", name, namespaces)
+		}
+		db.Stop()
+	}
+}
@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// Quota bounds the keys of a namespace, as counted by NamespaceStats: their
+// number, and their size in bytes, keys included. Zero fields are unbounded.
+type Quota struct {
+	MaxKeys  int64
+	MaxBytes int64
+}
+
+// ErrQuotaExceeded is returned, wrapped, by writes which would take a
+// namespace beyond its quota.
+var ErrQuotaExceeded = errors.New("namespace quota exceeded")
+
+// SetNamespaceQuota bounds the keys of namespace to quota, so that one
+// namespace can't take up the whole database: writes which would exceed it
+// fail with ErrQuotaExceeded, while other namespaces keep working. Unlike
+// SetMaxKeys and SetMaxMemory, nothing is ever evicted, so a namespace already
+// beyond its quota only accepts the writes shrinking it. The empty namespace
+// sets the default quota, of the namespaces without one of their own. Writes
+// are serialized while a quota is set, so that concurrent writes can't exceed
+// it together. It must be set before the database is in use.
+func (ns *NabiaDB) SetNamespaceQuota(namespace string, quota Quota) error {
+	if namespace != "" {
+		if err := checkNamespace(namespace); err != nil {
+			return err
+		}
+	}
+	if quota.MaxKeys < 0 || quota.MaxBytes < 0 {
+		return fmt.Errorf("quota cannot be negative")
+	}
+	if ns.internals.quotas == nil {
+		ns.internals.quotas = make(map[string]Quota)
+	}
+	ns.internals.quotas[namespace] = quota
+	return nil
+}
+
+// quotaOf returns the quota of namespace, and false if it is unbounded.
+func (ns *NabiaDB) quotaOf(namespace string) (Quota, bool) {
+	quota, ok := ns.internals.quotas[namespace]
+	if !ok {
+		quota = ns.internals.quotas[""]
+	}
+	return quota, quota.MaxKeys > 0 || quota.MaxBytes > 0
+}
+
+// checkQuota fails with ErrQuotaExceeded if adding keys keys and bytes bytes
+// to the namespace of key, if it has one, would take it beyond its quota.
+// Either may be negative, for writes which free some room as well. It must be
+// called with writes locked, see lockWrite.
+func (ns *NabiaDB) checkQuota(key string, keys, bytes int64) error {
+	if ns.internals.quotas == nil {
+		return nil
+	}
+	namespace, _, ok := splitNamespace(key)
+	if !ok {
+		return nil
+	}
+	quota, bounded := ns.quotaOf(namespace)
+	if !bounded {
+		return nil
+	}
+	var size, memory int64
+	if value, ok := ns.internals.namespaces.Load(namespace); ok {
+		m := value.(*namespaceMetrics)
+		size, memory = atomic.LoadInt64(&m.size), atomic.LoadInt64(&m.memory)
+	}
+	// Writes which don't grow the namespace are always allowed
+	if quota.MaxKeys > 0 && keys > 0 && size+keys > quota.MaxKeys {
+		return fmt.Errorf("%w: namespace %q is limited to %d keys", ErrQuotaExceeded, namespace, quota.MaxKeys)
+	}
+	if quota.MaxBytes > 0 && bytes > 0 && memory+bytes > quota.MaxBytes {
+		return fmt.Errorf("%w: namespace %q is limited to %d bytes", ErrQuotaExceeded, namespace, quota.MaxBytes)
+	}
+	return nil
+}
+
+// checkStore fails with ErrQuotaExceeded if storing value under key, in place
+// of current, which is nil for a new key, would exceed the quota of its
+// namespace.
+func (ns *NabiaDB) checkStore(key string, value []byte, current *entry) error {
+	keys, bytes := int64(1), int64(len(key)+len(value))
+	if current != nil {
+		keys, bytes = 0, bytes-current.size(key)
+	}
+	return ns.checkQuota(key, keys, bytes)
+}
+
+// checkMove is checkStore for Move, which frees the room of src, holding
+// source, when it is in the same namespace as dst, which holds current.
+func (ns *NabiaDB) checkMove(src, dst string, source, current *entry) error {
+	keys, bytes := int64(1), int64(len(dst)+len(source.data))
+	if current != nil {
+		keys, bytes = 0, bytes-current.size(dst)
+	}
+	srcNamespace, _, inNamespace := splitNamespace(src)
+	if dstNamespace, _, ok := splitNamespace(dst); inNamespace && ok && srcNamespace == dstNamespace {
+		keys, bytes = keys-1, bytes-source.size(src)
+	}
+	return ns.checkQuota(dst, keys, bytes)
+}
@@ -0,0 +1,72 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNamespaceQuota(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	if err := nabiaDB.SetNamespaceQuota("acme", Quota{MaxKeys: 2}); err != nil {
+		t.Fatalf("Failed to set a quota: %s", err)
+	}
+
+	// acme is full once it holds two keys, while globex is unbounded
+	nabiaDB.WriteNS("acme", "/a", []byte("Value_A"))
+	nabiaDB.WriteNS("acme", "/b", []byte("Value_B"))
+	if err := nabiaDB.WriteNS("acme", "/c", []byte("Value_C")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if stats := nabiaDB.NamespaceStats("acme"); stats.Size != 2 || stats.Writes != 2 {
+		t.Errorf("A refused write was counted: %+v", stats)
+	}
+	for _, key := range []string{"/a", "/b", "/c"} {
+		if err := nabiaDB.WriteNS("globex", key, []byte("Value")); err != nil {
+			t.Errorf("acme's quota applied to globex: %s", err)
+		}
+	}
+	if err := nabiaDB.Write("/c", []byte("Value")); err != nil {
+		t.Errorf("acme's quota applied outside of namespaces: %s", err)
+	}
+
+	// Overwrites and moves within acme don't grow it, and deletes free room
+	if err := nabiaDB.WriteNS("acme", "/a", []byte("Value_AA")); err != nil {
+		t.Errorf("Failed to overwrite within the quota: %s", err)
+	}
+	if err := nabiaDB.Move(NamespaceKey("acme", "/a"), NamespaceKey("acme", "/c"), false); err != nil {
+		t.Errorf("Failed to move within the quota: %s", err)
+	}
+	if err := nabiaDB.Copy(NamespaceKey("globex", "/a"), NamespaceKey("acme", "/d"), false); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded for a copy, got %v", err)
+	}
+	if _, err := nabiaDB.Increment(NamespaceKey("acme", "/counter"), 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded for an increment, got %v", err)
+	}
+	nabiaDB.DeleteNS("acme", "/b")
+	if err := nabiaDB.WriteNS("acme", "/d", []byte("Value_D")); err != nil {
+		t.Errorf("A delete didn't free room: %s", err)
+	}
+
+	// The default quota applies to the namespaces without one of their own
+	nabiaDB.SetNamespaceQuota("", Quota{MaxBytes: int64(len(NamespaceKey("initech", "/a")) + 8)})
+	if err := nabiaDB.WriteNS("initech", "/a", []byte("12345678")); err != nil {
+		t.Errorf("Failed to write within the default quota: %s", err)
+	}
+	if err := nabiaDB.WriteNS("initech", "/a", []byte("123456789")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded beyond the default quota, got %v", err)
+	}
+	if err := nabiaDB.WriteNS("initech", "/a", []byte("1234")); err != nil {
+		t.Errorf("Failed to shrink a key: %s", err)
+	}
+	if err := nabiaDB.WriteNS("acme", "/e", []byte("Value_E")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("The default quota replaced acme's: %v", err)
+	}
+
+	if err := nabiaDB.SetNamespaceQuota("acme", Quota{MaxKeys: -1}); err == nil {
+		t.Error("A negative quota was accepted")
+	}
+	if err := nabiaDB.SetNamespaceQuota("a"+namespaceSeparator+"b", Quota{}); !errors.Is(err, ErrNamespaceInvalid) {
+		t.Errorf("Expected ErrNamespaceInvalid, got %v", err)
+	}
+}
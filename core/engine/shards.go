@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"fmt"
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// shard holds the keys of the store hashing to it, along with their number
+// and size, so that writes to different shards never update the same
+// counters.
+type shard struct {
+	sync.Map
+	size   int64
+	memory int64    // sum of the sizes of the entries, see entry.size
+	_      [48]byte // keeps the counters of neighbouring shards off the same cache line
+}
+
+// store is the map of a database, split in shards selected by a hash of the
+// keys. Its methods are those of sync.Map, routed to the shard of the key.
+type store struct {
+	shards []shard
+	seed   maphash.Seed
+}
+
+// defaultShards is the number of shards of a new database, unless changed
+// with SetShards: one per CPU usable at once, as there can't be more writes
+// contending than that.
+func defaultShards() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// newStore returns an empty store of n shards.
+func newStore(n int) *store {
+	return &store{shards: make([]shard, n), seed: maphash.MakeSeed()}
+}
+
+// shard returns the shard holding key.
+func (s *store) shard(key string) *shard {
+	if len(s.shards) == 1 {
+		return &s.shards[0]
+	}
+	return &s.shards[maphash.String(s.seed, key)%uint64(len(s.shards))]
+}
+
+func (s *store) Load(key string) (interface{}, bool) {
+	return s.shard(key).Load(key)
+}
+
+func (s *store) Store(key string, value interface{}) {
+	s.shard(key).Store(key, value)
+}
+
+func (s *store) LoadOrStore(key string, value interface{}) (interface{}, bool) {
+	return s.shard(key).LoadOrStore(key, value)
+}
+
+func (s *store) LoadAndDelete(key string) (interface{}, bool) {
+	return s.shard(key).LoadAndDelete(key)
+}
+
+func (s *store) Swap(key string, value interface{}) (interface{}, bool) {
+	return s.shard(key).Swap(key, value)
+}
+
+func (s *store) CompareAndSwap(key string, old, new interface{}) bool {
+	return s.shard(key).CompareAndSwap(key, old, new)
+}
+
+func (s *store) CompareAndDelete(key string, old interface{}) bool {
+	return s.shard(key).CompareAndDelete(key, old)
+}
+
+// Range calls f on every key of every shard, one shard after the other, until
+// f returns false. As with sync.Map, it isn't a consistent point in time.
+func (s *store) Range(f func(key, value interface{}) bool) {
+	for i := range s.shards {
+		stopped := false
+		s.shards[i].Range(func(key, value interface{}) bool {
+			if !f(key, value) {
+				stopped = true
+			}
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// addSize adds delta to the number of keys of the shard of key.
+func (s *store) addSize(key string, delta int64) {
+	atomic.AddInt64(&s.shard(key).size, delta)
+}
+
+// addMemory adds delta to the size of the entries of the shard of key.
+func (s *store) addMemory(key string, delta int64) {
+	atomic.AddInt64(&s.shard(key).memory, delta)
+}
+
+// size returns the number of keys of the store, summed over its shards.
+func (s *store) size() int64 {
+	var size int64
+	for i := range s.shards {
+		size += atomic.LoadInt64(&s.shards[i].size)
+	}
+	return size
+}
+
+// memory returns the size of the entries of the store, summed over its
+// shards.
+func (s *store) memory() int64 {
+	var memory int64
+	for i := range s.shards {
+		memory += atomic.LoadInt64(&s.shards[i].memory)
+	}
+	return memory
+}
+
+// Shards returns the number of shards the keys are split in.
+func (ns *NabiaDB) Shards() int {
+	return len(ns.records().shards)
+}
+
+// SetShards splits the keys in n shards, selected by a hash of the keys, so
+// that concurrent writes to different keys seldom touch the same map and
+// counters. The default is one shard per CPU. Existing keys are moved to
+// their new shards while writes wait, so it is best called right after the
+// database is opened.
+func (ns *NabiaDB) SetShards(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("shards must be positive, got %d", n)
+	}
+	ns.internals.barrier.Lock()
+	defer ns.internals.barrier.Unlock()
+	current := ns.records()
+	if len(current.shards) == n {
+		return nil
+	}
+	next := newStore(n)
+	current.Range(func(key, value interface{}) bool {
+		k, e := key.(string), value.(*entry)
+		next.Store(k, e)
+		next.addSize(k, 1)
+		next.addMemory(k, e.size(k))
+		return true
+	})
+	ns.shards.Store(next)
+	return nil
+}
+
+// records returns the store holding the keys.
+func (ns *NabiaDB) records() *store {
+	return ns.shards.Load()
+}
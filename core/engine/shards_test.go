@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	if shards := nabiaDB.Shards(); shards != defaultShards() {
+		t.Errorf("Unexpected default number of shards: got %d, expected %d", shards, defaultShards())
+	}
+	if err := nabiaDB.SetShards(0); err == nil {
+		t.Error("0 shards were accepted")
+	}
+
+	var memory int64
+	for i := 0; i < 1000; i++ {
+		key, value := fmt.Sprintf("/key/%d", i), []byte(fmt.Sprintf("Value_%d", i))
+		nabiaDB.Write(key, value)
+		memory += int64(len(key) + len(value))
+	}
+	for _, n := range []int{16, 1, 7} {
+		if err := nabiaDB.SetShards(n); err != nil {
+			t.Fatalf("Failed to set %d shards: %s", n, err)
+		}
+		if shards := nabiaDB.Shards(); shards != n {
+			t.Errorf("Unexpected number of shards: got %d, expected %d", shards, n)
+		}
+		stats := nabiaDB.Stats()
+		if stats.Size != 1000 || stats.Memory != memory {
+			t.Errorf("Unexpected stats with %d shards: %d keys of %d bytes, expected 1000 of %d", n, stats.Size, stats.Memory, memory)
+		}
+		if keys := nabiaDB.Keys("/key/99"); len(keys) != 11 {
+			t.Errorf("Unexpected keys with %d shards: %q", n, keys)
+		}
+		for i := 0; i < 1000; i += 111 {
+			key := fmt.Sprintf("/key/%d", i)
+			if value, err := nabiaDB.Read(key); err != nil || string(value) != fmt.Sprintf("Value_%d", i) {
+				t.Errorf("Key %q was lost with %d shards: %q (%v)", key, n, value, err)
+			}
+		}
+	}
+
+	// The keys are spread over the shards, and counted where they land
+	if err := nabiaDB.Delete("/key/0"); err != nil {
+		t.Fatalf("Failed to delete: %s", err)
+	}
+	store := nabiaDB.records()
+	for i := range store.shards {
+		if size := atomic.LoadInt64(&store.shards[i].size); size == 0 || size > 500 {
+			t.Errorf("Shard %d holds %d keys of 999", i, size)
+		}
+	}
+	if size := nabiaDB.Stats().Size; size != 999 {
+		t.Errorf("Unexpected size after a delete: got %d, expected 999", size)
+	}
+}
+
+// benchmarkWrites writes and reads keys from every goroutine of the
+// benchmark, in a database of the given number of shards.
+func benchmarkWrites(b *testing.B, shards int) {
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	if err := nabiaDB.SetShards(shards); err != nil {
+		b.Fatal(err)
+	}
+	value := []byte("Value")
+	var goroutines int64
+	b.RunParallel(func(pb *testing.PB) {
+		prefix := fmt.Sprintf("/%d/", atomic.AddInt64(&goroutines, 1))
+		for i := 0; pb.Next(); i++ {
+			key := prefix + fmt.Sprint(i%1024)
+			nabiaDB.Write(key, value)
+			nabiaDB.Read(key)
+		}
+	})
+}
+
+// The single shard stands for the map of the database before it was sharded.
+func BenchmarkWritesSingleShard(b *testing.B) { benchmarkWrites(b, 1) }
+func BenchmarkWritesSharded(b *testing.B)     { benchmarkWrites(b, 16) }
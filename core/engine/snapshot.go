@@ -0,0 +1,231 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// snapshotMagic starts every snapshot, followed by a byte holding the version
+// of the layout of the rest of the file, so that loadFromFile can tell layouts
+// apart and migrate older ones. Snapshots saved before the header existed are
+// of version 0, and start right away with a gob stream, which can't begin with
+// snapshotMagic.
+//
+// Versions 0 and 1 hold a gob encoded map[string]NabiaRecord, and are only
+// read anymore: the next snapshot of a database loaded from one of them is of
+// the current version. Version 2 is independent of Go, so that snapshots can
+// be read by other tools. After the header come the number of records as a
+// uvarint, then every record: the length of the key as a uvarint and the key,
+// the length of the value as a uvarint and the value, then the expiry time (0
+// when the key doesn't expire), the creation time and the modification time
+// of the key, in Unix nanoseconds as big-endian int64s. Values are stored as
+// given to the engine, so the records of the server keep their own framing,
+// see the record package. The snapshot ends with the CRC-32 of everything
+// after the header, as a big-endian uint32.
+const (
+	snapshotMagic   = "NABIADB"
+	snapshotVersion = 2
+)
+
+// readSnapshotHeader consumes the header of a snapshot, if it has one, and
+// returns its version.
+func readSnapshotHeader(reader *bufio.Reader) (byte, error) {
+	magic, err := reader.Peek(len(snapshotMagic))
+	if err != nil || string(magic) != snapshotMagic {
+		return 0, nil // left for the decoder, which reports truncated files
+	}
+	reader.Discard(len(snapshotMagic))
+	version, err := reader.ReadByte()
+	if err != nil {
+		return 0, fmt.Errorf("reading the version of a snapshot: %w", err)
+	}
+	if version > snapshotVersion {
+		return 0, fmt.Errorf("snapshot of version %d is newer than supported, up to %d", version, snapshotVersion)
+	}
+	return version, nil
+}
+
+// writeSnapshot writes a snapshot of the current version holding entries.
+func writeSnapshot(w io.Writer, entries map[string]*entry) error {
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{snapshotVersion}); err != nil {
+		return err
+	}
+	checksum := crc32.NewIEEE()
+	w = io.MultiWriter(w, checksum)
+	if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(entries)))); err != nil {
+		return err
+	}
+	var record []byte
+	for key, e := range entries {
+		record = binary.AppendUvarint(record[:0], uint64(len(key)))
+		record = append(record, key...)
+		record = binary.AppendUvarint(record, uint64(len(e.data)))
+		record = append(record, e.data...)
+		var nanos int64
+		if !e.expiresAt.IsZero() {
+			nanos = e.expiresAt.UnixNano()
+		}
+		record = binary.BigEndian.AppendUint64(record, uint64(nanos))
+		record = binary.BigEndian.AppendUint64(record, uint64(e.createdAt.UnixNano()))
+		record = binary.BigEndian.AppendUint64(record, uint64(e.modifiedAt.UnixNano()))
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, checksum.Sum32()))
+	return err
+}
+
+// writeCompressedSnapshot writes a snapshot holding entries, gzipped if
+// compress is set, see decompress.
+func writeCompressedSnapshot(w io.Writer, entries map[string]*entry, compress bool) error {
+	if !compress {
+		return writeSnapshot(w, entries)
+	}
+	gz := gzip.NewWriter(w)
+	if err := writeSnapshot(gz, entries); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// gzipMagic starts every gzip stream, which neither snapshotMagic nor the gob
+// streams of version 0 can start with, so compressed snapshots are told apart
+// by it.
+const gzipMagic = "\x1f\x8b"
+
+// decompress returns a reader of the snapshot read by reader, decompressing
+// it if it is gzipped, see SetCompression.
+func decompress(reader *bufio.Reader) (*bufio.Reader, error) {
+	magic, err := reader.Peek(len(gzipMagic))
+	if err != nil || string(magic) != gzipMagic {
+		return reader, nil // left for the decoder, which reports truncated files
+	}
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing a snapshot: %w", err)
+	}
+	return bufio.NewReader(gz), nil
+}
+
+// readSnapshot decodes the records of a snapshot of the given version, its
+// header already consumed.
+func readSnapshot(reader *bufio.Reader, version byte) (map[string]NabiaRecord, error) {
+	data := make(map[string]NabiaRecord)
+	if version < 2 {
+		// Versions 0 and 1 share the same layout, the header excepted
+		if err := gob.NewDecoder(reader).Decode(&data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	body := &checksumReader{reader: reader, checksum: crc32.NewIEEE()}
+	count, err := binary.ReadUvarint(body)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	times := make([]byte, 24)
+	for i := uint64(0); i < count; i++ {
+		key, err := readSnapshotField(body)
+		if err != nil {
+			return nil, truncated(err)
+		}
+		value, err := readSnapshotField(body)
+		if err != nil {
+			return nil, truncated(err)
+		}
+		if _, err := io.ReadFull(body, times); err != nil {
+			return nil, truncated(err)
+		}
+		record := NabiaRecord{
+			RawData:    value,
+			CreatedAt:  time.Unix(0, int64(binary.BigEndian.Uint64(times[8:]))),
+			ModifiedAt: time.Unix(0, int64(binary.BigEndian.Uint64(times[16:]))),
+		}
+		if nanos := int64(binary.BigEndian.Uint64(times)); nanos != 0 {
+			record.ExpiresAt = time.Unix(0, nanos)
+		}
+		data[string(key)] = record
+	}
+	trailer := make([]byte, crc32.Size)
+	if _, err := io.ReadFull(reader, trailer); err != nil {
+		return nil, truncated(err)
+	}
+	if binary.BigEndian.Uint32(trailer) != body.checksum.Sum32() {
+		return nil, fmt.Errorf("snapshot is corrupted: checksum mismatch")
+	}
+	return data, nil
+}
+
+// fieldReader is what length-prefixed fields are read from: a checksumReader
+// for snapshots, or the bufio.Reader of the write-ahead log.
+type fieldReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readSnapshotField reads a field prefixed by its length. Fields longer than
+// snapshotChunk grow as they are read, so a corrupted length fails on the end
+// of the file rather than on allocating it all.
+func readSnapshotField(reader fieldReader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length <= snapshotChunk {
+		field := make([]byte, length)
+		_, err := io.ReadFull(reader, field)
+		return field, err
+	}
+	var field bytes.Buffer
+	if n, err := io.Copy(&field, io.LimitReader(reader, int64(min(length, math.MaxInt64)))); err != nil {
+		return nil, err
+	} else if uint64(n) != length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return field.Bytes(), nil
+}
+
+// snapshotChunk is the length up to which fields are allocated at once.
+const snapshotChunk = 1 << 20
+
+// checksumReader hashes the bytes read through it.
+type checksumReader struct {
+	reader   *bufio.Reader
+	checksum hash.Hash32
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.checksum.Write(p[:n])
+	return n, err
+}
+
+func (cr *checksumReader) ReadByte() (byte, error) {
+	b, err := cr.reader.ReadByte()
+	if err == nil {
+		cr.checksum.Write([]byte{b})
+	}
+	return b, err
+}
+
+// truncated reports the end of a snapshot in the middle of a record as such.
+func truncated(err error) error {
+	if ignoreTruncation(err) == nil {
+		return fmt.Errorf("snapshot is truncated")
+	}
+	return err
+}
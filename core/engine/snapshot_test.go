@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	created := time.Date(2024, 2, 9, 21, 5, 23, 0, time.UTC)
+	modified := created.Add(time.Hour)
+	expires := time.Now().Add(time.Hour)
+	entries := map[string]*entry{
+		"plain":    {data: []byte("Value"), createdAt: created, modifiedAt: modified},
+		"expiring": {data: []byte("Value"), expiresAt: expires, createdAt: created, modifiedAt: modified},
+		"binary":   {data: []byte{0, 1, 2, 0xFF}, createdAt: created, modifiedAt: modified},
+		"empty":    {data: []byte{}, createdAt: created, modifiedAt: modified},
+		"":         {data: []byte("empty key"), createdAt: created, modifiedAt: modified},
+		"long":     {data: bytes.Repeat([]byte("x"), snapshotChunk+1), createdAt: created, modifiedAt: modified},
+	}
+	var buffer bytes.Buffer
+	if err := writeSnapshot(&buffer, entries); err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+	snapshot := buffer.Bytes()
+
+	reader := bufio.NewReader(bytes.NewReader(snapshot))
+	version, err := readSnapshotHeader(reader)
+	if err != nil || version != snapshotVersion {
+		t.Fatalf("Unexpected header: version %d (%v)", version, err)
+	}
+	data, err := readSnapshot(reader, version)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %s", err)
+	}
+	if len(data) != len(entries) {
+		t.Errorf("Unexpected number of records: got %d, expected %d", len(data), len(entries))
+	}
+	for key, e := range entries {
+		record, ok := data[key]
+		if !ok || !bytes.Equal(record.RawData, e.data) || !record.ExpiresAt.Equal(e.expiresAt) ||
+			!record.CreatedAt.Equal(e.createdAt) || !record.ModifiedAt.Equal(e.modifiedAt) {
+			t.Errorf("Record %q changed by a round trip: got %+v", key, record)
+		}
+	}
+
+	// Truncation and corruption past the header are detected
+	for _, corrupted := range [][]byte{
+		snapshot[:len(snapshot)-1],
+		snapshot[:len(snapshot)/2],
+		snapshot[:len(snapshotMagic)+1],
+		append(bytes.Clone(snapshot[:len(snapshot)-5]), snapshot[len(snapshot)-5]^0x10, 0, 0, 0, 0),
+	} {
+		reader := bufio.NewReader(bytes.NewReader(corrupted))
+		version, _ := readSnapshotHeader(reader)
+		if _, err := readSnapshot(reader, version); err == nil {
+			t.Errorf("Corrupted snapshot of %d bytes was accepted", len(corrupted))
+		}
+	}
+	flipped := bytes.Clone(snapshot)
+	flipped[len(snapshot)/2] ^= 0x10
+	reader = bufio.NewReader(bytes.NewReader(flipped))
+	readSnapshotHeader(reader)
+	if _, err := readSnapshot(reader, snapshotVersion); err == nil {
+		t.Error("A flipped bit went undetected")
+	}
+}
+
+func TestSnapshotEmpty(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := writeSnapshot(&buffer, nil); err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+	reader := bufio.NewReader(&buffer)
+	version, _ := readSnapshotHeader(reader)
+	if data, err := readSnapshot(reader, version); err != nil || len(data) != 0 {
+		t.Errorf("Unexpected records in an empty snapshot: %v (%v)", data, err)
+	}
+}
+
+func TestSnapshotImportGob(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "legacy.db")
+	expires := time.Now().Add(time.Hour).Round(0)
+	created := time.Date(2024, 2, 9, 21, 5, 23, 0, time.UTC)
+	var buffer bytes.Buffer
+	buffer.WriteString(snapshotMagic)
+	buffer.WriteByte(1)
+	gob.NewEncoder(&buffer).Encode(map[string]NabiaRecord{
+		"A": {RawData: []byte("Value_A"), CreatedAt: created, ModifiedAt: created},
+		"B": {RawData: []byte("Value_B"), ExpiresAt: expires, CreatedAt: created, ModifiedAt: created},
+	})
+	if err := os.WriteFile(location, buffer.Bytes(), 0600); err != nil {
+		t.Fatalf("Failed to write legacy snapshot: %s", err)
+	}
+
+	// Loading the gob snapshot and saving it migrates it to the current format
+	nabiaDB, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("Failed to load legacy snapshot: %s", err)
+	}
+	if err := nabiaDB.Stop(); err != nil {
+		t.Fatalf("Failed to save NabiaDB: %s", err)
+	}
+	migrated, _ := os.ReadFile(location)
+	if !bytes.HasPrefix(migrated, append([]byte(snapshotMagic), snapshotVersion)) {
+		t.Fatalf("The snapshot wasn't migrated: %q", migrated[:min(len(migrated), 16)])
+	}
+	if bytes.Contains(migrated, []byte("NabiaRecord")) {
+		t.Error("The migrated snapshot still holds gob type information")
+	}
+
+	reloaded, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("Failed to load migrated snapshot: %s", err)
+	}
+	defer reloaded.Stop()
+	a, err := reloaded.ReadRecord("A")
+	if err != nil || string(a.RawData) != "Value_A" || !a.ExpiresAt.IsZero() || !a.CreatedAt.Equal(created) {
+		t.Errorf("Unexpected record A after migration: %+v (%v)", a, err)
+	}
+	b, err := reloaded.ReadRecord("B")
+	if err != nil || string(b.RawData) != "Value_B" || !b.ExpiresAt.Equal(expires) || !b.ModifiedAt.Equal(created) {
+		t.Errorf("Unexpected record B after migration: %+v (%v)", b, err)
+	}
+
+	// A gob stream under the header of the current version is refused
+	buffer.Bytes()[len(snapshotMagic)] = snapshotVersion
+	os.WriteFile(location, buffer.Bytes(), 0600)
+	if _, err := NabiaDBFromFile(location); err == nil || !strings.Contains(err.Error(), "version 2") {
+		t.Errorf("Unexpected error loading gob as version 2: %v", err)
+	}
+}
+
+func TestSnapshotCompression(t *testing.T) {
+	fastKDF(t)
+	dir := t.TempDir()
+	nabiaDB := NewInMemoryNabiaDB()
+	defer nabiaDB.Stop()
+	for i := 0; i < 1000; i++ {
+		nabiaDB.Write(fmt.Sprintf("/text/%d", i), []byte(strings.Repeat(fmt.Sprintf("Line %d of a text-heavy dataset. ", i%10), 20)))
+	}
+	saved := map[string]int64{}
+	for _, name := range []string{"plain.db", "compressed.db", "encrypted.db"} {
+		location := filepath.Join(dir, name)
+		nabiaDB.SetCompression(name != "plain.db")
+		if name == "encrypted.db" {
+			nabiaDB.SetEncryptionPassphrase("passphrase")
+		}
+		if err := nabiaDB.SaveToFile(location); err != nil {
+			t.Fatalf("Failed to save %s: %s", name, err)
+		}
+		loaded, err := loadFromFile(location, "passphrase")
+		if err != nil {
+			t.Fatalf("Failed to load %s: %s", name, err)
+		}
+		loaded.SetCompression(false)
+		loaded.SetEncryptionPassphrase("")
+		if stats := loaded.Stats(); stats.Size != 1000 || stats.Memory != nabiaDB.Stats().Memory {
+			t.Errorf("Unexpected stats of %s: %d keys of %d bytes", name, stats.Size, stats.Memory)
+		}
+		if value, err := loaded.Read("/text/7"); err != nil || !bytes.HasPrefix(value, []byte("Line 7 of")) {
+			t.Errorf("Unexpected value in %s: %q (%v)", name, value, err)
+		}
+		info, _ := os.Stat(location)
+		if loaded.Stats().DiskSize != info.Size() {
+			t.Errorf("Unexpected disk size of %s: got %d, expected %d", name, loaded.Stats().DiskSize, info.Size())
+		}
+		saved[name] = info.Size()
+		loaded.Stop()
+	}
+	if saved["compressed.db"]*4 > saved["plain.db"] || saved["encrypted.db"]*4 > saved["plain.db"] {
+		t.Errorf("The snapshots weren't compressed: %v", saved)
+	}
+	if nabiaDB.Stats().DiskSize != 0 {
+		t.Error("Saving elsewhere than the location changed the disk size")
+	}
+
+	// Saving to the location records the size of the snapshot
+	location := filepath.Join(dir, "located.db")
+	located, _ := NewNabiaDB(location)
+	located.SetCompression(true)
+	located.Write("Key", []byte("Value"))
+	if err := located.Save(); err != nil {
+		t.Fatalf("Failed to save: %s", err)
+	}
+	info, _ := os.Stat(location)
+	if located.Stats().DiskSize != info.Size() {
+		t.Errorf("Unexpected disk size after a save: got %d, expected %d", located.Stats().DiskSize, info.Size())
+	}
+	located.Stop()
+
+	// A truncated compressed snapshot is reported
+	compressed, _ := os.ReadFile(filepath.Join(dir, "compressed.db"))
+	os.WriteFile(location, compressed[:len(compressed)/2], 0600)
+	if _, err := NabiaDBFromFile(location); err == nil {
+		t.Error("A truncated compressed snapshot was accepted")
+	}
+}
@@ -0,0 +1,416 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy controls when the write-ahead log and snapshots are flushed to
+// stable storage.
+type FsyncPolicy int
+
+const (
+	// FsyncOS leaves flushing to the operating system. It is the fastest
+	// policy, but writes acknowledged shortly before a power loss or a kernel
+	// crash may be lost. A crash of the process alone loses nothing.
+	FsyncOS FsyncPolicy = iota
+	// FsyncAlways flushes the log after every write, before it is
+	// acknowledged, so no acknowledged write is ever lost. Every write pays
+	// for a full fsync.
+	FsyncAlways
+	// FsyncInterval flushes the log periodically, batching the writes made in
+	// between. On power loss at most one interval worth of writes is lost.
+	FsyncInterval
+)
+
+// ParseFsyncPolicy converts the configuration values "always", "interval" and
+// "os" into a FsyncPolicy.
+func ParseFsyncPolicy(policy string) (FsyncPolicy, error) {
+	switch policy {
+	case "always":
+		return FsyncAlways, nil
+	case "interval":
+		return FsyncInterval, nil
+	case "os":
+		return FsyncOS, nil
+	default:
+		return FsyncOS, fmt.Errorf("unknown fsync policy %q, expected \"always\", \"interval\" or \"os\"", policy)
+	}
+}
+
+// syncer is implemented by files which can be flushed to stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// Operations recorded in the write-ahead log.
+const (
+	walStore        byte = 'S' // written before timestamps were recorded
+	walStoreStamped byte = 'T'
+	walDelete       byte = 'D'
+)
+
+// wal is an append-only log of every mutation made since the last snapshot.
+// Each record is an operation byte followed by the length-prefixed key and,
+// for stores, the length-prefixed data and the expiry time in Unix
+// nanoseconds (0 when the key doesn't expire), then, in walStoreStamped
+// records, the creation and modification times in Unix nanoseconds. Lengths
+// are uvarints.
+type wal struct {
+	mu     sync.Mutex // held while mutating the map, so the log keeps its order
+	file   *os.File
+	syncer syncer
+	policy FsyncPolicy
+	dirty  bool  // written since the last sync
+	size   int64 // length of the log, in bytes
+	// saveMu is held by the saves to the location, which empty the log, so
+	// that they complete in the order they started
+	saveMu sync.Mutex
+	// compactBytes is how much the log may grow before compactWAL saves a
+	// snapshot, 0 for never; compactFrom is the length it grows from
+	compactBytes int64
+	compactFrom  int64
+	compacting   bool
+	compactions  sync.WaitGroup
+}
+
+// walLocation returns the location of the write-ahead log of a database.
+func walLocation(location string) string {
+	return location + ".wal"
+}
+
+// EnableWAL makes the database record every mutation in a write-ahead log next
+// to its location, so writes made after the last snapshot survive a crash. An
+// existing log is replayed first, which is how a database recovers: load the
+// snapshot with NabiaDBFromFile, then enable the log. The log is emptied every
+// time a snapshot is saved. The policy decides when the log is fsynced;
+// interval is only used by FsyncInterval. It fails with ErrEncryptedWAL for
+// encrypted databases, see SetEncryptionPassphrase.
+func (ns *NabiaDB) EnableWAL(policy FsyncPolicy, interval time.Duration) error {
+	if ns.internals.location == "" {
+		return fmt.Errorf("location cannot be empty")
+	}
+	if ns.internals.encryption != nil {
+		return ErrEncryptedWAL
+	}
+	if ns.internals.wal != nil {
+		return fmt.Errorf("write-ahead log is already enabled")
+	}
+	if policy == FsyncInterval && interval <= 0 {
+		return fmt.Errorf("fsync interval must be positive")
+	}
+	mode := ns.internals.fileMode
+	if mode == 0 {
+		mode = 0666
+	}
+	file, err := os.OpenFile(walLocation(ns.internals.location), os.O_CREATE|os.O_RDWR|os.O_APPEND, mode)
+	if err != nil {
+		return err
+	}
+	if ns.internals.fileMode != 0 { // also applies to an existing log, and regardless of the umask
+		if err := file.Chmod(mode); err != nil {
+			file.Close()
+			return fmt.Errorf("setting the mode of the write-ahead log: %w", err)
+		}
+	}
+	if err := ns.replayWAL(file); err != nil {
+		file.Close()
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	ns.internals.wal = &wal{file: file, syncer: file, policy: policy, size: info.Size()}
+	if policy != FsyncOS {
+		// Emptying the log is only safe once the snapshot is durable
+		ns.internals.syncSnapshot = func(s syncer) error { return s.Sync() }
+	}
+	if policy == FsyncInterval {
+		go ns.syncWALEvery(interval)
+	}
+	return nil
+}
+
+// replayWAL applies the records of a log to the map. A truncated last record,
+// left by a crash in the middle of an append, is ignored.
+func (ns *NabiaDB) replayWAL(file *os.File) error {
+	reader := bufio.NewReader(file)
+	now := time.Now()
+	for {
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		key, err := readWALBytes(reader)
+		if err != nil {
+			return ignoreTruncation(err)
+		}
+		switch op {
+		case walStore, walStoreStamped:
+			data, err := readWALBytes(reader)
+			if err != nil {
+				return ignoreTruncation(err)
+			}
+			times := make([]byte, 8, 24)
+			if op == walStoreStamped {
+				times = times[:24]
+			}
+			if _, err := io.ReadFull(reader, times); err != nil {
+				return ignoreTruncation(err)
+			}
+			e := &entry{data: data, createdAt: now, modifiedAt: now}
+			if nanos := int64(binary.BigEndian.Uint64(times)); nanos != 0 {
+				e.expiresAt = time.Unix(0, nanos)
+			}
+			if op == walStoreStamped {
+				e.createdAt = time.Unix(0, int64(binary.BigEndian.Uint64(times[8:])))
+				e.modifiedAt = time.Unix(0, int64(binary.BigEndian.Uint64(times[16:])))
+			}
+			if e.expired(now) {
+				ns.replayDelete(string(key))
+			} else {
+				previous := ns.swap(string(key), e)
+				if previous == nil {
+					ns.records().addSize(string(key), 1)
+				}
+				ns.replaced(string(key), e, previous)
+			}
+		case walDelete:
+			ns.replayDelete(string(key))
+		default:
+			return fmt.Errorf("corrupted write-ahead log: unknown operation %q", op)
+		}
+	}
+}
+
+func (ns *NabiaDB) replayDelete(key string) {
+	if previous, loaded := ns.records().LoadAndDelete(key); loaded {
+		ns.records().addSize(key, -1)
+		ns.removed(key, previous.(*entry))
+	}
+}
+
+// readWALBytes reads a field of a record, like the fields of snapshots: a
+// corrupted length ends the log, as a torn record would, rather than being
+// allocated at once.
+func readWALBytes(reader *bufio.Reader) ([]byte, error) {
+	return readSnapshotField(reader)
+}
+
+func ignoreTruncation(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
+
+// lockWAL serializes mutations while the write-ahead log is enabled, so the
+// order of the log matches the order in which the map was modified. It returns
+// the function releasing the lock.
+func (ns *NabiaDB) lockWAL() func() {
+	w := ns.internals.wal
+	if w == nil {
+		return func() {}
+	}
+	w.mu.Lock()
+	return w.mu.Unlock
+}
+
+// logStore records that key now holds e. It must be called with the log
+// locked, and does nothing if the log is disabled.
+func (ns *NabiaDB) logStore(key string, e *entry) error {
+	w := ns.internals.wal
+	if w == nil {
+		return nil
+	}
+	record := binary.AppendUvarint([]byte{walStoreStamped}, uint64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendUvarint(record, uint64(len(e.data)))
+	record = append(record, e.data...)
+	var nanos int64
+	if !e.expiresAt.IsZero() {
+		nanos = e.expiresAt.UnixNano()
+	}
+	record = binary.BigEndian.AppendUint64(record, uint64(nanos))
+	record = binary.BigEndian.AppendUint64(record, uint64(e.createdAt.UnixNano()))
+	record = binary.BigEndian.AppendUint64(record, uint64(e.modifiedAt.UnixNano()))
+	if err := w.append(record); err != nil {
+		return err
+	}
+	ns.compactWAL()
+	return nil
+}
+
+// logDelete records that key was deleted. It must be called with the log
+// locked, and does nothing if the log is disabled.
+func (ns *NabiaDB) logDelete(key string) error {
+	w := ns.internals.wal
+	if w == nil {
+		return nil
+	}
+	record := binary.AppendUvarint([]byte{walDelete}, uint64(len(key)))
+	record = append(record, key...)
+	if err := w.append(record); err != nil {
+		return err
+	}
+	ns.compactWAL()
+	return nil
+}
+
+func (w *wal) append(record []byte) error {
+	n, err := w.file.Write(record)
+	w.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	w.dirty = true
+	if w.policy == FsyncAlways {
+		return w.sync()
+	}
+	return nil
+}
+
+// sync flushes the log if it was written since the last sync. It must be
+// called with the log locked.
+func (w *wal) sync() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.syncer.Sync(); err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	w.dirty = false
+	return nil
+}
+
+// syncWALEvery flushes the log every interval, until the database is stopped.
+func (ns *NabiaDB) syncWALEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w := ns.internals.wal
+			w.mu.Lock()
+			w.sync()
+			w.mu.Unlock()
+		case <-ns.internals.stop:
+			return
+		}
+	}
+}
+
+// truncateWAL drops the first offset bytes of the log, once the records they
+// hold are part of a durable snapshot. It must be called with the log locked.
+// The records appended since, while the snapshot was written, are copied to a
+// new log renamed over the old one, so that a crash leaves either of them
+// whole.
+func (ns *NabiaDB) truncateWAL(offset int64) error {
+	w := ns.internals.wal
+	if offset == w.size {
+		if err := w.file.Truncate(0); err != nil {
+			return fmt.Errorf("write-ahead log: %w", err)
+		}
+		w.size, w.compactFrom, w.dirty = 0, 0, false
+		return nil
+	}
+	tail := make([]byte, w.size-offset)
+	if _, err := w.file.ReadAt(tail, offset); err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	location := walLocation(ns.internals.location)
+	info, err := w.file.Stat()
+	if err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(location), filepath.Base(location)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	defer os.Remove(file.Name()) // only left behind if the copy failed
+	defer file.Close()
+	if err := file.Chmod(info.Mode().Perm()); err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	if _, err := file.Write(tail); err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	if w.policy != FsyncOS {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("write-ahead log: %w", err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	if err := os.Rename(file.Name(), location); err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	// Appends go to the end of the new log, as they did to the old one
+	next, err := os.OpenFile(location, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("write-ahead log: %w", err)
+	}
+	if w.syncer == syncer(w.file) {
+		w.syncer = next
+	}
+	w.file.Close()
+	w.file, w.size, w.compactFrom, w.dirty = next, int64(len(tail)), 0, false
+	return nil
+}
+
+// SetWALCompaction makes the database save a snapshot in the background, which
+// empties the write-ahead log, whenever the log has grown by n bytes, so that
+// the records of overwritten and deleted keys don't pile up in it and slow the
+// next replay down. Writes only wait while the map is copied, see saveToFile.
+// A failed compaction is tried again once the log has grown by n more bytes,
+// and the error resurfaces on the next Save or Stop. 0, the default, leaves the
+// log to the snapshots saved otherwise.
+func (ns *NabiaDB) SetWALCompaction(n int64) error {
+	w := ns.internals.wal
+	if w == nil {
+		return fmt.Errorf("write-ahead log isn't enabled")
+	}
+	if n < 0 {
+		return fmt.Errorf("compaction threshold cannot be negative")
+	}
+	unlock := ns.lockWAL()
+	defer unlock()
+	w.compactBytes = n
+	return nil
+}
+
+// compactWAL starts saving a snapshot in the background if the log has grown
+// past the threshold of SetWALCompaction, unless one is already being saved or
+// the database is stopped. It must be called with the log locked.
+func (ns *NabiaDB) compactWAL() {
+	w := ns.internals.wal
+	if w.compactBytes == 0 || w.size-w.compactFrom < w.compactBytes || w.compacting {
+		return
+	}
+	select {
+	case <-ns.internals.stop: // Stop closes it with the log locked
+		return
+	default:
+	}
+	w.compacting, w.compactFrom = true, w.size
+	w.compactions.Add(1)
+	go func() {
+		defer w.compactions.Done()
+		ns.saveToFile(ns.internals.location)
+		unlock := ns.lockWAL()
+		w.compacting = false
+		unlock()
+	}()
+}
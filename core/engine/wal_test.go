@@ -0,0 +1,361 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countingSyncer counts the fsyncs requested on the write-ahead log.
+type countingSyncer struct {
+	syncs int
+}
+
+func (cs *countingSyncer) Sync() error {
+	cs.syncs++
+	return nil
+}
+
+func TestWALReplay(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "wal.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	if err := nabiaDB.Write("Saved", []byte("Value")); err != nil {
+		t.Fatalf("Failed to write: %s", err)
+	}
+	if err := nabiaDB.saveToFile(location); err != nil {
+		t.Fatalf("failed to save NabiaDB to file: %s", err)
+	}
+	if err := nabiaDB.EnableWAL(FsyncAlways, 0); err != nil {
+		t.Fatalf("Failed to enable the write-ahead log: %s", err)
+	}
+	nabiaDB.Write("A", []byte("Value_A"))
+	nabiaDB.WriteWithTTL("B", []byte("Value_B"), time.Hour)
+	nabiaDB.Increment("Counter", 5)
+	nabiaDB.CompareAndSwap("A", []byte("Value_A"), []byte("Swapped"))
+	nabiaDB.WriteIfAbsent("C", []byte("Value_C"))
+	nabiaDB.Delete("Saved")
+	nabiaDB.Delete("C")
+	e, _ := nabiaDB.load("B")
+	expiresAt := e.expiresAt
+	a, _ := nabiaDB.load("A")
+
+	// The process crashes here: nothing written since the snapshot was saved
+	// is in it, so everything must come from the log
+	nabiaDB.internals.wal.file.Close()
+	recovered, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("failed to load NabiaDB from file: %s", err)
+	}
+	if err := recovered.EnableWAL(FsyncAlways, 0); err != nil {
+		t.Fatalf("Failed to replay the write-ahead log: %s", err)
+	}
+	defer recovered.internals.wal.file.Close()
+
+	expected := map[string]string{"A": "Swapped", "B": "Value_B", "Counter": "5"}
+	for key, value := range expected {
+		if data, err := recovered.Read(key); err != nil || string(data) != value {
+			t.Errorf("Unexpected value for %q after replay: got %q (%v), expected %q", key, data, err, value)
+		}
+	}
+	for _, key := range []string{"Saved", "C"} {
+		if recovered.Exists(key) {
+			t.Errorf("Deleted key %q was restored by the replay", key)
+		}
+	}
+	if e, ok := recovered.load("B"); !ok || !e.expiresAt.Equal(expiresAt) {
+		t.Error("TTL wasn't preserved by the replay")
+	}
+	if e, ok := recovered.load("A"); !ok || !e.createdAt.Equal(a.createdAt) || !e.modifiedAt.Equal(a.modifiedAt) {
+		t.Error("Timestamps weren't preserved by the replay")
+	}
+	if size := recovered.Stats().Size; size != int64(len(expected)) {
+		t.Errorf("Unexpected size after replay: got %d, expected %d", size, len(expected))
+	}
+}
+
+func TestWALTruncatedBySnapshot(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "wal.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	if err := nabiaDB.EnableWAL(FsyncOS, 0); err != nil {
+		t.Fatalf("Failed to enable the write-ahead log: %s", err)
+	}
+	nabiaDB.Write("A", []byte("Value_A"))
+	if info, err := os.Stat(walLocation(location)); err != nil || info.Size() == 0 {
+		t.Fatalf("Write wasn't recorded in the write-ahead log: %v", err)
+	}
+	nabiaDB.Stop()
+	if info, err := os.Stat(walLocation(location)); err != nil || info.Size() != 0 {
+		t.Errorf("Write-ahead log wasn't emptied by the snapshot: %v", err)
+	}
+
+	recovered, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("failed to load NabiaDB from file: %s", err)
+	}
+	if err := recovered.EnableWAL(FsyncOS, 0); err != nil {
+		t.Fatalf("Failed to replay the write-ahead log: %s", err)
+	}
+	defer recovered.internals.wal.file.Close()
+	if data, err := recovered.Read("A"); err != nil || !bytes.Equal(data, []byte("Value_A")) {
+		t.Errorf("Snapshot lost a write: got %q (%v)", data, err)
+	}
+}
+
+func TestWALTornRecord(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "wal.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	if err := nabiaDB.EnableWAL(FsyncOS, 0); err != nil {
+		t.Fatalf("Failed to enable the write-ahead log: %s", err)
+	}
+	nabiaDB.Write("A", []byte("Value_A"))
+	nabiaDB.Write("B", []byte("Value_B"))
+	nabiaDB.internals.wal.file.Close()
+
+	// Crash in the middle of the second append
+	info, err := os.Stat(walLocation(location))
+	if err != nil {
+		t.Fatalf("Failed to stat the write-ahead log: %s", err)
+	}
+	if err := os.Truncate(walLocation(location), info.Size()-3); err != nil {
+		t.Fatalf("Failed to truncate the write-ahead log: %s", err)
+	}
+
+	recovered := newEmptyDB()
+	recovered.internals.location = location
+	if err := recovered.EnableWAL(FsyncOS, 0); err != nil {
+		t.Fatalf("Torn record wasn't ignored: %s", err)
+	}
+	defer recovered.internals.wal.file.Close()
+	if !recovered.Exists("A") {
+		t.Error("Complete record before the torn one was lost")
+	}
+	if recovered.Exists("B") {
+		t.Error("Torn record was applied")
+	}
+}
+
+func TestWALCorruptedLength(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "wal.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	if err := nabiaDB.EnableWAL(FsyncOS, 0); err != nil {
+		t.Fatalf("Failed to enable the write-ahead log: %s", err)
+	}
+	nabiaDB.Write("A", []byte("Value_A"))
+	nabiaDB.internals.wal.file.Close()
+
+	// A record whose value claims to be longer than any file
+	for _, length := range []uint64{1 << 40, math.MaxUint64} {
+		file, err := os.OpenFile(walLocation(location), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("Failed to open the write-ahead log: %s", err)
+		}
+		record := binary.AppendUvarint([]byte{walStore}, 1)
+		record = binary.AppendUvarint(append(record, 'B'), length)
+		file.Write(append(record, "Value_B"...))
+		file.Close()
+
+		recovered := newEmptyDB()
+		recovered.internals.location = location
+		if err := recovered.EnableWAL(FsyncOS, 0); err != nil {
+			t.Fatalf("Corrupted record of %d bytes wasn't ignored: %s", length, err)
+		}
+		recovered.internals.wal.file.Close()
+		if !recovered.Exists("A") || recovered.Exists("B") {
+			t.Errorf("Unexpected keys after a corrupted record of %d bytes: %q", length, recovered.Keys(""))
+		}
+	}
+}
+
+func TestFsyncPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   FsyncPolicy
+		expected int
+	}{
+		{"always", FsyncAlways, 3},
+		{"interval", FsyncInterval, 1},
+		{"os", FsyncOS, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if policy, err := ParseFsyncPolicy(tt.name); err != nil || policy != tt.policy {
+				t.Fatalf("Failed to parse fsync policy %q: %v", tt.name, err)
+			}
+			nabiaDB := newEmptyDB()
+			nabiaDB.internals.location = filepath.Join(t.TempDir(), "wal.db")
+			if err := nabiaDB.EnableWAL(tt.policy, time.Hour); err != nil {
+				t.Fatalf("Failed to enable the write-ahead log: %s", err)
+			}
+			defer nabiaDB.Stop()
+			syncs := &countingSyncer{}
+			nabiaDB.internals.wal.syncer = syncs
+			nabiaDB.Write("A", []byte("Value"))
+			nabiaDB.Write("B", []byte("Value"))
+			nabiaDB.Delete("A")
+			if tt.policy == FsyncInterval {
+				// Stand in for the ticker, a single sync covers every write
+				w := nabiaDB.internals.wal
+				w.mu.Lock()
+				w.sync()
+				w.sync()
+				w.mu.Unlock()
+			}
+			if syncs.syncs != tt.expected {
+				t.Errorf("Unexpected number of fsyncs: got %d, expected %d", syncs.syncs, tt.expected)
+			}
+		})
+	}
+	if _, err := ParseFsyncPolicy("sometimes"); err == nil {
+		t.Error("Unknown fsync policy was accepted")
+	}
+}
+
+func TestWALKeepsWritesDuringSnapshot(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "wal.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	if err := nabiaDB.EnableWAL(FsyncAlways, 0); err != nil {
+		t.Fatalf("Failed to enable the write-ahead log: %s", err)
+	}
+	nabiaDB.Write("Before", []byte("Value"))
+
+	// Writes don't wait for the snapshot being written, and stay in the log
+	// as the snapshot misses them
+	nabiaDB.internals.syncSnapshot = func(s syncer) error {
+		if err := nabiaDB.Write("During", []byte("Value")); err != nil {
+			t.Errorf("Failed to write during the snapshot: %s", err)
+		}
+		return s.Sync()
+	}
+	if err := nabiaDB.Save(); err != nil {
+		t.Fatalf("Failed to save: %s", err)
+	}
+	nabiaDB.internals.syncSnapshot = nil
+	nabiaDB.Write("After", []byte("Value"))
+	nabiaDB.internals.wal.file.Close()
+
+	log, _ := os.ReadFile(walLocation(location))
+	if bytes.Contains(log, []byte("Before")) || !bytes.Contains(log, []byte("During")) || !bytes.Contains(log, []byte("After")) {
+		t.Errorf("Unexpected records left in the log: %q", log)
+	}
+	recovered, err := NabiaDBFromFile(location)
+	if err != nil {
+		t.Fatalf("failed to load NabiaDB from file: %s", err)
+	}
+	if err := recovered.EnableWAL(FsyncAlways, 0); err != nil {
+		t.Fatalf("Failed to replay the write-ahead log: %s", err)
+	}
+	defer recovered.internals.wal.file.Close()
+	for _, key := range []string{"Before", "During", "After"} {
+		if !recovered.Exists(key) {
+			t.Errorf("Key %q was lost", key)
+		}
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	// churn overwrites and deletes a few keys many times over, leaving the
+	// last of them
+	churn := func(nabiaDB *NabiaDB) {
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("Key_%d", i%10)
+			if i%7 == 0 {
+				nabiaDB.Delete(key)
+			} else {
+				nabiaDB.Write(key, []byte(fmt.Sprintf("Value_%d", i)))
+			}
+		}
+	}
+	replay := func(location string) (*NabiaDB, time.Duration) {
+		t.Helper()
+		recovered, err := NabiaDBFromFile(location)
+		if err != nil {
+			t.Fatalf("failed to load NabiaDB from file: %s", err)
+		}
+		start := time.Now()
+		if err := recovered.EnableWAL(FsyncOS, 0); err != nil {
+			t.Fatalf("Failed to replay the write-ahead log: %s", err)
+		}
+		return recovered, time.Since(start)
+	}
+
+	// Without compaction the log holds every write
+	dir := t.TempDir()
+	uncompacted, err := NewNabiaDB(filepath.Join(dir, "uncompacted.db"))
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	uncompacted.saveToFile(uncompacted.internals.location)
+	uncompacted.EnableWAL(FsyncOS, 0)
+	churn(uncompacted)
+	uncompacted.internals.wal.file.Close()
+	uncompactedLog, _ := os.Stat(walLocation(uncompacted.internals.location))
+	_, uncompactedReplay := replay(uncompacted.internals.location)
+
+	location := filepath.Join(dir, "compacted.db")
+	nabiaDB, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("Failed to create NabiaDB: %s", err)
+	}
+	if err := nabiaDB.SetWALCompaction(4096); err == nil {
+		t.Error("Compaction was set without a write-ahead log")
+	}
+	nabiaDB.saveToFile(location)
+	nabiaDB.EnableWAL(FsyncOS, 0)
+	if err := nabiaDB.SetWALCompaction(-1); err == nil {
+		t.Error("A negative compaction threshold was accepted")
+	}
+	if err := nabiaDB.SetWALCompaction(4096); err != nil {
+		t.Fatalf("Failed to set the compaction threshold: %s", err)
+	}
+	churn(nabiaDB)
+	// Writes made during a compaction are left to the next one, which a last
+	// write starts if they add up to the threshold
+	w := nabiaDB.internals.wal
+	w.compactions.Wait()
+	nabiaDB.Write("Last", []byte("Value"))
+	w.compactions.Wait()
+	expected := map[string][]byte{"Last": []byte("Value")}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("Key_%d", i)
+		if value, err := nabiaDB.Read(key); err == nil {
+			expected[key] = value
+		}
+	}
+	w.file.Close()
+
+	compactedLog, _ := os.Stat(walLocation(location))
+	if compactedLog.Size() >= 4096 || compactedLog.Size()*10 > uncompactedLog.Size() {
+		t.Errorf("The log wasn't compacted: %d bytes, %d without compaction", compactedLog.Size(), uncompactedLog.Size())
+	}
+	recovered, compactedReplay := replay(location)
+	defer recovered.internals.wal.file.Close()
+	t.Logf("Replayed in %s, %s without compaction", compactedReplay, uncompactedReplay)
+	if size := recovered.Stats().Size; size != int64(len(expected)) {
+		t.Errorf("Unexpected size after replay: got %d, expected %d", size, len(expected))
+	}
+	for key, value := range expected {
+		if data, err := recovered.Read(key); err != nil || !bytes.Equal(data, value) {
+			t.Errorf("Unexpected value for %q after replay: got %q (%v), expected %q", key, data, err, value)
+		}
+	}
+}
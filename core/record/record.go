@@ -0,0 +1,165 @@
+// Package record implements the format in which Nabia stores values: the raw
+// data along with its Content-Type and, optionally, headers replayed when it is
+// served. Programs embedding the engine can use it to read and write the same
+// records as the server.
+package record
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"mime"
+)
+
+// Record is a value as stored by Nabia.
+type Record struct {
+	data        []byte
+	contentType string
+	headers     []Header // replayed on GET, in the order they were received
+}
+
+// Header is a header stored along with a value.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// New returns a record of data, of type ct, carrying headers. It fails if ct,
+// the number of headers or any of their names and values is too long to be
+// serialized.
+func New(data []byte, ct string, headers ...Header) (*Record, error) {
+	if len(ct) > 0xFFFF {
+		return nil, fmt.Errorf("Content-Type is too long")
+	}
+	if len(headers) > 0xFFFF {
+		return nil, fmt.Errorf("too many headers")
+	}
+	for _, header := range headers {
+		if len(header.Name) > 0xFFFF || len(header.Value) > 0xFFFF {
+			return nil, fmt.Errorf("header %.32q is too long", header.Name)
+		}
+	}
+	return &Record{
+		data:        data,
+		contentType: ct,
+		headers:     headers,
+	}, nil
+}
+
+func (r *Record) GetRawData() []byte {
+	return r.data
+}
+
+func (r *Record) GetContentType() string {
+	return r.contentType
+}
+
+func (r *Record) GetHeaders() []Header {
+	return r.headers
+}
+
+// ValidateContentType checks that ct is a well-formed media type.
+func ValidateContentType(ct string) error {
+	if _, _, err := mime.ParseMediaType(ct); err != nil {
+		return fmt.Errorf("invalid Content-Type %q: %s", ct, err)
+	}
+	return nil
+}
+
+// Serialize encodes the record into the bytes stored by the engine. The layout
+// is a version byte, the length of the Content-Type as a big-endian uint16,
+// the Content-Type itself, the raw data and finally the CRC-32 of everything
+// before it as a big-endian uint32. Records with headers are of version 2,
+// where the headers come between the Content-Type and the data: their count
+// as a uint16, then the length and bytes of each name and value, lengths being
+// uint16 as well. Records without headers are of version 1, which has no
+// such field.
+func (r *Record) Serialize() []byte {
+	result := make([]byte, 3, 3+len(r.contentType)+len(r.data)+crc32.Size)
+	result[0] = 1 // version
+	binary.BigEndian.PutUint16(result[1:3], uint16(len(r.contentType)))
+	result = append(result, r.contentType...)
+	if len(r.headers) > 0 {
+		result[0] = 2
+		result = binary.BigEndian.AppendUint16(result, uint16(len(r.headers)))
+		for _, header := range r.headers {
+			result = binary.BigEndian.AppendUint16(result, uint16(len(header.Name)))
+			result = append(result, header.Name...)
+			result = binary.BigEndian.AppendUint16(result, uint16(len(header.Value)))
+			result = append(result, header.Value...)
+		}
+	}
+	result = append(result, r.data...)
+	return binary.BigEndian.AppendUint32(result, crc32.ChecksumIEEE(result))
+}
+
+// Deserialize decodes the bytes produced by Serialize back into a record.
+// Records of version 0, which have no checksum, are still readable. The data
+// of the record is a slice of b, which must not be modified afterwards.
+func Deserialize(b []byte) (*Record, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("serialized record is empty")
+	}
+	switch b[0] {
+	case 0:
+		return decode(b)
+	case 1, 2:
+		if len(b) < 3+crc32.Size {
+			return nil, fmt.Errorf("serialized record is truncated")
+		}
+		body, checksum := b[:len(b)-crc32.Size], b[len(b)-crc32.Size:]
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(checksum) {
+			return nil, fmt.Errorf("serialized record is corrupted: checksum mismatch")
+		}
+		return decode(body)
+	default:
+		return nil, fmt.Errorf("unknown serialization version %d", b[0])
+	}
+}
+
+// decode decodes the fields of a record, without its checksum.
+func decode(b []byte) (*Record, error) {
+	version := b[0]
+	b = b[1:]
+	// next takes a field of n bytes off the front of b
+	next := func(n int) ([]byte, error) {
+		if len(b) < n {
+			return nil, fmt.Errorf("serialized record is truncated")
+		}
+		field := b[:n]
+		b = b[n:]
+		return field, nil
+	}
+	// nextString takes a field prefixed by its length off the front of b
+	nextString := func() (string, error) {
+		length, err := next(2)
+		if err != nil {
+			return "", err
+		}
+		field, err := next(int(binary.BigEndian.Uint16(length)))
+		return string(field), err
+	}
+	ct, err := nextString()
+	if err != nil {
+		return nil, err
+	}
+	record := &Record{contentType: ct}
+	if version >= 2 {
+		count, err := next(2)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < int(binary.BigEndian.Uint16(count)); i++ {
+			var header Header
+			if header.Name, err = nextString(); err != nil {
+				return nil, err
+			}
+			if header.Value, err = nextString(); err != nil {
+				return nil, err
+			}
+			record.headers = append(record.headers, header)
+		}
+	}
+	record.data = b
+	return record, nil
+}
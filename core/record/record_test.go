@@ -0,0 +1,107 @@
+package record
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSerialize(t *testing.T) {
+	records := []struct {
+		data    []byte
+		ct      string
+		headers []Header
+	}{
+		{[]byte("value"), "text/plain", nil},
+		{[]byte{0, 1, 2, 0xFF}, "application/octet-stream", nil},
+		{[]byte("x"), "", nil},
+		{[]byte{}, "text/plain", nil},
+		{[]byte("value"), "text/plain", []Header{{"X-Author", "Zoë"}, {"X-Author", "Ana"}}},
+	}
+	for _, r := range records {
+		record, err := New(r.data, r.ct, r.headers...)
+		if err != nil {
+			t.Fatalf("Failed to create record: %s", err)
+		}
+		serialized := record.Serialize()
+		version := byte(1)
+		if len(r.headers) > 0 {
+			version = 2
+		}
+		if serialized[0] != version {
+			t.Errorf("Unexpected serialization version: got %d, expected %d", serialized[0], version)
+		}
+		decoded, err := Deserialize(serialized)
+		if err != nil {
+			t.Fatalf("Failed to deserialize %q: %s", serialized, err)
+		}
+		if !bytes.Equal(decoded.GetRawData(), r.data) || decoded.GetContentType() != r.ct || !reflect.DeepEqual(decoded.GetHeaders(), r.headers) {
+			t.Errorf("Record changed by a round trip: got %q %q, expected %q %q",
+				decoded.GetRawData(), decoded.GetContentType(), r.data, r.ct)
+		}
+		// A flipped bit anywhere is detected
+		for i := range serialized {
+			corrupted := bytes.Clone(serialized)
+			corrupted[i] ^= 0x10
+			if _, err := Deserialize(corrupted); err == nil {
+				t.Errorf("Corruption of byte %d of %q went undetected", i, serialized)
+			}
+		}
+	}
+
+	legacy := append([]byte{0, 0, 10}, "text/plainvalue"...)
+	if record, err := Deserialize(legacy); err != nil || string(record.GetRawData()) != "value" || record.GetContentType() != "text/plain" {
+		t.Errorf("Version 0 record isn't readable anymore: %v", err)
+	}
+	for _, b := range [][]byte{{}, {1, 0}, {1, 0, 0, 0, 0, 0}, {2, 0, 0}, {3, 0, 0, 0, 0, 0, 0}} {
+		if _, err := Deserialize(b); err == nil {
+			t.Errorf("Invalid record %v was accepted", b)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New([]byte("value"), strings.Repeat("a", 0x10000)); err == nil {
+		t.Error("A Content-Type too long to be serialized was accepted")
+	}
+	if _, err := New([]byte("value"), strings.Repeat("a", 0xFFFF)); err != nil {
+		t.Errorf("Failed to create a record with the longest Content-Type: %s", err)
+	}
+
+	long := strings.Repeat("a", 0x10000)
+	for _, header := range []Header{{Name: long, Value: "v"}, {Name: "X-Name", Value: long}} {
+		if _, err := New([]byte("value"), "text/plain", header); err == nil {
+			t.Errorf("A header too long to be serialized was accepted: %.16q", header.Name)
+		}
+	}
+	if _, err := New([]byte("value"), "text/plain", make([]Header, 0x10000)...); err == nil {
+		t.Error("Too many headers to be serialized were accepted")
+	}
+	r, err := New([]byte("value"), "text/plain", make([]Header, 0xFFFF)...)
+	if err != nil {
+		t.Fatalf("Failed to create a record with the most headers: %s", err)
+	}
+	if decoded, err := Deserialize(r.Serialize()); err != nil || len(decoded.GetHeaders()) != 0xFFFF {
+		t.Errorf("Failed to round-trip the most headers: %v", err)
+	}
+}
+
+func TestValidateContentType(t *testing.T) {
+	table := []struct {
+		ct    string
+		valid bool
+	}{
+		{"text/plain", true},
+		{"text/plain; charset=utf-8", true},
+		{"application/vnd.nabia+json", true},
+		{"", false},
+		{"not a type", false},
+		{"text/plain; charset", false},
+	}
+	for _, row := range table {
+		if err := ValidateContentType(row.ct); (err == nil) != row.valid {
+			t.Errorf("Unexpected validation of %q: got %v, expected valid %t", row.ct, err, row.valid)
+		}
+	}
+}
@@ -3,7 +3,8 @@ module github.com/Nabia-DB/nabia/server
 go 1.22
 
 require (
-	github.com/Nabia-DB/nabia/core v0.0.0-20240209210523-23cd6bb486c1 // indirect
+	github.com/Nabia-DB/nabia/client v0.0.0-20240209210523-23cd6bb486c1
+	github.com/Nabia-DB/nabia/core v0.0.0-20240209210523-23cd6bb486c1
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
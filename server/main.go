@@ -0,0 +1,8 @@
+// Command server runs the Nabia HTTP API, see nabiahttp.Main.
+package main
+
+import "github.com/Nabia-DB/nabia/server/nabiahttp"
+
+func main() {
+	nabiahttp.Main()
+}
@@ -0,0 +1,224 @@
+package nabiahttp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	engine "github.com/Nabia-DB/nabia/core/engine"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// managedHeaders are the response headers set by Nabia, which mustn't be
+// overridden by stored ones.
+var managedHeaders = map[string]bool{
+	"Content-Type":      true,
+	"Content-Length":    true,
+	"Content-Encoding":  true,
+	"Content-Range":     true,
+	"Transfer-Encoding": true,
+	"Etag":              true,
+	"Vary":              true,
+	"Accept-Ranges":     true,
+	"X-Nabia-Expires":   true,
+	"X-Nabia-Sequence":  true,
+}
+
+// bindFlags parses the command-line arguments and binds the flags which
+// override the configuration: --port, --db for db_location, and --config, the
+// configuration file to read instead of looking for config.yaml.
+func bindFlags(args []string) error {
+	flags := pflag.NewFlagSet("nabia", pflag.ContinueOnError)
+	flags.String("port", "5380", "Port to listen on")
+	flags.String("db", defaultDBLocation, "Location of the database file")
+	flags.String("config", "", "Configuration file, instead of config.yaml in /etc/nabia, $HOME/.nabia or the working directory")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	viper.BindPFlags(flags)
+	viper.BindPFlag("db_location", flags.Lookup("db"))
+	return nil
+}
+
+// bindEnv lets every setting be overridden by an environment variable named
+// after it in upper case, with the NABIA_ prefix, such as NABIA_PORT or
+// NABIA_DB_LOCATION. Dots and dashes become underscores, as in
+// NABIA_ENCRYPTION_PASSPHRASE.
+func bindEnv() {
+	viper.SetEnvPrefix("nabia")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	viper.AutomaticEnv()
+}
+
+// readConfig reads the configuration file of --config, or else config.yaml in
+// /etc/nabia, $HOME/.nabia or the working directory, and reports whether one
+// was read. Only a file given with --config must exist: everything can be
+// configured with flags and the environment, as in containers.
+func readConfig() (bool, error) {
+	if config := viper.GetString("config"); config != "" {
+		viper.SetConfigFile(config)
+	} else {
+		viper.SetConfigName("config")       // name of config file (without extension)
+		viper.SetConfigType("yaml")         // REQUIRED if the config file does not have the extension in the name
+		viper.AddConfigPath("/etc/nabia/")  // path to look for the config file in
+		viper.AddConfigPath("$HOME/.nabia") // call multiple times to add many search paths
+		viper.AddConfigPath(".")            // optionally look for config in the working directory
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// validateConfig checks the whole configuration before anything is opened or
+// bound, and reports every problem found at once, rather than failing on the
+// first one, so a broken configuration can be fixed in a single pass. Settings
+// which fall back to a default with a warning, like delete_missing_status, are
+// left out.
+func validateConfig() error {
+	var errs []error
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if viper.IsSet("port") {
+		port, err := strconv.Atoi(viper.GetString("port"))
+		if err != nil || port < 1 || port > 65535 {
+			add("port must be a number between 1 and 65535, got %q", viper.GetString("port"))
+		}
+	}
+	if bind := viper.GetString("bind_address"); bind != "" {
+		if _, err := net.ResolveIPAddr("ip", bind); err != nil {
+			add("bind_address must be an IP address or a resolvable host name: %s", err)
+		}
+	}
+
+	if tenantsDir := viper.GetString("tenants_dir"); tenantsDir != "" {
+		if err := checkWritableDir(tenantsDir, true); err != nil {
+			add("tenants_dir: %s", err)
+		}
+		if viper.IsSet("max_tenants") && viper.GetInt("max_tenants") <= 0 {
+			add("max_tenants must be positive, got %d", viper.GetInt("max_tenants"))
+		}
+	} else if location, err := dbLocation(); err != nil {
+		errs = append(errs, err)
+	} else if viper.GetBool("read_only") {
+		// A frozen dataset is only read, possibly from a read-only disk
+		if file, err := os.Open(location); err != nil {
+			add("db_location: %s", err)
+		} else {
+			file.Close()
+		}
+	} else if err := checkWritableDir(filepath.Dir(location), viper.GetBool("create_db_dir")); err != nil {
+		add("db_location: %s", err)
+	}
+	if _, err := dbFileMode(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if viper.GetBool("wal") {
+		if viper.GetString("encryption_passphrase") != "" {
+			add("wal cannot be combined with encryption_passphrase, the write-ahead log would hold every write in plaintext")
+		}
+		if viper.IsSet("fsync_policy") {
+			if _, err := engine.ParseFsyncPolicy(viper.GetString("fsync_policy")); err != nil {
+				add("fsync_policy: %s", err)
+			}
+		}
+		if viper.IsSet("fsync_interval_ms") && viper.GetInt("fsync_interval_ms") <= 0 {
+			add("fsync_interval_ms must be positive, got %d", viper.GetInt("fsync_interval_ms"))
+		}
+		if viper.GetInt64("wal_compact_bytes") < 0 {
+			add("wal_compact_bytes cannot be negative, got %d", viper.GetInt64("wal_compact_bytes"))
+		}
+	}
+	if viper.IsSet("io_concurrency") && viper.GetInt("io_concurrency") <= 0 {
+		add("io_concurrency must be positive, got %d", viper.GetInt("io_concurrency"))
+	}
+	if viper.GetInt("shards") < 0 {
+		add("shards cannot be negative, got %d", viper.GetInt("shards"))
+	}
+	if viper.GetInt64("max_keys") < 0 {
+		add("max_keys cannot be negative, got %d", viper.GetInt64("max_keys"))
+	}
+	if viper.GetInt64("max_memory_bytes") < 0 {
+		add("max_memory_bytes cannot be negative, got %d", viper.GetInt64("max_memory_bytes"))
+	}
+	if viper.GetInt("max_watchers") < 0 {
+		add("max_watchers cannot be negative, got %d", viper.GetInt("max_watchers"))
+	}
+	if _, err := namespaceQuotas(); err != nil {
+		errs = append(errs, err)
+	}
+	if viper.GetInt64("slow_request_ms") < 0 {
+		add("slow_request_ms cannot be negative, got %d", viper.GetInt64("slow_request_ms"))
+	}
+	if viper.GetFloat64("rate_limit_rps") < 0 {
+		add("rate_limit_rps cannot be negative, got %g", viper.GetFloat64("rate_limit_rps"))
+	}
+
+	if _, err := newLogger(io.Discard); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, name := range canonicalHeaders(viper.GetStringSlice("stored_headers")) {
+		if managedHeaders[name] {
+			add("stored_headers cannot include %s, which Nabia sets itself", name)
+		}
+	}
+
+	if certFile, keyFile, err := tlsFiles(); err != nil {
+		errs = append(errs, err)
+	} else if certFile != "" {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			add("tls_cert and tls_key: %s", err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// defaultDBLocation is where the database is stored when db_location isn't
+// set, relative to the working directory.
+const defaultDBLocation = "server.db"
+
+// dbLocation returns the absolute path of db_location, so that where the
+// database lives doesn't depend on where relative paths are resolved later.
+func dbLocation() (string, error) {
+	location := viper.GetString("db_location")
+	if location == "" {
+		return "", errors.New("db_location must be set")
+	}
+	absolute, err := filepath.Abs(location)
+	if err != nil {
+		return "", fmt.Errorf("db_location: %w", err)
+	}
+	return absolute, nil
+}
+
+// checkWritableDir tells whether files can be created in dir, creating dir
+// first if create is set.
+func checkWritableDir(dir string, create bool) error {
+	if create {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file, err := os.CreateTemp(dir, ".nabia-check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,105 @@
+package nabiahttp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	setConfig(t, "port", "5380")
+	setConfig(t, "db_location", filepath.Join(dir, "nabia.db"))
+	if err := validateConfig(); err != nil {
+		t.Fatalf("Valid configuration was refused: %s", err)
+	}
+
+	setConfig(t, "port", "http")
+	setConfig(t, "db_location", filepath.Join(dir, "missing", "nabia.db"))
+	setConfig(t, "io_concurrency", 0)
+	setConfig(t, "shards", -1)
+	setConfig(t, "max_keys", -1)
+	setConfig(t, "max_memory_bytes", -1)
+	setConfig(t, "max_watchers", -1)
+	setConfig(t, "rate_limit_rps", -1)
+	setConfig(t, "tls_cert", filepath.Join(dir, "cert.pem"))
+	setConfig(t, "stored_headers", []string{"X-Author", "etag"})
+	setConfig(t, "log_level", "loud")
+	setConfig(t, "slow_request_ms", -1)
+	setConfig(t, "db_file_mode", "0999")
+	setConfig(t, "namespace_max_keys", -1)
+	err := validateConfig()
+	if err == nil {
+		t.Fatal("Invalid configuration was accepted")
+	}
+	for _, setting := range []string{"port", "db_location", "io_concurrency", "shards", "max_keys", "max_memory_bytes", "max_watchers", "rate_limit_rps", "tls_key", "stored_headers", "log_level", "slow_request_ms", "db_file_mode", "namespace_max_keys"} {
+		if !strings.Contains(err.Error(), setting) {
+			t.Errorf("Problem with %s wasn't reported in %q", setting, err)
+		}
+	}
+
+	// A read-only dataset only needs to be readable
+	setConfig(t, "read_only", true)
+	if err := validateConfig(); err == nil || !strings.Contains(err.Error(), "db_location:") {
+		t.Errorf("Missing read-only dataset wasn't reported: %v", err)
+	}
+	setConfig(t, "read_only", nil)
+
+	// Missing directories of db_location are only created on demand
+	setConfig(t, "port", nil)
+	setConfig(t, "io_concurrency", nil)
+	setConfig(t, "shards", nil)
+	setConfig(t, "max_keys", nil)
+	setConfig(t, "max_memory_bytes", nil)
+	setConfig(t, "max_watchers", nil)
+	setConfig(t, "rate_limit_rps", nil)
+	setConfig(t, "tls_cert", nil)
+	setConfig(t, "stored_headers", nil)
+	setConfig(t, "log_level", nil)
+	setConfig(t, "slow_request_ms", nil)
+	setConfig(t, "namespace_max_keys", nil)
+	setConfig(t, "db_file_mode", "0600")
+	setConfig(t, "create_db_dir", true)
+	if err := validateConfig(); err != nil {
+		t.Errorf("Missing directories of db_location weren't created: %s", err)
+	}
+	setConfig(t, "create_db_dir", nil)
+	setConfig(t, "tls_cert", filepath.Join(dir, "cert.pem"))
+
+	setConfig(t, "tls_key", filepath.Join(dir, "key.pem"))
+	if err := validateConfig(); err == nil || !strings.Contains(err.Error(), "tls_cert and tls_key:") {
+		t.Errorf("Missing certificate files weren't reported: %v", err)
+	}
+}
+
+func TestDBLocation(t *testing.T) {
+	dir := t.TempDir()
+	setConfig(t, "db_location", "")
+	if err := validateConfig(); err == nil || !strings.Contains(err.Error(), "db_location must be set") {
+		t.Errorf("Empty db_location wasn't reported: %v", err)
+	}
+
+	// Relative locations are resolved against the working directory
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	setConfig(t, "db_location", filepath.Join("data", "nabia.db"))
+	setConfig(t, "create_db_dir", true)
+	if location, err := dbLocation(); err != nil || location != filepath.Join(dir, "data", "nabia.db") {
+		t.Errorf("Unexpected location: %q (%v)", location, err)
+	}
+	if err := validateConfig(); err != nil {
+		t.Errorf("Relative db_location was refused: %s", err)
+	}
+
+	// A file can't hold the database
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+	setConfig(t, "db_location", filepath.Join(file, "nabia.db"))
+	if err := validateConfig(); err == nil || !strings.Contains(err.Error(), "db_location:") {
+		t.Errorf("Unwritable db_location wasn't reported: %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package nabiahttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Content types selecting how a PATCH request modifies a stored JSON document.
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7386
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// patchError is an error of a PATCH request which maps to an HTTP status.
+type patchError struct {
+	status int
+	msg    string
+}
+
+func (e *patchError) Error() string {
+	return e.msg
+}
+
+func patchErrorf(status int, format string, a ...interface{}) error {
+	return &patchError{status: status, msg: fmt.Sprintf(format, a...)}
+}
+
+// isJSON tells whether a Content-Type denotes a JSON document.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// decodeJSON decodes a JSON document, keeping numbers as written.
+func decodeJSON(b []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON document")
+	}
+	return doc, nil
+}
+
+// encodeJSON encodes a JSON document without escaping HTML characters.
+func encodeJSON(doc interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// applyPatch applies a patch of the given media type to a JSON document.
+// Malformed patches result in 400 and patches which can't be applied to this
+// document in 409.
+func applyPatch(document, patch []byte, patchType string) ([]byte, error) {
+	doc, err := decodeJSON(document)
+	if err != nil {
+		return nil, patchErrorf(http.StatusUnsupportedMediaType, "stored value isn't valid JSON: %s", err)
+	}
+	switch patchType {
+	case mergePatchType:
+		p, err := decodeJSON(patch)
+		if err != nil {
+			return nil, patchErrorf(http.StatusBadRequest, "invalid merge patch: %s", err)
+		}
+		doc = mergePatch(doc, p)
+	case jsonPatchType:
+		var ops []jsonPatchOp
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return nil, patchErrorf(http.StatusBadRequest, "invalid JSON patch: %s", err)
+		}
+		for i, op := range ops {
+			if doc, err = op.apply(doc); err != nil {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+		}
+	default:
+		return nil, patchErrorf(http.StatusUnsupportedMediaType, "unsupported patch type %q", patchType)
+	}
+	return encodeJSON(doc)
+}
+
+// mergePatch applies an RFC 7386 JSON Merge Patch: objects are merged
+// recursively, null removes a member and anything else replaces the target.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// jsonPatchOp is a single operation of an RFC 6902 JSON Patch.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (op jsonPatchOp) apply(doc interface{}) (interface{}, error) {
+	if op.Path == nil {
+		return nil, patchErrorf(http.StatusBadRequest, "%q is missing a path", op.Op)
+	}
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, patchErrorf(http.StatusBadRequest, "%q is missing a value", op.Op)
+		}
+		if value, err = decodeJSON(op.Value); err != nil {
+			return nil, patchErrorf(http.StatusBadRequest, "invalid value: %s", err)
+		}
+	case "move", "copy":
+		if op.From == nil {
+			return nil, patchErrorf(http.StatusBadRequest, "%q is missing from", op.Op)
+		}
+		from, err := parsePointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = getPointer(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			// The copy mustn't share objects or arrays with its source
+			copied, _ := encodeJSON(value)
+			value, _ = decodeJSON(copied)
+		} else {
+			if *op.Path != *op.From && strings.HasPrefix(*op.Path, *op.From+"/") {
+				return nil, patchErrorf(http.StatusConflict, "cannot move %q into itself", *op.From)
+			}
+			if doc, err = removePointer(doc, from); err != nil {
+				return nil, err
+			}
+		}
+	}
+	switch op.Op {
+	case "add", "move", "copy":
+		return addPointer(doc, path, value)
+	case "remove":
+		return removePointer(doc, path)
+	case "replace":
+		if _, err := getPointer(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		return walkPointer(doc, path, func(container interface{}, token string) (interface{}, error) {
+			switch c := container.(type) {
+			case map[string]interface{}:
+				c[token] = value
+			case []interface{}:
+				i, _ := arrayIndex(token, len(c))
+				c[i] = value
+			}
+			return container, nil
+		})
+	case "test":
+		current, err := getPointer(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(current, value) {
+			return nil, patchErrorf(http.StatusConflict, "test failed at %q", *op.Path)
+		}
+		return doc, nil
+	default:
+		return nil, patchErrorf(http.StatusBadRequest, "unknown operation %q", op.Op)
+	}
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil // the whole document
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, patchErrorf(http.StatusBadRequest, "invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index of a JSON Pointer, which must be below max.
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') || i >= max {
+		return 0, patchErrorf(http.StatusConflict, "invalid array index %q", token)
+	}
+	return i, nil
+}
+
+// getPointer returns the value at path.
+func getPointer(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			value, ok := c[token]
+			if !ok {
+				return nil, patchErrorf(http.StatusConflict, "member %q doesn't exist", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(c))
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, patchErrorf(http.StatusConflict, "cannot index %q into a scalar", token)
+		}
+	}
+	return doc, nil
+}
+
+// walkPointer follows path up to the container holding its last token, and
+// replaces that container with the one returned by modify. Arrays may change
+// length, which is why every container on the way is reassigned. path must
+// not be empty.
+func walkPointer(doc interface{}, path []string, modify func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return modify(doc, path[0])
+	}
+	child, err := getPointer(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	updated, err := walkPointer(child, path[1:], modify)
+	if err != nil {
+		return nil, err
+	}
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		c[path[0]] = updated
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(c))
+		c[i] = updated
+	}
+	return doc, nil
+}
+
+// addPointer adds value at path, inserting it when path points into an array.
+func addPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return walkPointer(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			if token == "-" {
+				return append(c, value), nil
+			}
+			i, err := arrayIndex(token, len(c)+1)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		default:
+			return nil, patchErrorf(http.StatusConflict, "cannot add %q to a scalar", token)
+		}
+	})
+}
+
+// removePointer removes the value at path.
+func removePointer(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, patchErrorf(http.StatusConflict, "cannot remove the whole document")
+	}
+	return walkPointer(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, patchErrorf(http.StatusConflict, "member %q doesn't exist", token)
+			}
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c))
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		default:
+			return nil, patchErrorf(http.StatusConflict, "cannot remove %q from a scalar", token)
+		}
+	})
+}
+
+// jsonEqual compares two decoded JSON documents, numbers by their value.
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, errX := x.Float64()
+		fy, errY := y.Float64()
+		return errX == nil && errY == nil && fx == fy
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, ok := y[k]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
@@ -0,0 +1,58 @@
+package nabiahttp
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		document  string
+		patch     string
+		patchType string
+		expected  string
+		status    int // of the error, 0 when the patch applies
+	}{
+		{"merge", `{"a":"b","c":{"d":"e","f":"g"}}`, `{"a":"z","c":{"f":null}}`, mergePatchType, `{"a":"z","c":{"d":"e"}}`, 0},
+		{"merge replacing an array", `{"a":[1,2]}`, `{"a":[3]}`, mergePatchType, `{"a":[3]}`, 0},
+		{"merge into a scalar", `"text"`, `{"a":1}`, mergePatchType, `{"a":1}`, 0},
+		{"merge keeping numbers", `{"big":12345678901234567890}`, `{"a":1.50}`, mergePatchType, `{"a":1.50,"big":12345678901234567890}`, 0},
+		{"add member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, jsonPatchType, `{"baz":"qux","foo":"bar"}`, 0},
+		{"add to array", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, jsonPatchType, `{"foo":["bar","qux","baz"]}`, 0},
+		{"append to array", `{"foo":[1]}`, `[{"op":"add","path":"/foo/-","value":2}]`, jsonPatchType, `{"foo":[1,2]}`, 0},
+		{"remove", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, jsonPatchType, `{"foo":["bar","baz"]}`, 0},
+		{"replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, jsonPatchType, `{"baz":"boo","foo":"bar"}`, 0},
+		{"move", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, jsonPatchType, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, 0},
+		{"copy", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b","value":2}]`, jsonPatchType, `{"a":{"b":1},"c":{"b":2}}`, 0},
+		{"escaped pointer", `{"a/b":1,"m~n":2}`, `[{"op":"remove","path":"/a~1b"},{"op":"replace","path":"/m~0n","value":3}]`, jsonPatchType, `{"m~n":3}`, 0},
+		{"test", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, jsonPatchType, `{"baz":"qux","foo":["a",2,"c"]}`, 0},
+		{"failed test", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, jsonPatchType, "", http.StatusConflict},
+		{"missing target", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, jsonPatchType, "", http.StatusConflict},
+		{"remove missing member", `{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, jsonPatchType, "", http.StatusConflict},
+		{"move into itself", `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/c"}]`, jsonPatchType, "", http.StatusConflict},
+		{"unknown operation", `{}`, `[{"op":"frobnicate","path":"/a"}]`, jsonPatchType, "", http.StatusBadRequest},
+		{"missing value", `{}`, `[{"op":"add","path":"/a"}]`, jsonPatchType, "", http.StatusBadRequest},
+		{"malformed patch", `{}`, `{"op":"add"}`, jsonPatchType, "", http.StatusBadRequest},
+		{"stored value isn't JSON", `not json`, `{}`, mergePatchType, "", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := applyPatch([]byte(tt.document), []byte(tt.patch), tt.patchType)
+			if tt.status != 0 {
+				var pe *patchError
+				if !errors.As(err, &pe) || pe.status != tt.status {
+					t.Errorf("Unexpected error: got %v, expected status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if string(result) != tt.expected {
+				t.Errorf("Unexpected result: got %s, expected %s", result, tt.expected)
+			}
+		})
+	}
+}
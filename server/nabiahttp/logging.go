@@ -0,0 +1,79 @@
+package nabiahttp
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// logLevels maps the values of log_level to the levels of slog.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// newLogger returns a logger writing to out the records at or above log_level,
+// info by default, as text or, when log_format is json, as one JSON object per
+// line.
+func newLogger(out io.Writer) (*slog.Logger, error) {
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("log_format", "text")
+	level, ok := logLevels[strings.ToLower(viper.GetString("log_level"))]
+	if !ok {
+		return nil, fmt.Errorf("log_level must be one of debug, info, warn and error, got %q", viper.GetString("log_level"))
+	}
+	options := &slog.HandlerOptions{Level: level}
+	switch format := viper.GetString("log_format"); strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(out, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(out, options)), nil
+	default:
+		return nil, fmt.Errorf("log_format must be text or json, got %q", format)
+	}
+}
+
+// statusRecorder is an http.ResponseWriter remembering the status code of the
+// response and counting the bytes of its body, so that they can be logged once
+// the request is served. The status is 200 until WriteHeader is called, as
+// for the underlying writer.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+// newStatusRecorder wraps w.
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.status, sr.wroteHeader = code, true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Write sends the status code first, as the underlying writer would, if it
+// wasn't already: the response is then a 200.
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if !sr.wroteHeader {
+		sr.status, sr.wroteHeader = http.StatusOK, true
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.written += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
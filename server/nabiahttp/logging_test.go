@@ -0,0 +1,184 @@
+package nabiahttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	engine "github.com/Nabia-DB/nabia/core/engine"
+)
+
+// captureLogs makes every level of the default logger write JSON to the
+// returned buffer until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	setConfig(t, "log_level", "debug")
+	setConfig(t, "log_format", "json")
+	var logs bytes.Buffer
+	logger, err := newLogger(&logs)
+	if err != nil {
+		t.Fatalf("Failed to create a logger: %s", err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &logs
+}
+
+// logRecords decodes the JSON records written to logs.
+func logRecords(t *testing.T, logs *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Failed to decode log record %q: %s", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestNewLogger(t *testing.T) {
+	table := []struct {
+		level, format string
+		logged        []string // messages written among debug, info, warn and error
+	}{
+		{"", "", []string{"info", "warn", "error"}}, // unset
+		{"debug", "text", []string{"debug", "info", "warn", "error"}},
+		{"WARN", "json", []string{"warn", "error"}},
+		{"error", "JSON", []string{"error"}},
+	}
+	for _, row := range table {
+		setConfig(t, "log_level", nil)
+		setConfig(t, "log_format", nil)
+		if row.level != "" {
+			setConfig(t, "log_level", row.level)
+			setConfig(t, "log_format", row.format)
+		}
+		var logs bytes.Buffer
+		logger, err := newLogger(&logs)
+		if err != nil {
+			t.Fatalf("Failed to create a logger with level %q and format %q: %s", row.level, row.format, err)
+		}
+		logger.Debug("debug")
+		logger.Info("info")
+		logger.Warn("warn")
+		logger.Error("error")
+		lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+		if len(lines) != len(row.logged) {
+			t.Fatalf("Unexpected logs with level %q: got %q, expected %v", row.level, logs.String(), row.logged)
+		}
+		for i, message := range row.logged {
+			json := strings.EqualFold(row.format, "json")
+			if json && !strings.Contains(lines[i], `"msg":"`+message+`"`) || !json && !strings.Contains(lines[i], "msg="+message) {
+				t.Errorf("Unexpected log record with format %q: got %q, expected message %q", row.format, lines[i], message)
+			}
+		}
+	}
+
+	for _, setting := range []string{"log_level", "log_format"} {
+		setConfig(t, "log_level", "info")
+		setConfig(t, "log_format", "text")
+		setConfig(t, setting, "loud")
+		if _, err := newLogger(&bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), setting) {
+			t.Errorf("Invalid %s wasn't reported: %v", setting, err)
+		}
+	}
+}
+
+// slowReader is a request body which takes delay to be read.
+type slowReader struct {
+	delay time.Duration
+	body  io.Reader
+}
+
+func (sr *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(sr.delay)
+	sr.delay = 0
+	return sr.body.Read(p)
+}
+
+func TestSlowRequests(t *testing.T) {
+	for _, threshold := range []int64{0, 5} {
+		setConfig(t, "slow_request_ms", threshold)
+		db := engine.NewInMemoryNabiaDB()
+		defer db.Stop()
+		handler := NewNabiaHttp(db)
+		logs := captureLogs(t)
+
+		slow := httptest.NewRequest("PUT", "/key", &slowReader{delay: 50 * time.Millisecond, body: strings.NewReader("test")})
+		handler.ServeHTTP(httptest.NewRecorder(), slow)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+		var requests []map[string]interface{}
+		for _, record := range logRecords(t, logs) {
+			if record["msg"] == "request" || record["msg"] == "slow request" {
+				requests = append(requests, record)
+			}
+		}
+		if len(requests) != 2 {
+			t.Fatalf("Unexpected requests logged with slow_request_ms %d: got %v", threshold, requests)
+		}
+		level := "INFO"
+		if threshold > 0 {
+			level = "WARN"
+		}
+		if put := requests[0]; put["level"] != level || put["status"] != float64(http.StatusCreated) {
+			t.Errorf("Unexpected log of a slow PUT with slow_request_ms %d: got %v, expected level %s", threshold, put, level)
+		}
+		if get := requests[1]; get["level"] != "INFO" || get["status"] != float64(http.StatusNotFound) {
+			t.Errorf("Unexpected log of a fast GET with slow_request_ms %d: got %v", threshold, get)
+		}
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	// Implicit 200, as a body written without a status is sent with one
+	rec := httptest.NewRecorder()
+	recorder := newStatusRecorder(rec)
+	recorder.Write([]byte("Hello"))
+	recorder.Write([]byte(", world"))
+	if recorder.status != http.StatusOK || recorder.written != 12 || rec.Body.String() != "Hello, world" {
+		t.Errorf("Unexpected record of an implicit 200: got %d and %d bytes", recorder.status, recorder.written)
+	}
+
+	// Nothing written at all is a 200 as well
+	if recorder := newStatusRecorder(httptest.NewRecorder()); recorder.status != http.StatusOK || recorder.written != 0 {
+		t.Errorf("Unexpected record of an empty response: got %d and %d bytes", recorder.status, recorder.written)
+	}
+
+	// Explicit code, of which only the first one counts, as for any writer
+	rec = httptest.NewRecorder()
+	recorder = newStatusRecorder(rec)
+	recorder.WriteHeader(http.StatusNotFound)
+	recorder.WriteHeader(http.StatusInternalServerError)
+	recorder.Write([]byte("not found"))
+	if recorder.status != http.StatusNotFound || rec.Code != http.StatusNotFound || recorder.written != 9 {
+		t.Errorf("Unexpected record of an explicit 404: got %d and %d bytes", recorder.status, recorder.written)
+	}
+	if http.NewResponseController(recorder).Flush() != nil || !rec.Flushed {
+		t.Error("The recorder hides the underlying writer from http.ResponseController")
+	}
+
+	// The request log carries the byte count
+	logs := captureLogs(t)
+	db := engine.NewInMemoryNabiaDB()
+	defer db.Stop()
+	handler := NewNabiaHttp(db)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/key", strings.NewReader("Hello")))
+	logs.Reset()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/key", nil))
+	records := logRecords(t, logs)
+	if last := records[len(records)-1]; last["status"] != float64(http.StatusOK) || last["bytes"] != float64(5) {
+		t.Errorf("Unexpected log of a GET: got %v", last)
+	}
+}
@@ -0,0 +1,1807 @@
+// Package nabiahttp serves a Nabia database over HTTP. The server command runs
+// Main, and programs embed the API with NewNabiaHttp, as the nabiatest package
+// does for tests.
+package nabiahttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	engine "github.com/Nabia-DB/nabia/core/engine"
+	"github.com/Nabia-DB/nabia/core/record"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+type NabiaHTTP struct {
+	db                  *engine.NabiaDB
+	deleteMissingStatus int                                // status of a DELETE to a key that doesn't exist
+	maxValueSize        int64                              // largest accepted request body, in bytes
+	guessContentType    bool                               // serve generic values with the type of the key's extension
+	sniffContentType    bool                               // store bodies sent without a Content-Type with the type sniffed from them
+	adminToken          string                             // bearer token of /_admin endpoints, which are disabled without one
+	storedHeaders       []string                           // request headers stored with values and replayed on GET
+	apiKeys             map[string]bool                    // bearer tokens of clients, mapped to whether they may write; none disables authentication
+	maintenance         atomic.Bool                        // writes are rejected while set
+	settings            atomic.Pointer[reloadableSettings] // rate limit, CORS and slow requests, reloaded on SIGHUP
+	closing             chan struct{}                      // closed on shutdown to end the streams of /_watch
+	closeOnce           sync.Once
+}
+
+// corsMethods and corsExposedHeaders are advertised to browsers making
+// cross-origin requests.
+const (
+	corsMethods        = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsExposedHeaders = "ETag, Content-Range, X-Nabia-Sequence, X-Nabia-Expires, X-Created-At, X-Nabia-CRC32"
+)
+
+// checksumHeader carries the CRC-32 of the values served by GET, as 8 hex
+// digits.
+const checksumHeader = "X-Nabia-CRC32"
+
+// maintenanceRetryAfter is how many seconds clients are asked to wait before
+// retrying a write rejected during maintenance.
+const maintenanceRetryAfter = "60"
+
+// defaultMaxValueSize is the default limit for the size of a stored value.
+const defaultMaxValueSize = 64 << 20 // 64 MiB
+
+// maxStoredHeadersSize bounds the total size of the names and values of the
+// headers stored with a value.
+const maxStoredHeadersSize = 8 << 10 // 8 KiB
+
+func extractDataAndContentType(nsr *record.Record) ([]byte, string, error) {
+	return nsr.GetRawData(), nsr.GetContentType(), nil
+}
+
+// setExpiryHeaders tells clients when a key with a TTL expires, through
+// X-Nabia-Expires as an RFC 3339 timestamp, and Cache-Control with the
+// remaining seconds, so that caches drop their copy when Nabia does. Keys
+// without a TTL get neither header.
+func setExpiryHeaders(w http.ResponseWriter, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		return
+	}
+	w.Header().Set("X-Nabia-Expires", expiresAt.UTC().Format(time.RFC3339Nano))
+	remaining := int64(time.Until(expiresAt) / time.Second)
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(max(remaining, 0), 10))
+}
+
+// setTimestampHeaders tells clients when a key was last modified, through
+// Last-Modified, and when it was created, through X-Created-At as an RFC 3339
+// timestamp.
+func setTimestampHeaders(w http.ResponseWriter, stored engine.NabiaRecord) {
+	w.Header().Set("Last-Modified", stored.ModifiedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Created-At", stored.CreatedAt.UTC().Format(time.RFC3339Nano))
+}
+
+// gzipMinSize is the size below which values are sent uncompressed, as the
+// gzip framing would outweigh the savings.
+const gzipMinSize = 1024
+
+// acceptsGzip tells whether the client advertised gzip in Accept-Encoding,
+// without excluding it with q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(coding, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !found {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// compressible tells whether values of a Content-Type shrink when gzipped.
+// Text does, while images, archives and other already compressed formats
+// don't, so only textual types are compressed.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-ndjson", "application/yaml":
+		return true
+	}
+	return false
+}
+
+// etag returns the entity tag of a stored value: a hash of its serialized
+// bytes, so it changes whenever either the data or its Content-Type does.
+func etag(value []byte) string {
+	sum := sha256.Sum256(value)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// noneMatch tells whether an If-None-Match header matches tag, in which case a
+// GET or HEAD is answered with 304 Not Modified. As RFC 9110 requires, weak
+// comparison is used, and "*" matches any existing value.
+func noneMatch(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified tells whether a conditional GET or HEAD can be answered with 304,
+// as the client's copy, identified by If-None-Match or else dated by
+// If-Modified-Since, is still current. As Last-Modified only has a precision
+// of seconds, so does the comparison. A malformed date is ignored.
+func notModified(r *http.Request, tag string, modifiedAt time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		return noneMatch(header, tag)
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modifiedAt.Truncate(time.Second).After(since)
+}
+
+// match tells whether an If-Match header matches tag, in which case a
+// conditional write may proceed. As RFC 9110 requires, strong comparison is
+// used, so weak tags never match, and "*" matches any existing value.
+func match(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// errUnsatisfiableRange is returned by parseRange when the requested range
+// lies entirely outside of the value.
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+// parseRange parses a Range header of the form bytes=start-end, bytes=start- or
+// bytes=-suffix against a value of size bytes, and returns the inclusive bounds
+// of the requested part. partial is false when the whole value must be served
+// instead, which is the case without a header and, as RFC 9110 allows, for
+// malformed headers and requests for several ranges.
+func parseRange(header string, size int) (start, end int, partial bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+	if first == "" { // the last bytes of the value
+		suffix, err := strconv.Atoi(last)
+		if err != nil || suffix < 0 {
+			return 0, 0, false, nil
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, false, errUnsatisfiableRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true, nil
+	}
+	start, err = strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end = size - 1
+	if last != "" {
+		end, err = strconv.Atoi(last)
+		if err != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, false, errUnsatisfiableRange
+	}
+	return start, end, true, nil
+}
+
+// validPath is the shape of the URL paths served: slash-separated segments of
+// letters, digits, underscores, dots and hyphens, without empty segments nor a
+// trailing slash. Other keys can only be used through binaryKeyRoute.
+var validPath = regexp.MustCompile(`^/[\w.-]+(/[\w.-]+)*$`)
+
+// binaryKeyRoute is the fixed path under which the key is taken from the
+// X-Nabia-Key header instead of the URL path.
+const binaryKeyRoute = "/_kv"
+
+// resolveKey returns the key a request refers to. Usually that is the URL path,
+// but requests to binaryKeyRoute carry the key base64-encoded in the
+// X-Nabia-Key header, which allows any byte sequence to be used as a key,
+// including null bytes and slashes that can't safely travel in a URL.
+func resolveKey(r *http.Request) (string, error) {
+	if r.URL.Path != binaryKeyRoute {
+		return r.URL.Path, nil
+	}
+	encoded := r.Header.Get("X-Nabia-Key")
+	if encoded == "" {
+		return "", fmt.Errorf("the X-Nabia-Key header is required for %s", binaryKeyRoute)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed X-Nabia-Key header: %s", err)
+	}
+	if len(key) == 0 {
+		return "", fmt.Errorf("key cannot be empty")
+	}
+	return string(key), nil
+}
+
+// namespaceHeader names the namespace of a request, whose keys are then those
+// of that namespace, see engine.NamespaceKey. Namespaces follow the rules of
+// tenant names, see validTenant.
+const namespaceHeader = "X-Nabia-Namespace"
+
+// namespaceRoutes are the control endpoints served within a namespace. The
+// others apply to the whole database, so they refuse requests naming one.
+var namespaceRoutes = map[string]bool{"/_keys": true, "/_stats": true, binaryKeyRoute: true}
+
+// namespaceOf returns the namespace of a request, empty when it names none.
+func namespaceOf(r *http.Request) (string, error) {
+	namespace := r.Header.Get(namespaceHeader)
+	if namespace != "" && !validTenant.MatchString(namespace) {
+		return "", fmt.Errorf("invalid namespace %q", namespace)
+	}
+	return namespace, nil
+}
+
+func NewNabiaHttp(ns *engine.NabiaDB) *NabiaHTTP {
+	viper.SetDefault("delete_missing_status", http.StatusNotFound)
+	deleteMissingStatus := viper.GetInt("delete_missing_status")
+	if deleteMissingStatus != http.StatusNotFound && deleteMissingStatus != http.StatusNoContent {
+		slog.Warn("delete_missing_status must be 404 or 204, using 404", "delete_missing_status", deleteMissingStatus)
+		deleteMissingStatus = http.StatusNotFound
+	}
+	viper.SetDefault("max_value_size", defaultMaxValueSize)
+	maxValueSize := viper.GetInt64("max_value_size")
+	if maxValueSize <= 0 {
+		slog.Warn("max_value_size must be positive, using the default", "max_value_size", maxValueSize, "default", defaultMaxValueSize)
+		maxValueSize = defaultMaxValueSize
+	}
+	h := &NabiaHTTP{
+		db:                  ns,
+		deleteMissingStatus: deleteMissingStatus,
+		maxValueSize:        maxValueSize,
+		guessContentType:    viper.GetBool("guess_content_type"),
+		sniffContentType:    viper.GetBool("sniff_content_type"),
+		adminToken:          viper.GetString("admin_token"),
+		apiKeys:             loadAPIKeys(),
+		storedHeaders:       canonicalHeaders(viper.GetStringSlice("stored_headers")),
+		closing:             make(chan struct{}),
+	}
+	h.settings.Store(loadReloadableSettings())
+	return h
+}
+
+// canonicalHeaders returns the canonical form of header names.
+func canonicalHeaders(names []string) []string {
+	canonical := make([]string, 0, len(names))
+	for _, name := range names {
+		canonical = append(canonical, http.CanonicalHeaderKey(name))
+	}
+	return canonical
+}
+
+// captureHeaders returns the headers of a request which are stored with its
+// value, as configured by stored_headers. It fails when they add up to more
+// than maxStoredHeadersSize.
+func (h *NabiaHTTP) captureHeaders(r *http.Request) ([]record.Header, error) {
+	var headers []record.Header
+	size := 0
+	for _, name := range h.storedHeaders {
+		for _, value := range r.Header.Values(name) {
+			size += len(name) + len(value)
+			if size > maxStoredHeadersSize {
+				return nil, fmt.Errorf("stored headers exceed %d bytes", maxStoredHeadersSize)
+			}
+			headers = append(headers, record.Header{Name: name, Value: value})
+		}
+	}
+	return headers, nil
+}
+
+// replayHeaders adds the headers stored with a value to the response.
+func replayHeaders(w http.ResponseWriter, nsr *record.Record) {
+	for _, header := range nsr.GetHeaders() {
+		w.Header().Add(header.Name, header.Value)
+	}
+}
+
+// allowedOrigin returns the value of Access-Control-Allow-Origin for a request
+// from origin, or "" if that origin isn't allowed. Browsers refuse the "*"
+// wildcard for requests with credentials, so the origin is echoed instead.
+func (s *reloadableSettings) allowedOrigin(origin string) string {
+	for _, allowed := range s.corsOrigins {
+		if allowed == "*" && !s.corsCredentials {
+			return "*"
+		}
+		if allowed == "*" || allowed == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// handleCORS adds the CORS headers to responses to allowed origins, and
+// answers their preflight requests with 204. It tells whether the request was
+// answered.
+func (h *NabiaHTTP) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	settings := h.settings.Load()
+	allowed := settings.allowedOrigin(origin)
+	if allowed == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	if allowed != "*" {
+		w.Header().Add("Vary", "Origin")
+	}
+	if settings.corsCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		return false
+	}
+	// Preflight request
+	w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// responseContentType returns the Content-Type to serve a value stored with ct
+// under key. When guess_content_type is enabled, values stored with the generic
+// application/octet-stream are served with the type matching the extension of
+// path-like keys, such as image/png for /images/logo.png. The stored record
+// isn't modified.
+func (h *NabiaHTTP) responseContentType(key, ct string) string {
+	if !h.guessContentType || ct != "application/octet-stream" {
+		return ct
+	}
+	if guessed := mime.TypeByExtension(path.Ext(key)); guessed != "" {
+		return guessed
+	}
+	return ct
+}
+
+// requestContentType returns the Content-Type to store body with: the one of
+// the request or, without one, application/octet-stream. When
+// sniff_content_type is enabled, bodies sent without a type are stored with
+// the type sniffed from their first bytes instead.
+func (h *NabiaHTTP) requestContentType(r *http.Request, body []byte) string {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		return ct
+	}
+	if h.sniffContentType {
+		if sniffed := http.DetectContentType(body); record.ValidateContentType(sniffed) == nil {
+			return sniffed
+		}
+	}
+	return "application/octet-stream"
+}
+
+// readBody reads the whole request body, unless it is larger than
+// max_value_size, in which case reading stops as soon as the limit is crossed
+// and an *http.MaxBytesError is returned.
+func (h *NabiaHTTP) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if r.ContentLength > h.maxValueSize { // no need to read anything
+		return nil, &http.MaxBytesError{Limit: h.maxValueSize}
+	}
+	return io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxValueSize))
+}
+
+// patchBytes returns a copy of data with body written at offset. The result
+// grows as needed, with zero bytes filling any gap past the end of data.
+func patchBytes(data, body []byte, offset int64) []byte {
+	result := make([]byte, max(int64(len(data)), offset+int64(len(body))))
+	copy(result, data)
+	copy(result[offset:], body)
+	return result
+}
+
+// bodyErrorStatus maps an error returned by readBody to a status code.
+func bodyErrorStatus(err error) int {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// copyKey answers a PUT carrying X-Nabia-Copy-From, which stores the record
+// of the src key, with its Content-Type and headers, under dst without it ever
+// leaving the server, and a POST carrying X-Nabia-Move-From, which does the
+// same and removes src, atomically. The destination is only replaced with
+// ?overwrite=true; otherwise an existing one is a 409. A missing source is a
+// 404.
+func (h *NabiaHTTP) copyKey(w http.ResponseWriter, r *http.Request, src, dst string, move bool) {
+	overwrite, err := boolParameter(r, "overwrite", false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	existed := h.db.Exists(dst)
+	if move {
+		err = h.db.Move(src, dst, overwrite)
+	} else {
+		err = h.db.Copy(src, dst, overwrite)
+	}
+	switch {
+	case errors.Is(err, engine.ErrKeyNotFound):
+		http.Error(w, fmt.Sprintf("key %q doesn't exist", src), http.StatusNotFound)
+	case errors.Is(err, engine.ErrKeyExists):
+		http.Error(w, fmt.Sprintf("key %q already exists", dst), http.StatusConflict)
+	case err != nil:
+		slog.Error("request failed", "error", err)
+		w.WriteHeader(errorStatus(err))
+	default:
+		h.setSequenceHeader(w)
+		if existed {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	}
+}
+
+// errorStatus maps an error returned by the database to a status code, telling
+// the errors of the engine apart with errors.Is.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, engine.ErrKeyEmpty), errors.Is(err, engine.ErrValueEmpty), errors.Is(err, engine.ErrValueNil):
+		return http.StatusBadRequest
+	case errors.Is(err, engine.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, engine.ErrReadOnly):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, engine.ErrKeyExists):
+		return http.StatusConflict
+	case errors.Is(err, engine.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, engine.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, engine.ErrTooManyWatchers):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// prefersRepresentation reports whether the request carries the
+// "Prefer: return=representation" preference (RFC 7240).
+func prefersRepresentation(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "return=representation") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setSequenceHeader reports the database sequence after a write, letting
+// clients check whether a replica has caught up with the write they made.
+func (h *NabiaHTTP) setSequenceHeader(w http.ResponseWriter) {
+	w.Header().Set("X-Nabia-Sequence", strconv.FormatInt(h.db.Sequence(), 10))
+}
+
+// serveStats responds with the database metrics encoded as JSON, or with those
+// of the namespace of the request, see engine.NamespaceStats.
+func (h *NabiaHTTP) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var stats interface{} = h.db.Stats()
+	if namespace, _ := namespaceOf(r); namespace != "" {
+		stats = h.db.NamespaceStats(namespace)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		slog.Error("request failed", "error", err)
+	}
+}
+
+// keyListing is an element of the response to /_keys?values=true. Values are
+// base64-encoded by encoding/json.
+type keyListing struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	Value       []byte `json:"value"`
+}
+
+// serveKeys lists the keys starting with the prefix query parameter, in
+// lexicographic order, as a JSON array. At most limit keys are listed when
+// that parameter is set, and with values=true every key comes with its value
+// and Content-Type. Within a namespace, only its keys are listed.
+func (h *NabiaHTTP) serveKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit := -1
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	values, err := boolParameter(r, "values", false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefix := query.Get("prefix")
+	// Keys are listed without their namespace, which is trimmed off them
+	var trimmed int
+	if namespace, _ := namespaceOf(r); namespace != "" {
+		namespaced := engine.NamespaceKey(namespace, prefix)
+		trimmed, prefix = len(namespaced)-len(prefix), namespaced
+	}
+	var listing interface{}
+	if values {
+		records, err := h.db.ReadPrefixContext(r.Context(), prefix)
+		if err != nil {
+			abandoned(w, r, err)
+			return
+		}
+		keys := make([]string, 0, len(records))
+		for key := range records {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if limit >= 0 && len(keys) > limit {
+			keys = keys[:limit]
+		}
+		entries := make([]keyListing, 0, len(keys))
+		for _, key := range keys {
+			nsr, err := record.Deserialize(records[key])
+			if err != nil {
+				slog.Error("request failed", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			entries = append(entries, keyListing{Key: key[trimmed:], ContentType: nsr.GetContentType(), Value: nsr.GetRawData()})
+		}
+		listing = entries
+	} else {
+		keys, err := h.db.KeysContext(r.Context(), prefix)
+		if err != nil {
+			abandoned(w, r, err)
+			return
+		}
+		if limit >= 0 && len(keys) > limit {
+			keys = keys[:limit]
+		}
+		for i := range keys {
+			keys[i] = keys[i][trimmed:]
+		}
+		listing = keys
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(listing); err != nil {
+		slog.Error("request failed", "error", err)
+	}
+}
+
+// serveExport streams every key of the database as a JSON array, see
+// engine.ExportJSON, with the data and Content-Type of each value rather than
+// its serialized bytes. The export stops when the client goes away.
+func (h *NabiaHTTP) serveExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := h.db.ExportJSONContext(r.Context(), w, func(exported *engine.ExportedRecord) error {
+		nsr, err := record.Deserialize(exported.Value)
+		if err != nil {
+			return fmt.Errorf("exporting key %q: %w", exported.Key, err)
+		}
+		exported.Value, exported.ContentType = nsr.GetRawData(), nsr.GetContentType()
+		return nil
+	})
+	if r.Context().Err() != nil {
+		slog.Debug("export abandoned", "error", err)
+	} else if err != nil {
+		// Part of the document may have been sent, all we can do is log
+		slog.Error("request failed", "error", err)
+	}
+}
+
+// abandoned answers a request whose scan was given up on because its context
+// is done, most likely as the client went away, in which case nobody reads
+// the answer.
+func abandoned(w http.ResponseWriter, r *http.Request, err error) {
+	slog.Debug("request abandoned", "method", r.Method, "key", r.URL.Path, "error", err)
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+// boolParameter returns the value of a boolean query parameter, or fallback
+// when it isn't set.
+func boolParameter(r *http.Request, name string, fallback bool) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false", name)
+	}
+	return b, nil
+}
+
+// serveImport writes the records of a JSON array in the format of /_export,
+// see engine.ImportJSONWith. Existing keys are overwritten unless
+// overwrite=false, dry_run=true only counts the records which would be
+// imported, and strict=true stops at the first invalid record, answering 400.
+// The response is the engine.ImportResult, listing invalid records by index.
+// The body is subject to max_value_size.
+func (h *NabiaHTTP) serveImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.rejectInMaintenance(w, r) {
+		return
+	}
+	var options engine.ImportOptions
+	var err error
+	if options.Overwrite, err = boolParameter(r, "overwrite", true); err == nil {
+		if options.DryRun, err = boolParameter(r, "dry_run", false); err == nil {
+			options.Strict, err = boolParameter(r, "strict", false)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options.Convert = func(exported *engine.ExportedRecord) error {
+		if len(exported.Value) == 0 && !h.db.AllowEmptyValues() {
+			return fmt.Errorf("value cannot be empty")
+		}
+		if exported.ContentType == "" {
+			exported.ContentType = "application/octet-stream"
+		}
+		if err := record.ValidateContentType(exported.ContentType); err != nil {
+			return err
+		}
+		nsr, err := record.New(exported.Value, exported.ContentType)
+		if err != nil {
+			return err
+		}
+		exported.Value = nsr.Serialize()
+		return nil
+	}
+	result, err := h.db.ImportJSONWith(http.MaxBytesReader(w, r.Body, h.maxValueSize), options)
+	status := http.StatusOK
+	var failure engine.ImportError
+	if errors.As(err, &failure) {
+		status = http.StatusBadRequest
+	} else if err != nil {
+		slog.Error("request failed", "error", err)
+		if status = bodyErrorStatus(err); status == http.StatusInternalServerError {
+			status = http.StatusBadRequest // the document is malformed
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if !options.DryRun {
+		h.setSequenceHeader(w)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("request failed", "error", err)
+	}
+}
+
+// maxExistsKeys is the largest number of keys checked by a single /_exists
+// request.
+const maxExistsKeys = 10000
+
+// serveExists checks the existence of the keys listed as a JSON array in the
+// body, and answers with a JSON object mapping each of them to a boolean. This
+// replaces one HEAD per key when reconciling large sets of keys.
+func (h *NabiaHTTP) serveExists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := h.readBody(w, r)
+	if err != nil {
+		slog.Error("request failed", "error", err)
+		w.WriteHeader(bodyErrorStatus(err))
+		return
+	}
+	var keys []string
+	if err := json.Unmarshal(body, &keys); err != nil {
+		http.Error(w, "body must be a JSON array of keys", http.StatusBadRequest)
+		return
+	}
+	if len(keys) > maxExistsKeys {
+		http.Error(w, fmt.Sprintf("at most %d keys can be checked at once", maxExistsKeys), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.db.MultiExists(keys)); err != nil {
+		slog.Error("request failed", "error", err)
+	}
+}
+
+// maxMgetKeys is the largest number of keys which can be read by a single
+// request.
+const maxMgetKeys = 1000
+
+// mgetValue is a value returned by a batch read. Value is base64 in JSON.
+type mgetValue struct {
+	Value       []byte `json:"value"`
+	ContentType string `json:"content_type"`
+}
+
+// serveMget reads the keys listed as a JSON array in the body, and answers
+// with a JSON object mapping each of them to a mgetValue, or to null when the
+// key doesn't exist. This replaces one GET per key when many keys are needed
+// at once; a missing key never fails the batch.
+func (h *NabiaHTTP) serveMget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := h.readBody(w, r)
+	if err != nil {
+		slog.Error("request failed", "error", err)
+		w.WriteHeader(bodyErrorStatus(err))
+		return
+	}
+	var keys []string
+	if err := json.Unmarshal(body, &keys); err != nil {
+		http.Error(w, "body must be a JSON array of keys", http.StatusBadRequest)
+		return
+	}
+	if len(keys) > maxMgetKeys {
+		http.Error(w, fmt.Sprintf("at most %d keys can be read at once", maxMgetKeys), http.StatusBadRequest)
+		return
+	}
+	values := h.db.MultiRead(keys)
+	result := make(map[string]*mgetValue, len(keys))
+	for _, key := range keys {
+		result[key] = nil
+		if data, ok := values[key]; ok {
+			nsr, err := record.Deserialize(data)
+			if err != nil {
+				slog.Error("request failed", "error", err)
+				continue // reported as missing, as a GET would fail
+			}
+			result[key] = &mgetValue{Value: nsr.GetRawData(), ContentType: nsr.GetContentType()}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("request failed", "error", err)
+	}
+}
+
+// bulkEntry is a key/value pair written by a bulk request.
+type bulkEntry struct {
+	Key         string  `json:"key"`
+	ContentType string  `json:"content_type"`
+	Value       *string `json:"value"`
+}
+
+// bulkResult reports the outcome of one entry of a bulk request, with the
+// status a PUT of the same entry would have gotten.
+type bulkResult struct {
+	Line   int    `json:"line"`
+	Key    string `json:"key,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// serveBulk writes many key/value pairs in a single request. The body holds
+// one JSON bulkEntry per line, and each entry is written as a PUT would. An
+// invalid entry doesn't abort the batch: the response lists the outcome of
+// every line, as a JSON array of bulkResult. The whole body is subject to
+// max_value_size; past it the request fails with 413, although the entries
+// read until then were written.
+func (h *NabiaHTTP) serveBulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.rejectInMaintenance(w, r) {
+		return
+	}
+	results := []bulkResult{}
+	reader := bufio.NewReader(http.MaxBytesReader(w, r.Body, h.maxValueSize))
+	for line := 1; ; line++ {
+		raw, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(raw)) > 0 {
+			results = append(results, h.writeBulkEntry(line, raw))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			slog.Error("request failed", "error", err)
+			w.WriteHeader(bodyErrorStatus(err))
+			return
+		}
+	}
+	h.setSequenceHeader(w)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		slog.Error("request failed", "error", err)
+	}
+}
+
+func (h *NabiaHTTP) writeBulkEntry(line int, raw []byte) bulkResult {
+	var entry bulkEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return bulkResult{Line: line, Status: http.StatusBadRequest, Error: err.Error()}
+	}
+	result := bulkResult{Line: line, Key: entry.Key, Status: http.StatusBadRequest}
+	ct := entry.ContentType
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	if entry.Key == "" {
+		result.Error = "key cannot be empty"
+	} else if entry.Value == nil || (*entry.Value == "" && !h.db.AllowEmptyValues()) {
+		result.Error = "value cannot be empty"
+	} else if err := record.ValidateContentType(ct); err != nil {
+		result.Error = err.Error()
+	} else if nsr, err := record.New([]byte(*entry.Value), ct); err != nil {
+		result.Error = err.Error()
+	} else {
+		existed := h.db.Exists(entry.Key)
+		if err := h.db.Write(entry.Key, nsr.Serialize()); err != nil {
+			result.Status = errorStatus(err)
+			result.Error = err.Error()
+		} else if existed {
+			result.Status = http.StatusOK
+		} else {
+			result.Status = http.StatusCreated
+		}
+	}
+	return result
+}
+
+// loadAPIKeys reads the keys of api_keys, which may read and write, and those
+// of read_only_api_keys, which may only read. A key in both lists keeps write
+// access.
+func loadAPIKeys() map[string]bool {
+	keys := map[string]bool{}
+	for _, key := range viper.GetStringSlice("read_only_api_keys") {
+		keys[key] = false
+	}
+	for _, key := range viper.GetStringSlice("api_keys") {
+		keys[key] = true
+	}
+	delete(keys, "")
+	return keys
+}
+
+// isWrite tells whether a request may modify the database. POST /_exists and
+// POST /_mget only read, despite their method.
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	case "POST":
+		return r.URL.Path != "/_exists" && r.URL.Path != "/_mget"
+	}
+	return true
+}
+
+// apiKeyAccess tells whether a request carries a configured API key, and
+// whether that key may write.
+func (h *NabiaHTTP) apiKeyAccess(r *http.Request) (valid, canWrite bool) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return false, false
+	}
+	for key, write := range h.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			valid, canWrite = true, write
+		}
+	}
+	return valid, canWrite
+}
+
+// authenticate checks the API key of a request when API keys are configured,
+// answering 401 without a valid key and 403 to writes made with a read-only
+// one. It tells whether the request was answered. OPTIONS requests aren't
+// authenticated, as browsers send CORS preflights without credentials; nor
+// are /_readyz, so probes need no key, and the /_admin endpoints, which have
+// their own token.
+func (h *NabiaHTTP) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if len(h.apiKeys) == 0 || r.Method == "OPTIONS" || r.URL.Path == "/_readyz" ||
+		strings.HasPrefix(r.URL.Path, "/_admin/") {
+		return false
+	}
+	valid, canWrite := h.apiKeyAccess(r)
+	if !valid {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="nabia"`)
+		http.Error(w, "A valid API key is required", http.StatusUnauthorized)
+		return true
+	}
+	if !canWrite && isWrite(r) {
+		http.Error(w, "This API key is read-only", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// authorizeAdmin tells whether a request carries the admin token. Without a
+// configured token every admin request is refused.
+func (h *NabiaHTTP) authorizeAdmin(r *http.Request) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && h.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) == 1
+}
+
+// serveMaintenance toggles maintenance mode with ?on=true or ?on=false. While
+// it is on, reads are served as usual but writes fail with 503, so data can be
+// migrated without restarting the server.
+func (h *NabiaHTTP) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+	if err != nil {
+		http.Error(w, "on must be true or false", http.StatusBadRequest)
+		return
+	}
+	h.maintenance.Store(on)
+	slog.Info("maintenance mode set", "maintenance", on)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"maintenance": on})
+}
+
+// readMethods are the methods allowed in read-only mode.
+const readMethods = "GET, HEAD, OPTIONS"
+
+// allowedMethods returns the Allow header advertised by OPTIONS for a key,
+// depending on whether it exists: the methods which can succeed on it, which
+// are only the reads in read-only mode.
+func (h *NabiaHTTP) allowedMethods(exists bool) string {
+	methods := []string{"HEAD", "PUT", "POST", "OPTIONS"}
+	if exists {
+		methods = []string{"GET", "HEAD", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	}
+	if !h.db.ReadOnly() {
+		return strings.Join(methods, ", ")
+	}
+	var allowed []string
+	for _, method := range methods {
+		if strings.Contains(readMethods, method) {
+			allowed = append(allowed, method)
+		}
+	}
+	return strings.Join(allowed, ", ")
+}
+
+// rejectInReadOnly answers 405 to writes made to a read-only database, and
+// tells whether it did. Toggling maintenance doesn't write to the database, so
+// it remains allowed.
+func (h *NabiaHTTP) rejectInReadOnly(w http.ResponseWriter, r *http.Request) bool {
+	if !h.db.ReadOnly() || !isWrite(r) || r.URL.Path == "/_admin/maintenance" {
+		return false
+	}
+	w.Header().Set("Allow", readMethods)
+	http.Error(w, "The database is read-only", http.StatusMethodNotAllowed)
+	return true
+}
+
+// rejectInMaintenance answers 503 to writes made during maintenance, and tells
+// whether it did.
+func (h *NabiaHTTP) rejectInMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	if !h.maintenance.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", maintenanceRetryAfter)
+	http.Error(w, "Writes are disabled during maintenance", http.StatusServiceUnavailable)
+	return true
+}
+
+// serveReadiness answers 200 while the database is usable, and 503 with the
+// reason otherwise, so load balancers stop routing requests to a node whose
+// disk went away.
+func (h *NabiaHTTP) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.db.Ping(); err != nil {
+		slog.Error("request failed", "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// logRequest logs a request once served, as a warning if it took longer than
+// slow_request_ms. Streams of /_watch last as long as their client wants, so
+// they are never slow.
+func (h *NabiaHTTP) logRequest(r *http.Request, response *statusRecorder, clientIP string, duration time.Duration) {
+	level, message := slog.LevelInfo, "request"
+	slowRequest := h.settings.Load().slowRequest
+	if slowRequest > 0 && duration > slowRequest && r.URL.Path != "/_watch" {
+		level, message = slog.LevelWarn, "slow request"
+	}
+	slog.Log(r.Context(), level, message, "method", r.Method, "key", r.URL.Path, "status", response.status,
+		"bytes", response.written, "client_ip", clientIP, "duration", duration)
+}
+
+// remoteIP returns the address of a client without its port. RemoteAddr has
+// one when set by net/http, but a handler may be given any address, which is
+// then kept as is, or "unknown" when there is none: it is only used to log and
+// throttle requests, never a reason to fail them.
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	if remoteAddr == "" {
+		return "unknown"
+	}
+	return remoteAddr
+}
+
+// These are the higher-level HTTP API calls exposed via the desired port, which
+// in turn call the CRUD primitives from core.
+
+func (h *NabiaHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	recorder := newStatusRecorder(w)
+	w = recorder
+	var response []byte
+	clientIP := remoteIP(r.RemoteAddr)
+	defer func() {
+		h.logRequest(r, recorder, clientIP, time.Since(start))
+	}()
+	if h.handleCORS(w, r) {
+		return
+	}
+	if h.throttle(w, r, clientIP) {
+		return
+	}
+	if !validPath.MatchString(r.URL.Path) {
+		// Trailing slashes are rejected rather than normalized away, whatever
+		// the method: /a/ is neither /a nor a distinct key, so it can never
+		// silently read or overwrite the wrong value
+		http.Error(w, fmt.Sprintf("malformed key %q", r.URL.Path), http.StatusBadRequest)
+		return
+	}
+	if h.authenticate(w, r) {
+		return
+	}
+	if h.rejectInReadOnly(w, r) {
+		return
+	}
+	namespace, err := namespaceOf(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if namespace != "" && strings.HasPrefix(r.URL.Path, "/_") && !namespaceRoutes[r.URL.Path] {
+		http.Error(w, fmt.Sprintf("%s applies to the whole database, it can't be used with %s", r.URL.Path, namespaceHeader), http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Path { // control endpoints
+	case "/_stats":
+		h.serveStats(w, r)
+		return
+	case "/_readyz":
+		h.serveReadiness(w, r)
+		return
+	case "/_bulk":
+		h.serveBulk(w, r)
+		return
+	case "/_keys":
+		h.serveKeys(w, r)
+		return
+	case "/_exists":
+		h.serveExists(w, r)
+		return
+	case "/_mget":
+		h.serveMget(w, r)
+		return
+	case "/_export":
+		h.serveExport(w, r)
+		return
+	case "/_import":
+		h.serveImport(w, r)
+		return
+	case "/_watch":
+		h.serveWatch(w, r)
+		return
+	case "/_admin/maintenance":
+		h.serveMaintenance(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/_") && r.URL.Path != binaryKeyRoute {
+		// Reserved for control endpoints, such keys are only reachable
+		// through binaryKeyRoute
+		http.NotFound(w, r)
+		return
+	}
+	if h.rejectInMaintenance(w, r) {
+		return
+	}
+	key, err := resolveKey(r)
+	if err != nil {
+		slog.Error("request failed", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if namespace != "" {
+		key = engine.NamespaceKey(namespace, key)
+	}
+	switch r.Method {
+	case "GET", "HEAD": // TODO tests
+		// Only Read. HEAD sends the same headers as GET, without the body.
+		stored, err := h.db.ReadRecord(key)
+		value := stored.RawData
+		if err != nil {
+			slog.Debug("read failed", "key", key, "error", err)
+			w.WriteHeader(errorStatus(err))
+		} else {
+			// The key exists, so a record which can't be decoded is
+			// corrupted rather than missing
+			nsr, err := record.Deserialize(value)
+			if err != nil {
+				slog.Error("corrupted record", "key", key, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				break
+			}
+			data, ct, err := extractDataAndContentType(nsr)
+			if err != nil {
+				slog.Error("request failed", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				slog.Debug("serving data", "key", key)
+				replayHeaders(w, nsr)
+				setExpiryHeaders(w, stored.ExpiresAt)
+				setTimestampHeaders(w, stored)
+				ct = h.responseContentType(key, ct)
+				w.Header().Add("Vary", "Accept-Encoding")
+				// Partial responses are never compressed, as their ranges
+				// refer to the stored bytes
+				compress := r.Header.Get("Range") == "" && len(data) >= gzipMinSize &&
+					acceptsGzip(r) && compressible(ct)
+				tag := etag(value)
+				if compress { // a different representation needs its own tag
+					tag = strings.TrimSuffix(tag, `"`) + `-gzip"`
+				}
+				w.Header().Set("ETag", tag)
+				if notModified(r, tag, stored.ModifiedAt) {
+					w.WriteHeader(http.StatusNotModified)
+					break
+				}
+				w.Header().Set("Accept-Ranges", "bytes")
+				start, end, partial, err := parseRange(r.Header.Get("Range"), len(data))
+				if err != nil {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					break
+				}
+				status := http.StatusOK
+				if !partial {
+					// Lets clients verify the value they receive, once
+					// decompressed
+					w.Header().Set(checksumHeader, fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)))
+				}
+				if partial {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+					data = data[start : end+1]
+					status = http.StatusPartialContent
+				}
+				// Headers must be set before the first write. The value is
+				// streamed from the stored bytes without copying it.
+				w.Header().Set("Content-Type", ct)
+				if compress {
+					w.Header().Set("Content-Encoding", "gzip")
+					w.WriteHeader(status)
+					if r.Method == "HEAD" {
+						break
+					}
+					gz := gzip.NewWriter(w)
+					if _, err := gz.Write(data); err != nil {
+						slog.Error("streaming failed", "key", key, "error", err)
+					}
+					if err := gz.Close(); err != nil {
+						slog.Error("streaming failed", "key", key, "error", err)
+					}
+					break
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.WriteHeader(status)
+				if r.Method == "HEAD" {
+					break
+				}
+				if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+					// The status was already sent, all we can do is log
+					slog.Error("streaming failed", "key", key, "error", err)
+				}
+			}
+		}
+	case "POST":
+		// Creates if not exists, otherwise denies
+		if src := r.Header.Get("X-Nabia-Move-From"); src != "" {
+			h.copyKey(w, r, src, key, true)
+			break
+		}
+		body, err := h.readBody(w, r)
+		if err != nil {
+			slog.Error("request failed", "error", err)
+			w.WriteHeader(bodyErrorStatus(err))
+		} else if len(body) == 0 && !h.db.AllowEmptyValues() {
+			slog.Error("request failed", "error", engine.ErrValueEmpty)
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			ct := h.requestContentType(r, body) // TODO Content-Type validation needs more checks
+			headers, err := h.captureHeaders(r)
+			if err != nil {
+				slog.Error("request failed", "error", err)
+				w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+				break
+			}
+			nsr, err := record.New(body, ct, headers...)
+			if err != nil {
+				slog.Error("request failed", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			} else if written, err := h.db.WriteIfAbsent(key, nsr.Serialize()); !written && err != nil {
+				slog.Error("request failed", "error", err)
+				w.WriteHeader(errorStatus(err))
+			} else if written {
+				h.setSequenceHeader(w)
+				w.WriteHeader(http.StatusCreated)
+			} else {
+				existing, err := h.db.Read(key)
+				if err == nil && noneMatch(r.Header.Get("If-None-Match"), etag(existing)) {
+					// "If-None-Match: *" makes the creation conditional
+					w.WriteHeader(http.StatusPreconditionFailed)
+					break
+				}
+				// With "Prefer: return=representation" the loser of a race
+				// learns the winning value without another round trip
+				if err == nil && prefersRepresentation(r) {
+					if nsr, err := record.Deserialize(existing); err == nil {
+						w.Header().Set("Content-Type", nsr.GetContentType())
+						response = nsr.GetRawData()
+					}
+				}
+				w.WriteHeader(http.StatusConflict)
+			}
+		}
+	case "PUT":
+		// Overwrites if exists, otherwise creates
+		if src := r.Header.Get("X-Nabia-Copy-From"); src != "" {
+			h.copyKey(w, r, src, key, false)
+			break
+		}
+		body, err := h.readBody(w, r)
+		if err != nil {
+			slog.Error("request failed", "error", err)
+			w.WriteHeader(bodyErrorStatus(err))
+		} else if len(body) == 0 && !h.db.AllowEmptyValues() {
+			slog.Error("request failed", "error", engine.ErrValueEmpty)
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			ct := h.requestContentType(r, body)
+			headers, err := h.captureHeaders(r)
+			if err != nil {
+				slog.Error("request failed", "error", err)
+				w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+				break
+			}
+			existed := h.db.Exists(key)
+			nsr, err := record.New(body, ct, headers...)
+			if err != nil {
+				slog.Error("request failed", "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			} else if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+				// Optimistic concurrency: the value is only replaced if it is
+				// still the version the client has seen. The swap fails if
+				// another writer got in between, so the check is atomic.
+				current, err := h.db.Read(key)
+				if err != nil || !match(ifMatch, etag(current)) {
+					w.WriteHeader(http.StatusPreconditionFailed)
+				} else if swapped, err := h.db.CompareAndSwap(key, current, nsr.Serialize()); !swapped && err != nil {
+					slog.Error("request failed", "error", err)
+					w.WriteHeader(errorStatus(err))
+				} else if !swapped {
+					w.WriteHeader(http.StatusPreconditionFailed)
+				} else {
+					h.setSequenceHeader(w)
+					w.WriteHeader(http.StatusOK)
+				}
+			} else if err := h.db.Write(key, nsr.Serialize()); err != nil {
+				slog.Error("request failed", "error", err)
+				w.WriteHeader(errorStatus(err))
+			} else {
+				h.setSequenceHeader(w)
+				if existed {
+					w.WriteHeader(http.StatusOK)
+				} else {
+					w.WriteHeader(http.StatusCreated)
+				}
+			}
+		}
+	case "PATCH":
+		// Either a structured update of a stored JSON document, selected by
+		// the Content-Type of the patch, or a write of the body into the
+		// stored bytes: appended by default, or at X-Nabia-Offset
+		body, err := h.readBody(w, r)
+		if err != nil {
+			slog.Error("request failed", "error", err)
+			w.WriteHeader(bodyErrorStatus(err))
+			break
+		}
+		patchType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		structured := patchType == mergePatchType || patchType == jsonPatchType
+		offset := int64(-1) // append
+		if header := r.Header.Get("X-Nabia-Offset"); header != "" && !structured {
+			offset, err = strconv.ParseInt(header, 10, 64)
+			if err != nil || offset < 0 {
+				slog.Error("invalid X-Nabia-Offset", "offset", header)
+				w.WriteHeader(http.StatusBadRequest)
+				break
+			}
+			if offset > h.maxValueSize { // keeps the offset and the body from overflowing
+				http.Error(w, fmt.Sprintf("patched value exceeds %d bytes", h.maxValueSize), http.StatusRequestEntityTooLarge)
+				break
+			}
+		}
+		err = h.db.Update(key, func(current []byte) ([]byte, error) {
+			nsr, err := record.Deserialize(current)
+			if err != nil {
+				return nil, err
+			}
+			var patched []byte
+			if structured {
+				if !isJSON(nsr.GetContentType()) {
+					return nil, patchErrorf(http.StatusUnsupportedMediaType, "value of key %q isn't JSON", key)
+				}
+				if patched, err = applyPatch(nsr.GetRawData(), body, patchType); err != nil {
+					return nil, err
+				}
+			} else {
+				at := offset
+				if at < 0 {
+					at = int64(len(nsr.GetRawData()))
+				}
+				if at > h.maxValueSize-int64(len(body)) { // checked before allocating
+					return nil, patchErrorf(http.StatusRequestEntityTooLarge, "patched value exceeds %d bytes", h.maxValueSize)
+				}
+				patched = patchBytes(nsr.GetRawData(), body, at)
+			}
+			if int64(len(patched)) > h.maxValueSize {
+				return nil, patchErrorf(http.StatusRequestEntityTooLarge, "patched value exceeds %d bytes", h.maxValueSize)
+			}
+			updated, err := record.New(patched, nsr.GetContentType(), nsr.GetHeaders()...)
+			if err != nil {
+				return nil, err
+			}
+			return updated.Serialize(), nil
+		})
+		var pe *patchError
+		if errors.As(err, &pe) {
+			slog.Error("request failed", "error", err)
+			w.WriteHeader(pe.status)
+			response = []byte(err.Error())
+		} else if err != nil {
+			slog.Error("request failed", "error", err)
+			w.WriteHeader(errorStatus(err))
+		} else {
+			h.setSequenceHeader(w)
+			w.WriteHeader(http.StatusOK)
+		}
+	case "DELETE": // TODO tests
+		// Only Destroy
+		if h.db.Exists(key) {
+			if err := h.db.Delete(key); err != nil {
+				slog.Error("request failed", "error", err)
+				w.WriteHeader(errorStatus(err))
+				break
+			}
+			h.setSequenceHeader(w)
+			w.WriteHeader(http.StatusOK)
+		} else {
+			// Either 404 or, for idempotent-friendly setups, 204, as the
+			// key is absent regardless
+			w.WriteHeader(h.deleteMissingStatus)
+		}
+	case "OPTIONS":
+		w.Header().Set("Allow", h.allowedMethods(h.db.Exists(key)))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+	w.Write(response)
+}
+
+// tlsFiles returns the certificate and key files to serve HTTPS with, or empty
+// strings to serve plain HTTP. Setting only one of tls_cert and tls_key is an
+// error, rather than silently falling back to plain HTTP.
+func tlsFiles() (string, string, error) {
+	certFile, keyFile := viper.GetString("tls_cert"), viper.GetString("tls_key")
+	if (certFile == "") != (keyFile == "") {
+		return "", "", fmt.Errorf("tls_cert and tls_key must be set together to serve HTTPS")
+	}
+	return certFile, keyFile, nil
+}
+
+// startServer binds the configured address, forks into a goroutine to serve
+// requests on it, then, making use of the ready channel, informs the caller
+// when the server is ready to receive requests. The returned server is what
+// shutdown stops. If the address can't be bound, the error is returned and
+// ready is never closed.
+func startServer(http_handler http.Handler, ready chan struct{}) (*http.Server, error) {
+	viper.SetDefault("port", 5380)
+	addr := net.JoinHostPort(viper.GetString("bind_address"), viper.GetString("port"))
+	certFile, keyFile, err := tlsFiles()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	slog.Info("listening", "address", listener.Addr().String())
+	server := &http.Server{Addr: addr, Handler: http_handler}
+	go func() {
+		// Start the server
+		var err error
+		if certFile != "" {
+			slog.Info("serving HTTPS")
+			err = server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("failed to start the server", "error", err)
+			os.Exit(1)
+		}
+	}()
+	// Check if the server is ready by trying to connect to the bound address
+	for {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		conn.Close()
+		break
+	}
+	// Signal that the server is ready
+	close(ready)
+	return server, nil
+}
+
+// shutdownTimeout is how long in-flight requests are given to complete once a
+// shutdown starts.
+const shutdownTimeout = 5 * time.Second
+
+// stoppableHandler is served by the server, and stopped once it is shut down.
+// Its streams are ended first, as they only end otherwise when their client
+// goes away. Its settings which can change at runtime are reloaded on SIGHUP.
+type stoppableHandler interface {
+	http.Handler
+	Stop() error
+	endWatches()
+	reload()
+}
+
+// Stop saves and stops the database.
+func (h *NabiaHTTP) Stop() error {
+	return h.db.Stop()
+}
+
+// shutdown ends the streams of /_watch, stops accepting connections, waits for
+// the in-flight requests to complete, and only then stops the handler, so the
+// final save holds every acknowledged write. It returns the errors of both
+// steps instead of exiting, leaving the exit code to the caller.
+func shutdown(server *http.Server, handler stoppableHandler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	handler.endWatches()
+	shutdownErr := server.Shutdown(ctx)
+	if shutdownErr != nil {
+		shutdownErr = fmt.Errorf("failed to drain in-flight requests: %w", shutdownErr)
+	}
+	stopErr := handler.Stop()
+	if stopErr != nil {
+		stopErr = fmt.Errorf("failed to save the database: %w", stopErr)
+	}
+	return errors.Join(shutdownErr, stopErr)
+}
+
+// openDB opens the database at location and applies the persistence settings
+// of the configuration. With read_only, the database is frozen once loaded.
+func openDB(location string) (*engine.NabiaDB, error) {
+	db, err := openStorage(location)
+	if err != nil {
+		return nil, err
+	}
+	db.SetReadOnly(viper.GetBool("read_only"))
+	db.SetAllowEmptyValues(viper.GetBool("allow_empty_values"))
+	if viper.IsSet("io_concurrency") {
+		if err := db.SetIOConcurrency(viper.GetInt("io_concurrency")); err != nil {
+			return nil, err
+		}
+	}
+	if shards := viper.GetInt("shards"); shards > 0 {
+		if err := db.SetShards(shards); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.SetMaxKeys(viper.GetInt64("max_keys")); err != nil {
+		return nil, err
+	}
+	if err := db.SetMaxMemory(viper.GetInt64("max_memory_bytes")); err != nil {
+		return nil, err
+	}
+	if err := db.SetMaxWatchers(viper.GetInt("max_watchers")); err != nil {
+		return nil, err
+	}
+	quotas, err := namespaceQuotas()
+	if err != nil {
+		return nil, err
+	}
+	for namespace, quota := range quotas {
+		if err := db.SetNamespaceQuota(namespace, quota); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// openStorage opens the database at location, loading its last snapshot if
+// there is one, so the keys saved on shutdown survive a restart. With the
+// write-ahead log enabled, the log is replayed on top of that snapshot, so the
+// writes made since then survive a crash as well. With
+// create_db_dir, missing directories of location are created first, and the
+// files of the database get the permissions of db_file_mode when it is set.
+// With compress_db, snapshots are saved gzipped, and with
+// encryption_passphrase, encrypted; both kinds are loaded either way.
+func openStorage(location string) (*engine.NabiaDB, error) {
+	if viper.GetBool("create_db_dir") {
+		if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+			return nil, fmt.Errorf("creating the directory of db_location: %w", err)
+		}
+	}
+	mode, err := dbFileMode()
+	if err != nil {
+		return nil, err
+	}
+	passphrase := viper.GetString("encryption_passphrase")
+	var db *engine.NabiaDB
+	if info, err := os.Stat(location); err == nil && info.Size() > 0 {
+		if passphrase != "" {
+			db, err = engine.NabiaDBFromEncryptedFile(location, passphrase)
+		} else {
+			db, err = engine.NabiaDBFromFile(location)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		db, err = engine.NewNabiaDB(location)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.SetEncryptionPassphrase(passphrase); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.SetFileMode(mode); err != nil {
+		return nil, err
+	}
+	db.SetCompression(viper.GetBool("compress_db"))
+	if !viper.GetBool("wal") {
+		return db, nil
+	}
+	viper.SetDefault("fsync_policy", "os")
+	viper.SetDefault("fsync_interval_ms", 1000)
+	policy, err := engine.ParseFsyncPolicy(viper.GetString("fsync_policy"))
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(viper.GetInt("fsync_interval_ms")) * time.Millisecond
+	if err := db.EnableWAL(policy, interval); err != nil {
+		return nil, err
+	}
+	if err := db.SetWALCompaction(viper.GetInt64("wal_compact_bytes")); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// dbFileMode returns the permissions of db_file_mode, an octal number such as
+// 0600, or 0 when it isn't set, which keeps the defaults of the engine.
+func dbFileMode() (os.FileMode, error) {
+	setting := viper.GetString("db_file_mode")
+	if setting == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(setting, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("db_file_mode must be an octal mode between 0001 and 0777, got %q", setting)
+	}
+	return os.FileMode(mode), nil
+}
+
+// namespaceQuotas returns the quotas of namespace_quotas, a map of namespaces
+// to their max_keys and max_bytes, along with the default quota of
+// namespace_max_keys and namespace_max_bytes under the empty namespace. It
+// returns no quota at all while none is set, so writes aren't serialized for
+// nothing, see engine.SetNamespaceQuota.
+func namespaceQuotas() (map[string]engine.Quota, error) {
+	var settings map[string]struct {
+		MaxKeys  int64 `mapstructure:"max_keys"`
+		MaxBytes int64 `mapstructure:"max_bytes"`
+	}
+	if err := viper.UnmarshalKey("namespace_quotas", &settings); err != nil {
+		return nil, fmt.Errorf("namespace_quotas: %w", err)
+	}
+	quotas := make(map[string]engine.Quota)
+	for namespace, setting := range settings {
+		if !validTenant.MatchString(namespace) {
+			return nil, fmt.Errorf("namespace_quotas: invalid namespace %q", namespace)
+		}
+		if setting.MaxKeys < 0 || setting.MaxBytes < 0 {
+			return nil, fmt.Errorf("namespace_quotas: the quota of %s cannot be negative", namespace)
+		}
+		quotas[namespace] = engine.Quota{MaxKeys: setting.MaxKeys, MaxBytes: setting.MaxBytes}
+	}
+	if keys, bytes := viper.GetInt64("namespace_max_keys"), viper.GetInt64("namespace_max_bytes"); keys != 0 || bytes != 0 {
+		if keys < 0 || bytes < 0 {
+			return nil, fmt.Errorf("namespace_max_keys and namespace_max_bytes cannot be negative, got %d and %d", keys, bytes)
+		}
+		quotas[""] = engine.Quota{MaxKeys: keys, MaxBytes: bytes}
+	}
+	return quotas, nil
+}
+
+// Main runs the Nabia server, configured by the command line, the
+// environment and the configuration file, until it receives SIGINT or SIGTERM.
+func Main() {
+	slog.Info("starting Nabia")
+
+	bindEnv()
+	viper.SetDefault("db_location", defaultDBLocation)
+
+	if err := bindFlags(os.Args[1:]); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			os.Exit(0)
+		}
+		slog.Error("invalid arguments", "error", err)
+		os.Exit(2)
+	}
+
+	found, err := readConfig()
+	if err != nil {
+		panic(fmt.Errorf("fatal error config file: %s", err))
+	}
+	if err := validateConfig(); err != nil {
+		slog.Error("invalid configuration:\n" + err.Error())
+		os.Exit(1)
+	}
+	logger, err := newLogger(os.Stderr)
+	if err != nil { // unreachable, validateConfig checks the settings
+		panic(err)
+	}
+	slog.SetDefault(logger)
+	if found {
+		slog.Info("found configuration file", "file", viper.ConfigFileUsed())
+	} else {
+		slog.Info("no configuration file found, using the defaults, flags and environment")
+	}
+
+	var handler stoppableHandler
+	if tenantsDir := viper.GetString("tenants_dir"); tenantsDir != "" {
+		viper.SetDefault("max_tenants", defaultMaxTenants)
+		handler = newTenantRouter(tenantsDir, viper.GetString("tenant_domain"), viper.GetInt("max_tenants"))
+	} else {
+		location, err := dbLocation()
+		if err != nil { // unreachable, validateConfig checks the settings
+			panic(err)
+		}
+		slog.Info("opening the database", "db_location", location)
+		db, err := openDB(location)
+		if err != nil {
+			slog.Error("failed to start NabiaDB", "error", err)
+			os.Exit(1)
+		}
+		handler = NewNabiaHttp(db)
+	}
+	ready := make(chan struct{})
+	server, err := startServer(handler, ready)
+	if err != nil {
+		slog.Error("failed to start the server", "error", err)
+		os.Exit(1)
+	}
+	<-ready
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	received := <-signals
+	for ; received == syscall.SIGHUP; received = <-signals {
+		if err := reloadConfig(handler); err != nil {
+			slog.Error("failed to reload the configuration", "error", err)
+		}
+	}
+	slog.Info("shutting down", "signal", received.String())
+	if err := shutdown(server, handler); err != nil {
+		slog.Error("failed to shut down", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Nabia stopped")
+}
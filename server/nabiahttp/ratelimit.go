@@ -0,0 +1,104 @@
+package nabiahttp
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bucketIdleTime is how long the bucket of a client may go unused before it is
+// dropped. A dropped bucket is refilled anyway by the time it is needed again.
+const bucketIdleTime = 10 * time.Minute
+
+// tokenBucket holds the requests a client may still make right away.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when tokens was last refilled
+}
+
+// rateLimiter throttles each client IP to rate requests per second, allowing
+// bursts of up to burst requests.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu          sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+}
+
+// newRateLimiter returns a limiter of rate requests per second with bursts of
+// burst requests, or nil when rate isn't positive, which disables limiting. A
+// burst below 1 defaults to one second worth of requests.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &rateLimiter{
+		rate:        rate,
+		burst:       float64(burst),
+		now:         time.Now,
+		buckets:     map[string]*tokenBucket{},
+		lastCleanup: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of ip. When the bucket is empty it
+// returns false and how long until the next token.
+func (rl *rateLimiter) allow(ip string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	if now.Sub(rl.lastCleanup) >= bucketIdleTime {
+		rl.cleanup(now)
+	}
+	b, ok := rl.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[ip] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// cleanup drops the buckets left idle for bucketIdleTime, so the map doesn't
+// grow with every client ever seen.
+func (rl *rateLimiter) cleanup(now time.Time) {
+	for ip, b := range rl.buckets {
+		if now.Sub(b.last) >= bucketIdleTime {
+			delete(rl.buckets, ip)
+		}
+	}
+	rl.lastCleanup = now
+}
+
+// throttle answers 429 to clients which exceeded the rate limit, and tells
+// whether it did. Requests made with an API key which may write aren't
+// limited.
+func (h *NabiaHTTP) throttle(w http.ResponseWriter, r *http.Request, clientIP string) bool {
+	limiter := h.settings.Load().limiter
+	if limiter == nil {
+		return false
+	}
+	if _, canWrite := h.apiKeyAccess(r); canWrite {
+		return false
+	}
+	allowed, wait := limiter.allow(clientIP)
+	if allowed {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	return true
+}
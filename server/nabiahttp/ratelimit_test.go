@@ -0,0 +1,76 @@
+package nabiahttp
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	setConfig(t, "rate_limit_rps", 0.5)
+	setConfig(t, "rate_limit_burst", 3)
+	setConfig(t, "api_keys", []string{"full"})
+	setConfig(t, "read_only_api_keys", []string{"reader"})
+	server, teardown := newTestServer(t)
+	defer teardown()
+
+	send := func(key string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL+"/key", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		response, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error on GET: %s", err)
+		}
+		response.Body.Close()
+		return response
+	}
+	for i := 0; i < 3; i++ {
+		if response := send("reader"); response.StatusCode == http.StatusTooManyRequests {
+			t.Fatalf("Request %d within the burst was limited", i)
+		}
+	}
+	response := send("reader")
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Request beyond the burst wasn't limited: got %d", response.StatusCode)
+	}
+	if retry := response.Header.Get("Retry-After"); retry != "2" {
+		t.Errorf("Unexpected Retry-After: got %q, expected %q", retry, "2")
+	}
+	for i := 0; i < 5; i++ {
+		if response := send("full"); response.StatusCode == http.StatusTooManyRequests {
+			t.Fatal("Request with a full-access key was limited")
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	rl := newRateLimiter(1, 2)
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.allow("10.0.0.1"); !ok {
+			t.Fatalf("Request %d within the burst was refused", i)
+		}
+	}
+	if ok, wait := rl.allow("10.0.0.1"); ok || wait != time.Second {
+		t.Errorf("Unexpected result beyond the burst: got %t, waiting %s", ok, wait)
+	}
+	if ok, _ := rl.allow("10.0.0.2"); !ok {
+		t.Error("Another client was limited by the first one's requests")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := rl.allow("10.0.0.1"); !ok {
+		t.Error("Bucket wasn't refilled")
+	}
+
+	now = now.Add(bucketIdleTime)
+	rl.allow("10.0.0.3")
+	if _, ok := rl.buckets["10.0.0.1"]; ok || len(rl.buckets) != 1 {
+		t.Errorf("Idle buckets weren't dropped: %d left", len(rl.buckets))
+	}
+	if newRateLimiter(0, 10) != nil {
+		t.Error("Rate limiting wasn't disabled by a zero rate")
+	}
+}
@@ -0,0 +1,96 @@
+package nabiahttp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// reloadableSettings are the settings of a NabiaHTTP which reloadConfig
+// changes at runtime. They are swapped all at once, so a request never sees
+// some of them reloaded and others not.
+type reloadableSettings struct {
+	limiter         *rateLimiter  // throttles requests per client IP, nil when unlimited
+	corsOrigins     []string      // origins allowed to make cross-origin requests, "*" for any
+	corsCredentials bool          // whether cross-origin requests may carry credentials
+	slowRequest     time.Duration // requests taking longer are logged as warnings, 0 disables them
+}
+
+// loadReloadableSettings returns the reloadable settings of the configuration.
+func loadReloadableSettings() *reloadableSettings {
+	return &reloadableSettings{
+		limiter:         newRateLimiter(viper.GetFloat64("rate_limit_rps"), viper.GetInt("rate_limit_burst")),
+		corsOrigins:     viper.GetStringSlice("cors_allowed_origins"),
+		corsCredentials: viper.GetBool("cors_allow_credentials"),
+		slowRequest:     time.Duration(viper.GetInt64("slow_request_ms")) * time.Millisecond,
+	}
+}
+
+// reload applies the reloadable settings of the configuration. The rate limiter
+// starts afresh, with the buckets of every client full.
+func (h *NabiaHTTP) reload() {
+	h.settings.Store(loadReloadableSettings())
+}
+
+// reload applies the reloadable settings of the configuration to every
+// tenant. Tenants opened later get them as well.
+func (tr *tenantRouter) reload() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, h := range tr.tenants {
+		h.reload()
+	}
+}
+
+// restartSettings are the settings only read at startup, whose changes are
+// reported by reloadConfig rather than applied.
+var restartSettings = []string{
+	"port", "bind_address", "tls_cert", "tls_key", "db_location", "tenants_dir", "tenant_domain", "max_tenants",
+	"wal", "fsync_policy", "fsync_interval_ms", "wal_compact_bytes", "read_only", "shards", "io_concurrency",
+	"max_keys", "max_memory_bytes", "max_watchers", "namespace_max_keys", "namespace_max_bytes", "namespace_quotas",
+	"create_db_dir", "db_file_mode", "compress_db", "encryption_passphrase", "admin_token", "api_keys",
+	"read_only_api_keys", "stored_headers", "delete_missing_status", "max_value_size", "guess_content_type",
+	"sniff_content_type", "allow_empty_values",
+}
+
+// reloadConfig reads the configuration file again, if there is one, on SIGHUP,
+// and applies the settings which can change at runtime: log_level and
+// log_format, which replace the default logger, slow_request_ms,
+// rate_limit_rps, rate_limit_burst, cors_allowed_origins and
+// cors_allow_credentials. Changes of the other settings are logged as warnings
+// and ignored until the next restart. An invalid configuration is refused as a
+// whole, keeping the current settings.
+func reloadConfig(handler stoppableHandler) error {
+	previous := make(map[string]interface{}, len(restartSettings))
+	for _, setting := range restartSettings {
+		previous[setting] = viper.Get(setting)
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		// Without a file, the environment may still have changed
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return fmt.Errorf("failed to read the configuration: %w", err)
+		}
+	}
+	if err := validateConfig(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	for _, setting := range restartSettings {
+		if !reflect.DeepEqual(previous[setting], viper.Get(setting)) {
+			slog.Warn("setting changed, restart Nabia to apply it", "setting", setting)
+		}
+	}
+	logger, err := newLogger(os.Stderr)
+	if err != nil { // unreachable, validateConfig checks the settings
+		return err
+	}
+	slog.SetDefault(logger)
+	handler.reload()
+	slog.Info("configuration reloaded", "file", viper.ConfigFileUsed())
+	return nil
+}
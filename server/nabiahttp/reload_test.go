@@ -0,0 +1,129 @@
+package nabiahttp
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	engine "github.com/Nabia-DB/nabia/core/engine"
+	"github.com/spf13/viper"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.yaml")
+	writeConfig := func(content string) {
+		t.Helper()
+		content = "db_location: " + filepath.Join(dir, "nabia.db") + "\n" + content
+		if err := os.WriteFile(config, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("port: \"5380\"\n")
+	viper.SetConfigFile(config)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatalf("Failed to read the configuration: %s", err)
+	}
+	defaultLogger := slog.Default()
+	t.Cleanup(func() {
+		// The settings of the file mustn't leak into other tests
+		os.WriteFile(config, nil, 0644)
+		viper.ReadInConfig()
+		slog.SetDefault(defaultLogger)
+	})
+	db := engine.NewInMemoryNabiaDB()
+	defer db.Stop()
+	handler := NewNabiaHttp(db)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	writeConfig(`port: "6000"
+log_level: debug
+slow_request_ms: 250
+rate_limit_rps: 1
+cors_allowed_origins: ["https://app.example.com"]
+`)
+	if err := reloadConfig(handler); err != nil {
+		t.Fatalf("Failed to reload the configuration: %s", err)
+	}
+	settings := handler.settings.Load()
+	if settings.slowRequest != 250*time.Millisecond {
+		t.Errorf("Unexpected slow request threshold: %s", settings.slowRequest)
+	}
+	if settings.allowedOrigin("https://app.example.com") != "https://app.example.com" {
+		t.Errorf("The allowed origins weren't reloaded: %q", settings.corsOrigins)
+	}
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("The log level wasn't reloaded")
+	}
+	var statuses []int
+	for i := 0; i < 2; i++ {
+		response, err := http.Get(server.URL + "/key")
+		if err != nil {
+			t.Fatalf("GET failed: %s", err)
+		}
+		response.Body.Close()
+		statuses = append(statuses, response.StatusCode)
+	}
+	if statuses[1] != http.StatusTooManyRequests {
+		t.Errorf("The rate limit wasn't reloaded: got %d", statuses)
+	}
+	if viper.GetString("port") != "6000" {
+		t.Errorf("Unexpected port in the configuration: %q", viper.GetString("port"))
+	}
+
+	// An invalid configuration changes nothing
+	writeConfig("log_level: loud\nslow_request_ms: 500\n")
+	if err := reloadConfig(handler); err == nil {
+		t.Error("An invalid configuration was reloaded")
+	}
+	if handler.settings.Load() != settings || !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("An invalid configuration was applied")
+	}
+}
+
+func TestReloadWithoutConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if _, err := os.Stat("/etc/nabia/config.yaml"); err == nil {
+		t.Skip("/etc/nabia/config.yaml exists")
+	}
+	if found, err := readConfig(); err != nil || found {
+		t.Fatalf("Unexpected result without a configuration file: %t (%v)", found, err)
+	}
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+	db := engine.NewInMemoryNabiaDB()
+	defer db.Stop()
+	handler := NewNabiaHttp(db)
+
+	// The environment is applied all the same
+	bindEnv()
+	t.Setenv("NABIA_SLOW_REQUEST_MS", "250")
+	if err := reloadConfig(handler); err != nil {
+		t.Fatalf("Failed to reload without a configuration file: %s", err)
+	}
+	settings := handler.settings.Load()
+	if settings.slowRequest != 250*time.Millisecond {
+		t.Errorf("Unexpected slow request threshold: %s", settings.slowRequest)
+	}
+
+	// and still validated
+	t.Setenv("NABIA_LOG_LEVEL", "loud")
+	if err := reloadConfig(handler); err == nil {
+		t.Error("An invalid environment was reloaded")
+	}
+	if handler.settings.Load() != settings {
+		t.Error("An invalid environment was applied")
+	}
+}
@@ -0,0 +1,141 @@
+package nabiahttp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// tenantHeader selects the tenant of a request, taking precedence over the
+// subdomain.
+const tenantHeader = "X-Nabia-Tenant"
+
+// defaultMaxTenants is the default limit for the number of open tenants.
+const defaultMaxTenants = 100
+
+// errTooManyTenants is returned when a new tenant would exceed max_tenants.
+var errTooManyTenants = fmt.Errorf("too many tenants")
+
+// validTenant restricts tenant names to what can safely name a file and be a
+// DNS label.
+var validTenant = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// tenantRouter isolates tenants from each other by giving each its own
+// database, stored in its own file under dir, so tenants can be backed up and
+// deleted independently. Databases are opened on the first request of their
+// tenant.
+type tenantRouter struct {
+	dir        string // directory holding the database of every tenant
+	domain     string // tenants are the subdomains of this domain, if set
+	maxTenants int    // tenants beyond this number are refused
+
+	mu      sync.Mutex
+	tenants map[string]*NabiaHTTP
+}
+
+func newTenantRouter(dir, domain string, maxTenants int) *tenantRouter {
+	if maxTenants <= 0 {
+		slog.Warn("max_tenants must be positive, using the default", "max_tenants", maxTenants, "default", defaultMaxTenants)
+		maxTenants = defaultMaxTenants
+	}
+	return &tenantRouter{
+		dir:        dir,
+		domain:     strings.ToLower(strings.Trim(domain, ".")),
+		maxTenants: maxTenants,
+		tenants:    map[string]*NabiaHTTP{},
+	}
+}
+
+// tenantOf returns the tenant named by the X-Nabia-Tenant header or, failing
+// that, by the subdomain of the Host header, such as acme for
+// acme.nabia.example.com when the domain is nabia.example.com.
+func (tr *tenantRouter) tenantOf(r *http.Request) (string, error) {
+	tenant := r.Header.Get(tenantHeader)
+	if tenant == "" && tr.domain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		tenant, _ = strings.CutSuffix(strings.ToLower(host), "."+tr.domain)
+		if tenant == strings.ToLower(host) {
+			tenant = ""
+		}
+	}
+	if tenant == "" {
+		return "", fmt.Errorf("no tenant in the %s header or the subdomain", tenantHeader)
+	}
+	if !validTenant.MatchString(tenant) {
+		return "", fmt.Errorf("invalid tenant %q", tenant)
+	}
+	return tenant, nil
+}
+
+// handler returns the handler of tenant, opening its database if needed.
+func (tr *tenantRouter) handler(tenant string) (*NabiaHTTP, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if h, ok := tr.tenants[tenant]; ok {
+		return h, nil
+	}
+	if len(tr.tenants) >= tr.maxTenants {
+		return nil, errTooManyTenants
+	}
+	db, err := openDB(filepath.Join(tr.dir, tenant+".db"))
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("opened the database of a tenant", "tenant", tenant)
+	h := NewNabiaHttp(db)
+	tr.tenants[tenant] = h
+	return h, nil
+}
+
+func (tr *tenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tr.tenantOf(r)
+	if err != nil {
+		slog.Error("request failed", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h, err := tr.handler(tenant)
+	if err == errTooManyTenants {
+		slog.Error("refused a tenant, too many are open", "tenant", tenant, "max_tenants", tr.maxTenants)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		slog.Error("request failed", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// endWatches ends the streams of /_watch of every tenant.
+func (tr *tenantRouter) endWatches() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, h := range tr.tenants {
+		h.endWatches()
+	}
+}
+
+// Stop saves and stops the database of every tenant, returning the errors of
+// the saves which failed.
+func (tr *tenantRouter) Stop() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var errs []error
+	for tenant, h := range tr.tenants {
+		if err := h.Stop(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %q: %w", tenant, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,85 @@
+package nabiahttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	engine "github.com/Nabia-DB/nabia/core/engine"
+	"github.com/Nabia-DB/nabia/core/record"
+)
+
+func TestTenants(t *testing.T) {
+	dir := t.TempDir()
+	router := newTenantRouter(dir, "nabia.example.com", 2)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	send := func(method, tenant, host, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+"/key", strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		if tenant != "" {
+			req.Header.Set(tenantHeader, tenant)
+		}
+		if host != "" {
+			req.Host = host
+		}
+		response, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error on %s: %s", method, err)
+		}
+		defer response.Body.Close()
+		b, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(b)
+	}
+
+	if status, _ := send("PUT", "acme", "", "acme value"); status != http.StatusCreated {
+		t.Fatalf("Unexpected status of PUT to acme: %d", status)
+	}
+	if status, _ := send("PUT", "", "globex.nabia.example.com:5380", "globex value"); status != http.StatusCreated {
+		t.Fatalf("Unexpected status of PUT to globex: %d", status)
+	}
+	if status, body := send("GET", "", "acme.nabia.example.com", ""); status != http.StatusOK || body != "acme value" {
+		t.Errorf("Unexpected value of acme: got %d %q", status, body)
+	}
+	if status, body := send("GET", "globex", "", ""); status != http.StatusOK || body != "globex value" {
+		t.Errorf("Unexpected value of globex: got %d %q", status, body)
+	}
+
+	tests := []struct {
+		name     string
+		tenant   string
+		host     string
+		expected int
+	}{
+		{"no tenant", "", "", http.StatusBadRequest},
+		{"other domain", "", "acme.example.org", http.StatusBadRequest},
+		{"invalid tenant", "../etc", "", http.StatusBadRequest},
+		{"beyond max_tenants", "initech", "", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		if status, _ := send("GET", tt.tenant, tt.host, ""); status != tt.expected {
+			t.Errorf("%s: got %d, expected %d", tt.name, status, tt.expected)
+		}
+	}
+
+	router.Stop()
+	for tenant, expected := range map[string]string{"acme": "acme value", "globex": "globex value"} {
+		db, err := engine.NabiaDBFromFile(filepath.Join(dir, tenant+".db"))
+		if err != nil {
+			t.Fatalf("Failed to load the database of %s: %s", tenant, err)
+		}
+		value, err := db.Read("/key")
+		if err != nil {
+			t.Fatalf("Value of %s wasn't persisted: %s", tenant, err)
+		}
+		if nsr, err := record.Deserialize(value); err != nil || string(nsr.GetRawData()) != expected {
+			t.Errorf("Unexpected value persisted for %s: %q", tenant, value)
+		}
+		db.Stop()
+	}
+}
@@ -0,0 +1,132 @@
+package nabiahttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	engine "github.com/Nabia-DB/nabia/core/engine"
+	record "github.com/Nabia-DB/nabia/core/record"
+)
+
+// watchKeepAlive is how often a comment is sent on idle streams of /_watch,
+// so that proxies keep them open and clients which went away are noticed.
+const watchKeepAlive = 30 * time.Second
+
+// watchWriteTimeout bounds the time an event may take to be sent: a client
+// not reading its stream is disconnected rather than holding up its handler
+// forever.
+const watchWriteTimeout = 10 * time.Second
+
+// watchShutdownEvent ends the streams of /_watch on shutdown.
+const watchShutdownEvent = "event: shutdown\ndata: {}\n\n"
+
+// watchEvent is the data of an event of /_watch. Values are base64-encoded by
+// encoding/json, and only sent for writes with values=true.
+type watchEvent struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type,omitempty"`
+	Value       []byte `json:"value,omitempty"`
+}
+
+// serveWatch streams the changes of the keys starting with the prefix query
+// parameter as Server-Sent Events, until the client goes away or the server
+// shuts down, which ends the stream with a shutdown event. Events are named
+// after their operation, write or delete, and their data is a watchEvent.
+// With values=true, writes come with the value and Content-Type of the key as
+// it is when the event is sent, which may be newer than the change reported;
+// a key deleted meanwhile comes without them. Changes are delivered as by
+// engine.Subscribe, so a client lagging too far behind misses some of them.
+// Beyond max_watchers streams, new ones are refused with 503.
+func (h *NabiaHTTP) serveWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	values, err := boolParameter(r, "values", false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+
+	events, unsubscribe, err := h.db.Subscribe()
+	if err != nil {
+		slog.Warn("watch refused", "error", err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	defer unsubscribe()
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// The headers tell the client that changes are being watched from now on
+	if err := controller.Flush(); err != nil {
+		slog.Error("request failed", "error", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var message string
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.closing:
+			// Tells clients that the server shut down, rather than crashed
+			controller.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+			if _, err := io.WriteString(w, watchShutdownEvent); err == nil {
+				controller.Flush()
+			}
+			return
+		case <-keepAlive.C:
+			message = ": keep-alive\n\n"
+		case event, open := <-events:
+			if !open { // the database was stopped
+				return
+			}
+			if !strings.HasPrefix(event.Key, prefix) {
+				continue
+			}
+			data := watchEvent{Key: event.Key}
+			if values && event.Op == engine.OpWrite {
+				if raw, err := h.db.Read(event.Key); err == nil {
+					if nsr, err := record.Deserialize(raw); err == nil {
+						data.ContentType, data.Value = nsr.GetContentType(), nsr.GetRawData()
+					}
+				}
+			}
+			payload, err := json.Marshal(data)
+			if err != nil {
+				slog.Error("request failed", "error", err)
+				return
+			}
+			message = fmt.Sprintf("event: %s\ndata: %s\n\n", event.Op, payload)
+		}
+		err := controller.SetWriteDeadline(time.Now().Add(watchWriteTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return
+		}
+		if _, err := w.Write([]byte(message)); err != nil {
+			slog.Debug("watch ended", "error", err)
+			return
+		}
+		if err := controller.Flush(); err != nil {
+			slog.Debug("watch ended", "error", err)
+			return
+		}
+	}
+}
+
+// endWatches ends the streams of /_watch, which would otherwise keep a
+// shutdown waiting for them.
+func (h *NabiaHTTP) endWatches() {
+	h.closeOnce.Do(func() { close(h.closing) })
+}
@@ -0,0 +1,200 @@
+package nabiahttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	engine "github.com/Nabia-DB/nabia/core/engine"
+)
+
+// readEvent returns the name and data of the next event of a stream of
+// /_watch.
+func readEvent(t *testing.T, stream *bufio.Reader) (string, watchEvent) {
+	t.Helper()
+	var name string
+	var data watchEvent
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read an event: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return name, data
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+				t.Fatalf("Malformed data %q: %s", line, err)
+			}
+		}
+	}
+}
+
+// watch opens a stream of /_watch with the given query.
+func watch(t *testing.T, ctx context.Context, url string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to watch: %s", err)
+	}
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response: %s of %q", response.Status, response.Header.Get("Content-Type"))
+	}
+	return response, bufio.NewReader(response.Body)
+}
+
+func TestWatch(t *testing.T) {
+	db := engine.NewInMemoryNabiaDB()
+	defer db.Stop()
+	handler := NewNabiaHttp(db)
+	served := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		if r.URL.Path == "/_watch" {
+			served <- struct{}{}
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	response, stream := watch(t, ctx, server.URL+"/_watch?prefix=/foo/&values=true")
+	defer response.Body.Close()
+
+	put := func(key, value string) {
+		req, _ := http.NewRequest("PUT", server.URL+key, strings.NewReader(value))
+		req.Header.Set("Content-Type", "text/plain")
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT failed: %s", err)
+		}
+		response.Body.Close()
+	}
+	put("/bar", "ignored") // outside of the prefix
+	put("/foo/a", "Value_A")
+	name, data := readEvent(t, stream)
+	if name != "write" || data.Key != "/foo/a" || string(data.Value) != "Value_A" || data.ContentType != "text/plain" {
+		t.Errorf("Unexpected event: %s of %+v", name, data)
+	}
+	req, _ := http.NewRequest("DELETE", server.URL+"/foo/a", nil)
+	if response, err := http.DefaultClient.Do(req); err == nil {
+		response.Body.Close()
+	}
+	name, data = readEvent(t, stream)
+	if name != "delete" || data.Key != "/foo/a" || data.Value != nil {
+		t.Errorf("Unexpected event: %s of %+v", name, data)
+	}
+
+	// The handler returns once the client goes away
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The stream outlived its client")
+	}
+
+	// Values are only sent when asked for, and streams end on shutdown
+	response, stream = watch(t, context.Background(), server.URL+"/_watch")
+	defer response.Body.Close()
+	put("/bar", "Value_Bar")
+	if name, data := readEvent(t, stream); name != "write" || data.Key != "/bar" || data.Value != nil {
+		t.Errorf("Unexpected event: %s of %+v", name, data)
+	}
+	handler.endWatches()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The stream outlived the shutdown")
+	}
+
+	response, err := http.Post(server.URL+"/_watch", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("POST failed: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status of POST: %d", response.StatusCode)
+	}
+}
+
+func TestWatchShutdown(t *testing.T) {
+	port := freePort(t)
+	setConfig(t, "port", port)
+	db := engine.NewInMemoryNabiaDB()
+	handler := NewNabiaHttp(db)
+	ready := make(chan struct{})
+	server, err := startServer(handler, ready)
+	if err != nil {
+		t.Fatalf("Failed to start server: %s", err)
+	}
+	<-ready
+	response, stream := watch(t, context.Background(), fmt.Sprintf("http://127.0.0.1:%d/_watch", port))
+	defer response.Body.Close()
+
+	// The stream ends with a shutdown event, and the shutdown doesn't wait for
+	// the client to go away
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- shutdown(server, handler) }()
+	if name, _ := readEvent(t, stream); name != "shutdown" {
+		t.Errorf("Unexpected event on shutdown: %s", name)
+	}
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Errorf("Failed to shut down: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The shutdown waited for the stream")
+	}
+	if _, err := stream.ReadString('\n'); err == nil {
+		t.Error("The stream outlived the shutdown")
+	}
+}
+
+func TestMaxWatchers(t *testing.T) {
+	setConfig(t, "max_watchers", 1)
+	db, err := openDB(filepath.Join(t.TempDir(), "nabia.db"))
+	if err != nil {
+		t.Fatalf("Failed to open Nabia DB: %q", err)
+	}
+	defer db.Stop()
+	handler := NewNabiaHttp(db)
+	served := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		served <- struct{}{}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	response, _ := watch(t, ctx, server.URL+"/_watch")
+	defer response.Body.Close()
+	refused, err := http.Get(server.URL + "/_watch")
+	if err != nil {
+		t.Fatalf("Failed to watch: %s", err)
+	}
+	refused.Body.Close()
+	<-served
+	if refused.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status beyond max_watchers: %d", refused.StatusCode)
+	}
+
+	// A stream whose client went away frees its slot
+	cancel()
+	<-served
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	response, _ = watch(t, ctx, server.URL+"/_watch")
+	defer response.Body.Close()
+}
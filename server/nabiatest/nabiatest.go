@@ -0,0 +1,44 @@
+// Package nabiatest runs a Nabia server in-process, so that programs using
+// Nabia can test their integration without starting one.
+package nabiatest
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/Nabia-DB/nabia/client/client"
+	engine "github.com/Nabia-DB/nabia/core/engine"
+	"github.com/Nabia-DB/nabia/server/nabiahttp"
+)
+
+// NewTestServer starts the Nabia HTTP API on an httptest.Server, backed by a
+// fresh database in memory. It returns the URL of the server, a client of it,
+// and the function shutting both down, which must be deferred. The server is
+// configured as the nabia server command would be, by viper.
+func NewTestServer(t testing.TB) (string, *client.Client, func()) {
+	t.Helper()
+	db := engine.NewInMemoryNabiaDB()
+	handler := nabiahttp.NewNabiaHttp(db)
+	server := httptest.NewServer(handler)
+	address, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected URL of the test server: %s", err)
+	}
+	host, port, err := net.SplitHostPort(address.Host)
+	if err != nil {
+		t.Fatalf("Unexpected address of the test server: %s", err)
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		t.Fatalf("Unexpected port of the test server: %s", err)
+	}
+	c := client.New(host, uint16(number))
+	c.HTTPClient = server.Client()
+	return server.URL, c, func() {
+		server.Close()
+		handler.Stop()
+	}
+}
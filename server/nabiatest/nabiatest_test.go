@@ -0,0 +1,49 @@
+package nabiatest_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/Nabia-DB/nabia/client/client"
+	"github.com/Nabia-DB/nabia/server/nabiatest"
+)
+
+// TestNewTestServer creates, reads, updates and deletes a key through the
+// harness, as the tests of a program using Nabia would.
+func TestNewTestServer(t *testing.T) {
+	url, c, teardown := nabiatest.NewTestServer(t)
+	defer teardown()
+
+	if err := c.Post("/greeting", []byte("Hello"), "text/plain"); err != nil {
+		t.Fatalf("Failed to create a key: %s", err)
+	}
+	if err := c.Post("/greeting", []byte("Hello"), "text/plain"); !errors.Is(err, client.ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	if value, ctype, err := c.Get("/greeting"); err != nil || string(value) != "Hello" || ctype != "text/plain" {
+		t.Errorf("Unexpected value: %q of %q (%v)", value, ctype, err)
+	}
+	if err := c.Put("/greeting", []byte("Hello, world"), "text/plain"); err != nil {
+		t.Fatalf("Failed to update a key: %s", err)
+	}
+	if value, _, _ := c.Get("/greeting"); string(value) != "Hello, world" {
+		t.Errorf("Unexpected value after an update: %q", value)
+	}
+	if err := c.Delete("/greeting"); err != nil {
+		t.Fatalf("Failed to delete a key: %s", err)
+	}
+	if _, _, err := c.Get("/greeting"); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// The server can be reached without the client as well
+	response, err := http.Get(url + "/_readyz")
+	if err != nil {
+		t.Fatalf("Failed to reach the server: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status: %d", response.StatusCode)
+	}
+}